@@ -0,0 +1,82 @@
+package saovivo
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry is a change made through the API.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Role   string    `json:"role"`
+	Remote string    `json:"remote"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Detail string    `json:"detail,omitempty"` // Body of the request, without passwords
+	Status int       `json:"status"`
+}
+
+// Audit appends the changes to a file, one json object per line, the file is
+// never rewritten.
+type Audit struct {
+	path string
+	lock *sync.Mutex
+}
+
+func NewAudit(path string) *Audit {
+	return &Audit{path: path, lock: &sync.Mutex{}}
+}
+
+func (a *Audit) Record(e AuditEntry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		lerr.Printf("Audit: %v", err)
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		lerr.Printf("Audit: unable to open %s: %v", a.path, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		lerr.Printf("Audit: unable to write %s: %v", a.path, err)
+	}
+}
+
+// Recent returns the last n entries of user, of every user when it is empty,
+// the newest first.
+func (a *Audit) Recent(n int, user string) ([]AuditEntry, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	entries := []AuditEntry{}
+	f, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil || (user != "" && e.User != user) {
+			continue
+		}
+		entries = append(entries, e)
+		if len(entries) > n {
+			entries = entries[1:]
+		}
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, scanner.Err()
+}
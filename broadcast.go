@@ -0,0 +1,580 @@
+package saovivo
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+type DestinationStatus struct {
+	Id       string `json:"id"`
+	State    string `json:"state"` // connecting, online, reconnecting or failed
+	Error    string `json:"error,omitempty"`
+	Attempts int    `json:"attempts,omitempty"` // Reconnect attempts
+}
+
+type ChannelOptions struct {
+	// Continuous restarts the pacer for every video and re-stamps the
+	// timestamps, so the destinations receive one uninterrupted stream.
+	Continuous bool
+	// Reconnect is applied when a destination or the whole output fails.
+	Reconnect ReconnectPolicy
+	// Notify is called when a destination fails, reconnects or gives up.
+	Notify func(DestinationStatus)
+	// NotifyReconnect is called on every attempt to restart the output.
+	NotifyReconnect func(attempt int, err error)
+	// Overlays, when set, are burned over every video in continuous playout,
+	// the ones added or enabled on air are seen without restarting the pacer.
+	Overlays *Overlays
+	// Profile encodes the videos of the channel, DefaultProfile when empty.
+	Profile Profile
+	// Profiles resolves the profiles of the destinations that re-encode.
+	Profiles *Profiles
+	// Slate is the image shown under the assets that only have audio, a
+	// black frame when it does not exist.
+	Slate string
+	// Prefetcher, when set, reports the transcode of the videos ingested
+	// while they play.
+	Prefetcher *Prefetcher
+	// Hls, when set, publishes the channel as HLS besides the destinations.
+	Hls *HlsOutput
+	// Rtmp, when set, is where the channel is published to the RtmpServer of
+	// the process besides the destinations.
+	Rtmp string
+}
+
+// profile returns the encoding of the channel.
+func (o ChannelOptions) profile() Profile {
+	if o.Profile.Id == "" {
+		return DefaultProfile
+	}
+	return o.Profile
+}
+
+// PlayoutItem is a video sent to the Broadcast
+type PlayoutItem struct {
+	Video      io.ReadCloser
+	Duration   float64 // Seconds, 0 when unknown
+	Transition Transition
+}
+
+// Broadcast paces the videos sent to the channel in real time and delivers
+// the resulting stream to every connected destination.
+type Broadcast struct {
+	Input  chan *PlayoutItem
+	Output chan error
+
+	ffmpeg       *FFMPEG
+	stopped      bool
+	lock         *sync.Mutex
+	closed       bool
+	done         chan struct{}
+	policy       ReconnectPolicy
+	destinations map[string]Destination
+	outputs      map[string]*RtmpOutput
+	status       map[string]*DestinationStatus
+	notify       func(DestinationStatus)
+	overlays     *Overlays
+	profile      Profile
+	profiles     *Profiles
+	hls          *HlsOutput
+	rtmp         string
+	wg           *sync.WaitGroup
+}
+
+// frameGap separates the last frame of a video from the first one of the next
+// video in continuous mode.
+const frameGap = 0.05
+
+func NewBroadcast(destinations []Destination, options ChannelOptions) (*Broadcast, error) {
+	var b Broadcast
+
+	b.Input = make(chan *PlayoutItem)
+	b.Output = make(chan error)
+	b.lock = &sync.Mutex{}
+	b.outputs = make(map[string]*RtmpOutput)
+	b.status = make(map[string]*DestinationStatus)
+	b.destinations = make(map[string]Destination)
+	b.done = make(chan struct{})
+	b.policy = options.Reconnect
+	b.notify = options.Notify
+	b.overlays = options.Overlays
+	b.profile = options.profile()
+	b.profiles = options.Profiles
+	b.hls = options.Hls
+	b.rtmp = options.Rtmp
+	b.wg = &sync.WaitGroup{}
+
+	if options.Continuous {
+		b.addDestinations(destinations)
+		go b.continuous()
+		return &b, nil
+	}
+
+	in, intcp, err := listenLocal()
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	out, outtcp, err := listenLocal()
+	if err != nil {
+		return nil, err
+	}
+	// ffmpeg connects to its output after reading the first video
+	out.SetDeadline(time.Time{})
+
+	b.ffmpeg = FFMPEGStream(intcp, outtcp, b.pacePreset(Transition{}, 0))
+	b.ffmpeg.Run()
+
+	dst, err := in.Accept()
+	if err != nil {
+		out.Close()
+		b.ffmpeg.StopAndWait()
+		return nil, err
+	}
+
+	b.addDestinations(destinations)
+
+	distributed := make(chan struct{})
+	go func() {
+		b.relay(out)
+		close(distributed)
+	}()
+
+	go func() {
+		lout.Printf("Broadcast: Start, listen on: %s, sending to: %s", intcp, outtcp)
+		for {
+			item := <-b.Input
+			if item == nil {
+				lout.Println("Broadcast: nothing to do, stoping")
+				dst.Close()
+				e := b.ffmpeg.Wait()
+				out.Close()
+				<-distributed
+				b.close()
+				b.Output <- e
+				goto end_loop
+			}
+			err := copyVideo(dst, item.Video)
+			item.Video.Close()
+			if err != nil {
+				lerr.Printf("Broadcast: send with error: %v", err)
+				dst.Close()
+				e := b.ffmpeg.Wait()
+				out.Close()
+				<-distributed
+				b.close()
+				b.Output <- e
+				goto end_loop
+			}
+			b.Output <- nil
+		}
+	end_loop:
+		lout.Println("Broadcast: End")
+	}()
+	return &b, nil
+}
+
+func (b *Broadcast) addDestinations(destinations []Destination) {
+	if b.hls != nil {
+		destinations = append(destinations, Destination{Id: HlsDestination, Name: "HLS", Url: b.hls.Dir, Enabled: true})
+	}
+	if b.rtmp != "" {
+		destinations = append(destinations, Destination{Id: RtmpDestination, Name: "RTMP", Url: b.rtmp, Enabled: true})
+	}
+	for _, d := range destinations {
+		if d.Enabled {
+			if err := b.Add(d); err != nil {
+				lerr.Printf("Broadcast: unable to connect %s: %v", d.Url, err)
+			}
+		}
+	}
+}
+
+// continuous runs a pacer for every video, each one starting where the
+// timestamps of the previous video ended.
+func (b *Broadcast) continuous() {
+	lout.Println("Broadcast: Start continuous playout")
+	offset := 0.0
+	for {
+		item := <-b.Input
+		if item == nil {
+			lout.Println("Broadcast: nothing to do, stoping")
+			b.close()
+			b.Output <- nil
+			break
+		}
+		var err error
+		if item.Transition.Kind == BlackTransition && item.Transition.Duration > 0 {
+			var d float64
+			d, err = b.pace(blackInput, nil, blackPreset(item.Transition.Duration, b.profile), offset)
+			offset += d
+		}
+		if err == nil {
+			var d float64
+			d, err = b.pace("", item.Video, b.pacePreset(item.Transition, item.Duration), offset)
+			offset += d
+		} else {
+			item.Video.Close()
+		}
+		if err != nil {
+			lerr.Printf("Broadcast: send with error: %v", err)
+			b.close()
+			b.Output <- err
+			break
+		}
+		b.Output <- nil
+	}
+	lout.Println("Broadcast: End")
+}
+
+// pacePreset returns the preset of the pacer, it always re-encodes the video
+// with the overlays of the channel so they can be enabled at any time.
+func (b *Broadcast) pacePreset(t Transition, duration float64) Preset {
+	if b.overlays == nil {
+		return transitionPreset(t, duration, b.profile)
+	}
+	video, audio := transitionFilters(t, duration)
+	return b.overlays.burn([]string{"-re"}, video, audio, b.profile)
+}
+
+// outputProfile returns the profile that re-encodes the stream for a
+// destination, nil when the stream is copied.
+func (b *Broadcast) outputProfile(d Destination) (*Profile, error) {
+	if d.Profile == "" {
+		return nil, validOutputCodec(d.Url, b.profile)
+	}
+	if b.profiles == nil {
+		return nil, fmt.Errorf("profile %s not found", d.Profile)
+	}
+	p, err := b.profiles.Get(d.Profile)
+	if err != nil {
+		return nil, err
+	}
+	return &p, validOutputCodec(d.Url, p)
+}
+
+// connect starts the output of a destination, the HLS of the channel is
+// written to its directory.
+func (b *Broadcast) connect(d Destination) (*RtmpOutput, error) {
+	if d.Id == HlsDestination && b.hls != nil {
+		return NewHlsOutput(*b.hls, b.profile)
+	}
+	if err := ValidateOutputURL(d.Url); err != nil {
+		return nil, err
+	}
+	profile, err := b.outputProfile(d)
+	if err != nil {
+		return nil, err
+	}
+	return NewRtmpOutput(d.Url, profile)
+}
+
+// pace sends a video through its own pacer, when src is nil the input is
+// given to ffmpeg as is. It returns the duration of the stream sent, only the
+// failures caused by Stop are returned as errors.
+func (b *Broadcast) pace(input string, src io.ReadCloser, preset Preset, offset float64) (float64, error) {
+	var in *net.TCPListener
+	if src != nil {
+		defer src.Close()
+		l, tcp, err := listenLocal()
+		if err != nil {
+			return 0, err
+		}
+		defer l.Close()
+		in, input = l, tcp
+	}
+	out, outtcp, err := listenLocal()
+	if err != nil {
+		return 0, err
+	}
+	out.SetDeadline(time.Time{})
+
+	b.lock.Lock()
+	if b.stopped {
+		b.lock.Unlock()
+		out.Close()
+		return 0, fmt.Errorf("broadcast stopped")
+	}
+	ffmpeg := FFMPEGStream(input, outtcp, preset.withOutputOptions("-output_ts_offset", fmt.Sprintf("%.3f", offset)))
+	b.ffmpeg = ffmpeg
+	ffmpeg.Run()
+	b.lock.Unlock()
+
+	span := make(chan float64, 1)
+	go func() {
+		span <- b.relay(out)
+	}()
+
+	if in != nil {
+		dst, err := in.Accept()
+		if err == nil {
+			err = copyVideo(dst, src)
+			dst.Close()
+		}
+		if err != nil {
+			lerr.Printf("Broadcast: send with error: %v", err)
+			ffmpeg.Stop()
+		}
+	}
+	ferr := ffmpeg.Wait()
+	out.Close()
+	d := <-span
+
+	b.lock.Lock()
+	stopped := b.stopped
+	b.lock.Unlock()
+	if stopped {
+		return d, fmt.Errorf("broadcast stopped")
+	}
+	if ferr != nil {
+		// A video that ffmpeg can not read does not end the channel
+		lerr.Printf("Broadcast: pacer ends with error: %v", ferr)
+	}
+	if d > 0 {
+		d += frameGap
+	}
+	return d, nil
+}
+
+// close disconnects the destinations once there is nothing more to send.
+func (b *Broadcast) close() {
+	b.lock.Lock()
+	if !b.closed {
+		close(b.done)
+	}
+	b.closed = true
+	for id, o := range b.outputs {
+		close(o.Input)
+		delete(b.outputs, id)
+	}
+	b.lock.Unlock()
+	b.wg.Wait()
+}
+
+// copyVideo sends a video to the pacer, only the errors writing to the pacer
+// are returned, a video that can not be read any more just ends there.
+func copyVideo(dst io.Writer, src io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, e := dst.Write(buf[:n]); e != nil {
+				return e
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				lerr.Printf("Broadcast: video ends with error: %v", err)
+			}
+			return nil
+		}
+	}
+}
+
+// relay accepts the connection of a pacer and delivers its stream to the
+// destinations, it returns the seconds of stream seen.
+func (b *Broadcast) relay(srv *net.TCPListener) float64 {
+	var clock tsClock
+
+	src, err := srv.Accept()
+	if err != nil {
+		return 0
+	}
+	defer src.Close()
+
+	for {
+		buf := make([]byte, 188*64)
+		n, err := src.Read(buf)
+		if n > 0 {
+			clock.Write(buf[:n])
+			b.lock.Lock()
+			for id, o := range b.outputs {
+				select {
+				case o.Input <- buf[:n]:
+				default:
+					// The destination does not keep up with the stream, drop it
+					// instead of delaying the rest of them.
+					lerr.Printf("Broadcast: destination %s stalled", id)
+					delete(b.outputs, id)
+					close(o.Input)
+					o.Stop()
+					go b.reconnect(id, fmt.Errorf("destination stalled"))
+				}
+			}
+			b.lock.Unlock()
+		}
+		if err != nil {
+			return clock.Duration()
+		}
+	}
+}
+
+func (b *Broadcast) watch(id string, o *RtmpOutput) {
+	defer b.wg.Done()
+	err := <-o.Output
+	b.lock.Lock()
+	if b.outputs[id] != o {
+		// Removed, stalled or finished with the broadcast
+		b.lock.Unlock()
+		return
+	}
+	delete(b.outputs, id)
+	b.lock.Unlock()
+	if err == nil {
+		err = fmt.Errorf("output finished")
+	}
+	lerr.Printf("Broadcast: destination %s failed: %v", id, err)
+	b.reconnect(id, err)
+}
+
+// reconnect tries to connect again a failed destination following the
+// reconnect policy, the rest of the destinations keep sending meanwhile.
+func (b *Broadcast) reconnect(id string, cause error) {
+	b.lock.Lock()
+	d, ok := b.destinations[id]
+	if !ok || b.closed {
+		b.lock.Unlock()
+		return
+	}
+	st := &DestinationStatus{Id: id, State: "failed", Error: cause.Error()}
+	b.status[id] = st
+	b.lock.Unlock()
+
+	for attempt := 1; attempt <= b.policy.MaxAttempts; attempt++ {
+		b.lock.Lock()
+		st.State, st.Attempts = "reconnecting", attempt
+		s := *st
+		b.lock.Unlock()
+		b.notify(s)
+
+		select {
+		case <-time.After(b.policy.delay(attempt)):
+		case <-b.done:
+			return
+		}
+
+		o, err := b.connect(d)
+		b.lock.Lock()
+		if b.status[id] != st || b.closed {
+			// Removed or updated while reconnecting
+			b.lock.Unlock()
+			if err == nil {
+				close(o.Input)
+				<-o.Output
+			}
+			return
+		}
+		if err == nil {
+			b.outputs[id] = o
+			st.State, st.Attempts, st.Error = "online", 0, ""
+			s := *st
+			b.wg.Add(1)
+			go b.watch(id, o)
+			b.lock.Unlock()
+			lout.Printf("Broadcast: destination %s reconnected", id)
+			b.notify(s)
+			return
+		}
+		st.Error = err.Error()
+		b.lock.Unlock()
+		lerr.Printf("Broadcast: destination %s reconnect attempt %d: %v", id, attempt, err)
+	}
+
+	b.lock.Lock()
+	if b.status[id] != st {
+		b.lock.Unlock()
+		return
+	}
+	st.State = "failed"
+	s := *st
+	b.lock.Unlock()
+	b.notify(s)
+}
+
+// Add connects a new destination to the running broadcast.
+func (b *Broadcast) Add(d Destination) error {
+	b.lock.Lock()
+	if s, ok := b.status[d.Id]; (ok && s.State != "failed") || b.closed {
+		b.lock.Unlock()
+		return fmt.Errorf("destination %s can not be added", d.Id)
+	}
+	st := &DestinationStatus{Id: d.Id, State: "connecting"}
+	b.status[d.Id] = st
+	b.destinations[d.Id] = d
+	b.lock.Unlock()
+
+	o, err := b.connect(d)
+
+	b.lock.Lock()
+	if err != nil {
+		b.lock.Unlock()
+		go b.reconnect(d.Id, err)
+		return err
+	}
+	if b.status[d.Id] != st || b.closed {
+		// Removed while connecting
+		b.lock.Unlock()
+		close(o.Input)
+		<-o.Output
+		return fmt.Errorf("destination %s removed", d.Id)
+	}
+	b.outputs[d.Id] = o
+	st.State = "online"
+	b.wg.Add(1)
+	go b.watch(d.Id, o)
+	b.lock.Unlock()
+	return nil
+}
+
+// Remove disconnects a destination, the rest of them keep sending.
+func (b *Broadcast) Remove(id string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if o, ok := b.outputs[id]; ok {
+		delete(b.outputs, id)
+		close(o.Input)
+	}
+	delete(b.status, id)
+	delete(b.destinations, id)
+}
+
+// configured returns the destinations added to the broadcast, connected or
+// not. The HLS and the RTMP of the channel are added again by the new
+// broadcast.
+func (b *Broadcast) configured() []Destination {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	destinations := []Destination{}
+	for id, d := range b.destinations {
+		if id != HlsDestination && id != RtmpDestination {
+			destinations = append(destinations, d)
+		}
+	}
+	return destinations
+}
+
+func (b *Broadcast) Status() []DestinationStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	status := []DestinationStatus{}
+	for _, s := range b.status {
+		status = append(status, *s)
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Id < status[j].Id
+	})
+	return status
+}
+
+func (b *Broadcast) Stop() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.stopped = true
+	if b.ffmpeg != nil {
+		b.ffmpeg.Stop()
+	}
+}
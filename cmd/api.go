@@ -0,0 +1,516 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"saovivo"
+	"strings"
+)
+
+// apiPrefix is where the versioned API is served, the /playlist routes are
+// kept for the web UI. Every route is also served for a channel under
+// /api/v1/channels/{id}.
+const apiPrefix = "/api/v1"
+
+type apiError struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// apiItem is an asset of the playlist with where it is and how far its
+// transcode is.
+type apiItem struct {
+	saovivo.Asset
+	Place    string              `json:"place"`              // inPlay, queued or reproduced
+	Position *int                `json:"position,omitempty"` // In the queue
+	Ingest   saovivo.IngestState `json:"ingest"`
+}
+
+// itemsRequest adds items to the playlist from one of its sources, the files
+// are uploaded as multipart/form-data instead.
+type itemsRequest struct {
+	Url     string              `json:"url,omitempty"`     // Youtube, media file, HLS, DASH or s3://bucket/key
+	Library []string            `json:"library,omitempty"` // Items of the library
+	Live    *saovivo.LiveSource `json:"live,omitempty"`
+	Name    string              `json:"name,omitempty"` // Of the live source
+}
+
+// itemsResponse has the items added, or the jobs that process the uploaded
+// files and add them when they are ready.
+type itemsResponse struct {
+	Items []apiItem     `json:"items"`
+	Jobs  []saovivo.Job `json:"jobs"`
+}
+
+type itemRequest struct {
+	Name       *string             `json:"name"`
+	Transition *saovivo.Transition `json:"transition"`
+	Segments   *[]saovivo.Segment  `json:"segments"` // Empty plays the whole source
+}
+
+type positionRequest struct {
+	Position *int `json:"position"`
+}
+
+type outputBody struct {
+	Url string `json:"url"` // Rtmp url or youtube stream key
+}
+
+type settingsBody struct {
+	Loop       *bool                    `json:"loop"`
+	Continuous *bool                    `json:"continuous"`
+	Reconnect  *saovivo.ReconnectPolicy `json:"reconnect"`
+	Prefetch   *int                     `json:"prefetch"`
+	Profile    *string                  `json:"profile"`
+}
+
+type playbackRequest struct {
+	Status string `json:"status"` // start, stop or return
+}
+
+type playbackResponse struct {
+	Status       string         `json:"status"`
+	InPlay       *saovivo.Asset `json:"inPlay"`
+	Reconnecting int            `json:"reconnecting"`
+	Outputs      interface{}    `json:"outputs"` // Without the stream keys below operator
+	Hls          *hlsStatus     `json:"hls,omitempty"`
+	Rtmp         *rtmpStatus    `json:"rtmp,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	writeJSON(w, status, apiError{Error: fmt.Sprintf(format, a...), Status: status})
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allow ...string) {
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+}
+
+// decode reads the json body into v, unknown keys are an error.
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if e := dec.Decode(v); e != nil {
+		writeError(w, http.StatusBadRequest, "wrong body: %v", e)
+		return false
+	}
+	return true
+}
+
+type apiRouter struct {
+	registry *Registry
+}
+
+func (api *apiRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+	if path == "openapi.json" {
+		if r.Method != "GET" {
+			methodNotAllowed(w, r, "GET")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(openAPI))
+		return
+	}
+	parts := strings.Split(path, "/")
+	vs := api.registry.Default()
+	if parts[0] == "channels" && len(parts) > 2 {
+		if vs = api.registry.Get(parts[1]); vs == nil {
+			writeError(w, http.StatusNotFound, "channel %s not found", parts[1])
+			return
+		}
+		parts = parts[2:]
+	}
+	switch {
+	case len(parts) == 1 && parts[0] == "items":
+		vs.apiItems(w, r)
+	case len(parts) == 2 && parts[0] == "items":
+		vs.apiItem(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "items" && parts[2] == "position":
+		vs.apiItemPosition(w, r, parts[1])
+	case len(parts) == 1 && parts[0] == "output":
+		vs.apiOutput(w, r)
+	case len(parts) == 1 && parts[0] == "settings":
+		vs.apiSettings(w, r)
+	case len(parts) == 1 && parts[0] == "playback":
+		vs.apiPlayback(w, r)
+	case len(parts) == 1 && parts[0] == "jobs":
+		vs.apiJobs(w, r)
+	case len(parts) == 2 && parts[0] == "jobs":
+		vs.apiJob(w, r, parts[1])
+	case len(parts) == 1 && parts[0] == "uploads":
+		vs.apiUploads(w, r)
+	case len(parts) == 2 && parts[0] == "uploads":
+		vs.apiUpload(w, r, parts[1])
+	default:
+		writeError(w, http.StatusNotFound, "%s not found", r.URL.Path)
+	}
+}
+
+// item returns an asset of the playlist for the API, must be called with the
+// lock held.
+func (vs *VideoServer) item(a *saovivo.Asset) apiItem {
+	item := apiItem{Asset: *a, Ingest: vs.prefetcher.State(a, vs.channelProfile())}
+	place, position := vs.playlist.Locate(a.Id)
+	item.Place = place
+	if place == "queued" {
+		item.Position = &position
+	}
+	return item
+}
+
+// items returns the playlist in play order, must be called with the lock
+// held.
+func (vs *VideoServer) items() []apiItem {
+	items := []apiItem{}
+	for _, a := range vs.playlist.Assets() {
+		items = append(items, vs.item(a))
+	}
+	return items
+}
+
+// addItems appends assets to the playlist and returns them as items.
+func (vs *VideoServer) addItems(assets []*saovivo.Asset) []apiItem {
+	vs.catalog(assets)
+	for _, a := range assets {
+		vs.appendToPlaylist(a)
+		vs.notify("El video <b>%s</b> ha sido agregado a la lista de reproducción", a.Name)
+	}
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	items := []apiItem{}
+	for _, a := range assets {
+		items = append(items, vs.item(a))
+	}
+	return items
+}
+
+func (vs *VideoServer) apiItemsPost(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		jobs, err := vs.receiver.Recv(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, itemsResponse{Items: []apiItem{}, Jobs: jobs})
+		return
+	}
+	var body itemsRequest
+	if !decode(w, r, &body) {
+		return
+	}
+	var assets []*saovivo.Asset
+	switch {
+	case body.Url != "":
+		url := body.Url
+		if !strings.Contains(url, "://") {
+			url = "http://" + url
+		}
+		remote, err := vs.receiver.GetRemote(url)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		assets = remote
+	case len(body.Library) > 0:
+		for _, id := range body.Library {
+			a, err := vs.library.Asset(id)
+			if err != nil {
+				writeError(w, http.StatusNotFound, "%v", err)
+				return
+			}
+			assets = append(assets, a)
+		}
+	case body.Live != nil:
+		if e := body.Live.Validate(); e != nil {
+			writeError(w, http.StatusBadRequest, "%v", e)
+			return
+		}
+		if body.Name == "" {
+			body.Name = body.Live.Url
+		}
+		a := saovivo.NewLiveAsset(body.Name, *body.Live)
+		vs.appendToPlaylist(a)
+		vs.notify("La transmisión en vivo <b>%s</b> ha sido agregada a la lista de reproducción", a.Name)
+		vs.lock.Lock()
+		item := vs.item(a)
+		vs.lock.Unlock()
+		writeJSON(w, http.StatusCreated, itemsResponse{Items: []apiItem{item}, Jobs: []saovivo.Job{}})
+		return
+	default:
+		writeError(w, http.StatusBadRequest, "url, library or live is required")
+		return
+	}
+	writeJSON(w, http.StatusCreated, itemsResponse{Items: vs.addItems(assets), Jobs: []saovivo.Job{}})
+}
+
+// apiItems lists the playlist, adds items to it or clears it while the
+// channel is stopped.
+func (vs *VideoServer) apiItems(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		vs.lock.Lock()
+		items := vs.items()
+		vs.lock.Unlock()
+		writeJSON(w, http.StatusOK, items)
+	case "POST":
+		vs.apiItemsPost(w, r)
+	case "DELETE":
+		vs.lock.Lock()
+		defer vs.lock.Unlock()
+		if vs.status != "stop" {
+			writeError(w, http.StatusConflict, "the playlist can not be cleared while the channel is on air")
+			return
+		}
+		vs.playlist.RemoveAll()
+		vs.persist()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, r, "GET", "POST", "DELETE")
+	}
+}
+
+func (vs *VideoServer) apiItem(w http.ResponseWriter, r *http.Request, id string) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	a := vs.playlist.GetAssetById(id)
+	if a == nil {
+		writeError(w, http.StatusNotFound, "item %s not found", id)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, vs.item(a))
+	case "PATCH":
+		var body itemRequest
+		if !decode(w, r, &body) {
+			return
+		}
+		if body.Name != nil && *body.Name == "" {
+			writeError(w, http.StatusBadRequest, "empty name")
+			return
+		}
+		if body.Transition != nil {
+			if e := body.Transition.Validate(); e != nil {
+				writeError(w, http.StatusBadRequest, "wrong transition: %v", e)
+				return
+			}
+		}
+		// The item in play is being read by the channel
+		if place, _ := vs.playlist.Locate(id); body.Segments != nil && place == "inPlay" {
+			writeError(w, http.StatusConflict, "the item in play can not be trimmed")
+			return
+		}
+		// Trimmed before the rest is applied, it is validated as it is applied
+		if body.Segments != nil {
+			if e := a.Trim(*body.Segments); e != nil {
+				writeError(w, http.StatusBadRequest, "wrong segments: %v", e)
+				return
+			}
+		}
+		if body.Transition != nil {
+			a.Transition = body.Transition
+		}
+		if body.Name != nil {
+			a.Name = *body.Name
+		}
+		vs.persist()
+		writeJSON(w, http.StatusOK, vs.item(a))
+	case "DELETE":
+		if place, _ := vs.playlist.Locate(id); place != "queued" {
+			writeError(w, http.StatusConflict, "only a queued item can be removed")
+			return
+		}
+		vs.playlist.Remove(id)
+		vs.persist()
+		vs.notify("Se eliminó <b>%s</b> de la lista de reproducción", a.Name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, r, "GET", "PATCH", "DELETE")
+	}
+}
+
+// apiItemPosition moves an item to a position of the queue, a reproduced item
+// goes back to the queue.
+func (vs *VideoServer) apiItemPosition(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "PUT" {
+		methodNotAllowed(w, r, "PUT")
+		return
+	}
+	var body positionRequest
+	if !decode(w, r, &body) {
+		return
+	}
+	if body.Position == nil {
+		writeError(w, http.StatusBadRequest, "position is required")
+		return
+	}
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	a := vs.playlist.GetAssetById(id)
+	if a == nil {
+		writeError(w, http.StatusNotFound, "item %s not found", id)
+		return
+	}
+	if *body.Position < 0 || *body.Position >= vs.playlist.InQueue() {
+		writeError(w, http.StatusBadRequest, "position must be between 0 and %d", vs.playlist.InQueue()-1)
+		return
+	}
+	if !vs.playlist.MoveByAssetIdToPosition(id, *body.Position) {
+		writeError(w, http.StatusConflict, "the item in play can not be moved")
+		return
+	}
+	vs.persist()
+	writeJSON(w, http.StatusOK, vs.item(a))
+}
+
+// apiOutput is the destination of the channel before there were several, the
+// rest are managed in /playlist/outputs.
+func (vs *VideoServer) apiOutput(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		vs.lock.Lock()
+		body := outputBody{}
+		if d := vs.getDestination(defaultOutput); d != nil {
+			body.Url = d.Url
+		}
+		vs.lock.Unlock()
+		writeJSON(w, http.StatusOK, body)
+	case "PUT":
+		var body outputBody
+		if !decode(w, r, &body) {
+			return
+		}
+		if body.Url == "" {
+			writeError(w, http.StatusBadRequest, "url is required")
+			return
+		}
+		if e := vs.setOutput(body.Url); e != nil {
+			writeError(w, http.StatusBadRequest, "%v", e)
+			return
+		}
+		vs.lock.Lock()
+		body.Url = vs.getDestination(defaultOutput).Url
+		vs.lock.Unlock()
+		writeJSON(w, http.StatusOK, body)
+	default:
+		methodNotAllowed(w, r, "GET", "PUT")
+	}
+}
+
+// settings returns the settings of the channel, must be called with the lock
+// held.
+func (vs *VideoServer) settings() settingsBody {
+	loop, continuous, reconnect, prefetch, profile := vs.loop, vs.continuous, vs.reconnect, vs.prefetch, vs.profile
+	return settingsBody{Loop: &loop, Continuous: &continuous, Reconnect: &reconnect, Prefetch: &prefetch, Profile: &profile}
+}
+
+// apiSettings changes the settings given, nothing is changed when one of
+// them is wrong. They apply the next time the channel starts.
+func (vs *VideoServer) apiSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		vs.lock.Lock()
+		settings := vs.settings()
+		vs.lock.Unlock()
+		writeJSON(w, http.StatusOK, settings)
+	case "PATCH":
+		var body settingsBody
+		if !decode(w, r, &body) {
+			return
+		}
+		if body.Reconnect != nil {
+			if e := body.Reconnect.Validate(); e != nil {
+				writeError(w, http.StatusBadRequest, "wrong reconnect policy: %v", e)
+				return
+			}
+		}
+		if body.Prefetch != nil && (*body.Prefetch < 0 || *body.Prefetch > 20) {
+			writeError(w, http.StatusBadRequest, "prefetch must be between 0 and 20")
+			return
+		}
+		if body.Profile != nil {
+			if _, e := vs.profiles.Get(*body.Profile); e != nil {
+				writeError(w, http.StatusBadRequest, "%v", e)
+				return
+			}
+		}
+		vs.lock.Lock()
+		defer vs.lock.Unlock()
+		if body.Loop != nil {
+			vs.loop = *body.Loop
+		}
+		if body.Continuous != nil {
+			vs.continuous = *body.Continuous
+		}
+		if body.Reconnect != nil {
+			vs.reconnect = *body.Reconnect
+		}
+		if body.Prefetch != nil {
+			vs.prefetch = *body.Prefetch
+			vs.prefetchUpcoming()
+		}
+		if body.Profile != nil {
+			vs.profile = *body.Profile
+		}
+		vs.persist()
+		writeJSON(w, http.StatusOK, vs.settings())
+	default:
+		methodNotAllowed(w, r, "GET", "PATCH")
+	}
+}
+
+// playback returns the state of the channel, with the urls and keys of the
+// destinations only when keys is set.
+func (vs *VideoServer) playback(keys bool) playbackResponse {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	p := playbackResponse{Status: vs.status, InPlay: vs.playlist.InPlay(), Outputs: vs.outputsView(keys), Hls: vs.hlsStatus(), Rtmp: vs.rtmpStatus()}
+	if vs.playing != nil {
+		p.InPlay = vs.playing.Asset
+	}
+	if vs.vc != nil {
+		p.Reconnecting = vs.vc.Attempts()
+	}
+	return p
+}
+
+// apiPlayback starts or stops the channel, return ends the live source or
+// video in play and continues with the playlist.
+func (vs *VideoServer) apiPlayback(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, vs.playback(allowed(r, saovivo.RoleOperator)))
+	case "PUT":
+		var body playbackRequest
+		if !decode(w, r, &body) {
+			return
+		}
+		var err error
+		switch body.Status {
+		case "start":
+			err = vs.start()
+		case "stop":
+			err = vs.stop()
+		case "return":
+			err = vs.back()
+		default:
+			writeError(w, http.StatusBadRequest, "wrong status, must be start, stop or return")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusConflict, "%v", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, vs.playback(allowed(r, saovivo.RoleOperator)))
+	default:
+		methodNotAllowed(w, r, "GET", "PUT")
+	}
+}
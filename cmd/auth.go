@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"saovivo"
+	"strings"
+	"time"
+)
+
+const sessionCookie = "saovivo_session"
+
+// auditBody is the biggest body of a request kept in the audit trail
+const auditBody = 4096
+
+type contextKey string
+
+const userKey contextKey = "user"
+
+// auth checks who makes every request and what its role lets it do, and
+// keeps the audit trail of the changes.
+type auth struct {
+	users   *saovivo.Users
+	audit   *saovivo.Audit
+	origins []string // Allowed by CORS, * is any
+}
+
+// newAuth restores the users, the first time it creates an admin with a
+// random password that is printed once.
+func newAuth(dir string, origins string) *auth {
+	a := &auth{
+		users: saovivo.NewUsers(saovivo.NewStore(filepath.Join(dir, "users.json"))),
+		audit: saovivo.NewAudit(filepath.Join(dir, "audit.log")),
+	}
+	for _, o := range strings.Split(origins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			a.origins = append(a.origins, strings.TrimSuffix(o, "/"))
+		}
+	}
+	if a.users.Len() == 0 {
+		password := saovivo.NewPassword()
+		if _, err := a.users.Add("admin", password, saovivo.RoleAdmin); err != nil {
+			fmt.Printf("Error: unable to create the admin user: %v\n", err)
+		} else {
+			fmt.Printf("User admin created with password: %s\n", password)
+		}
+	}
+	return a
+}
+
+// requiredRole returns the role needed by a request, empty when it is open to
+// anyone. The routes of a channel need the same roles as the ones of the
+// default channel.
+func requiredRole(method string, path string) string {
+	path = strings.TrimSuffix(path, "/")
+	read := method == "GET" || method == "HEAD"
+	api := strings.HasPrefix(path, apiPrefix+"/")
+	if api {
+		path = strings.TrimPrefix(path, apiPrefix)
+	}
+	if strings.HasPrefix(path, "/channels/") {
+		parts := strings.SplitN(strings.TrimPrefix(path, "/channels/"), "/", 2)
+		if len(parts) == 1 {
+			// The channel itself
+			if read {
+				return saovivo.RoleViewer
+			}
+			return saovivo.RoleAdmin
+		}
+		path = "/" + parts[1]
+	}
+	switch {
+	case path == "/version", path == "/login", path == "/auth/login", api && path == "/openapi.json":
+		return ""
+	case api && path == "/output":
+		// The stream key
+		if read {
+			return saovivo.RoleOperator
+		}
+		return saovivo.RoleAdmin
+	case api:
+		if read {
+			return saovivo.RoleViewer
+		}
+		return saovivo.RoleOperator
+	case strings.HasPrefix(path, "/auth"), path == "/tokens":
+		return saovivo.RoleViewer
+	case path == "/users", path == "/audit":
+		return saovivo.RoleAdmin
+	case path == "/playlist/outputs":
+		// The destinations have the stream keys
+		if read {
+			return saovivo.RoleOperator
+		}
+		return saovivo.RoleAdmin
+	case path == "/channels", path == "/profiles":
+		if read {
+			return saovivo.RoleViewer
+		}
+		return saovivo.RoleAdmin
+	case strings.HasPrefix(path, "/playlist"), path == "/library", path == "/platforms", path == "/slate":
+		if read {
+			return saovivo.RoleViewer
+		}
+		return saovivo.RoleOperator
+	}
+	// The files of the web UI
+	return ""
+}
+
+// viewer tells if a token lets play the channels.
+func (a *auth) viewer(token string) bool {
+	user, ok := a.users.Resolve(token)
+	return ok && saovivo.RoleAllows(user.Role, saovivo.RoleViewer)
+}
+
+// userOf returns the user that makes the request.
+func userOf(r *http.Request) (saovivo.User, bool) {
+	user, ok := r.Context().Value(userKey).(saovivo.User)
+	return user, ok
+}
+
+// allowed tells if the user of the request has the role.
+func allowed(r *http.Request, role string) bool {
+	user, ok := userOf(r)
+	return ok && saovivo.RoleAllows(user.Role, role)
+}
+
+// credential returns the key sent as a bearer token or the session cookie.
+// The players of HTTP-FLV can only send it as ?token=.
+func credential(r *http.Request) string {
+	if strings.HasSuffix(r.URL.Path, flvPath) {
+		if token := r.URL.Query().Get("token"); token != "" {
+			return token
+		}
+	}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+func (a *auth) allowedOrigin(origin string) bool {
+	for _, o := range a.origins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// cors answers to the origins configured, a request from any other origin
+// gets no CORS headers and the browser blocks it.
+func (a *auth) cors(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !a.allowedOrigin(origin) {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Last-Event-ID, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset, Upload-Checksum")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Checksum-Algorithm, Upload-Offset, Upload-Length, Upload-Expires, Upload-Job")
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, POST, PUT, PATCH, DELETE")
+	w.Header().Add("Vary", "Origin")
+}
+
+// statusWriter keeps the status of the response for the audit trail, it
+// flushes for the event streams.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// redact hides the passwords and the stream keys of a json body, the url is
+// hidden too in the bodies of the destinations.
+func redact(path string, body []byte) string {
+	var m map[string]interface{}
+	if json.Unmarshal(body, &m) != nil {
+		return string(body)
+	}
+	path = strings.TrimSuffix(path, "/")
+	output := strings.HasSuffix(path, "/playlist/outputs") || strings.HasSuffix(path, "/output")
+	for k := range m {
+		switch key := strings.ToLower(k); {
+		case strings.Contains(key, "password"), key == "key", key == "output", output && key == "url":
+			m[k] = "***"
+		}
+	}
+	data, _ := json.Marshal(m)
+	return string(data)
+}
+
+func remoteAddr(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// handler authorizes every request before next, the changes are recorded in
+// the audit trail with the user that made them.
+func (a *auth) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.cors(w, r)
+		if r.Method == "OPTIONS" {
+			tusOptions(w, r)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		user, ok := a.users.Resolve(credential(r))
+		if ok {
+			r = r.WithContext(context.WithValue(r.Context(), userKey, user))
+		}
+		role := requiredRole(r.Method, r.URL.Path)
+		if role == "" {
+			if r.URL.Path == "/" && !ok {
+				http.Redirect(w, r, "/login", http.StatusFound)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			setResponse(w, "error", "Debe iniciar sesión")
+			return
+		}
+		if !saovivo.RoleAllows(user.Role, role) {
+			w.WriteHeader(http.StatusForbidden)
+			setResponse(w, "error", fmt.Sprintf("El usuario <b>%s</b> no tiene permiso para esta acción", user.Name))
+			return
+		}
+		if r.Method == "GET" || r.Method == "HEAD" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		entry := saovivo.AuditEntry{Time: time.Now(), User: user.Name, Role: user.Role, Remote: remoteAddr(r), Method: r.Method, Path: r.URL.RequestURI()}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			body, _ := io.ReadAll(io.LimitReader(r.Body, auditBody+1))
+			if len(body) <= auditBody {
+				entry.Detail = redact(r.URL.Path, body)
+			}
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		} else if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+			entry.Detail = "multipart upload"
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		entry.Status = sw.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		a.audit.Record(entry)
+	})
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"saovivo"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// defaultChannel is the channel served under /playlist, it keeps the state
+// saved before there were multiple channels.
+const defaultChannel = "default"
+
+type channelInfo struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status,omitempty"`
+}
+
+// registryState is what survives a restart of the server besides the state
+// of every channel
+type registryState struct {
+	Channels []channelInfo     `json:"channels"`
+	Profiles []saovivo.Profile `json:"profiles"`
+}
+
+// shared is what every channel of the server uses.
+type shared struct {
+	storage    string
+	download   string
+	profiles   *saovivo.Profiles
+	library    *saovivo.Library
+	prefetcher *saovivo.Prefetcher
+	progress   *saovivo.ProgressHub // Transcodes of the prefetcher
+	slate      string               // Image shown under the assets that only have audio
+	jobs       *saovivo.JobQueue    // Processing of the uploaded files
+	hls        *saovivo.HlsOutput   // Every channel in its own directory, nil when not published
+	rtmp       *saovivo.RtmpServer  // Where the players pull the channels, nil when it does not run
+}
+
+// Registry keeps the channels of the server, each one has its own playlist,
+// outputs and status. The assets, the downloads and the profiles are shared.
+type Registry struct {
+	*shared
+	dir      string
+	store    *saovivo.Store
+	channels map[string]*VideoServer
+	lock     *sync.Mutex
+}
+
+func NewRegistry(dir string, storage string, download string, workers int, jobs int, hls *saovivo.HlsOutput, rtmp *saovivo.RtmpServer) *Registry {
+	var state registryState
+	reg := &Registry{
+		dir:      dir,
+		store:    saovivo.NewStore(filepath.Join(dir, "channels.json")),
+		channels: make(map[string]*VideoServer),
+		lock:     &sync.Mutex{},
+	}
+	if err := reg.store.Load(&state); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Error: unable to restore channels: %v\n", err)
+	}
+	progress := saovivo.NewProgressHub()
+	slate := filepath.Join(dir, "slate.png")
+	reg.shared = &shared{
+		storage:    storage,
+		download:   download,
+		profiles:   saovivo.RestoreProfiles(storage, state.Profiles),
+		library:    saovivo.NewLibrary(storage, saovivo.NewStore(filepath.Join(dir, "library.json"))),
+		prefetcher: saovivo.NewPrefetcher(storage, workers, slate, progress),
+		progress:   progress,
+		slate:      slate,
+		jobs:       saovivo.NewJobQueue(jobs),
+		hls:        hls,
+		rtmp:       rtmp,
+	}
+	reg.channels[defaultChannel] = NewVideoServer(defaultChannel, "Principal", filepath.Join(dir, "overlays"), saovivo.NewStore(filepath.Join(dir, "state.json")), reg.shared)
+	for _, c := range state.Channels {
+		if c.Id != defaultChannel {
+			reg.channels[c.Id] = reg.newChannel(c.Id, c.Name)
+		}
+	}
+	return reg
+}
+
+func (reg *Registry) newChannel(id string, name string) *VideoServer {
+	dir := filepath.Join(reg.dir, "channels", id)
+	if e := os.MkdirAll(dir, os.ModePerm); e != nil {
+		fmt.Printf("Error: %v\n", e)
+	}
+	return NewVideoServer(id, name, filepath.Join(dir, "overlays"), saovivo.NewStore(filepath.Join(dir, "state.json")), reg.shared)
+}
+
+// persist saves the channels and the profiles, must be called with the lock
+// held.
+func (reg *Registry) persist() {
+	state := registryState{Channels: []channelInfo{}, Profiles: reg.profiles.Snapshot()}
+	for _, vs := range reg.channels {
+		state.Channels = append(state.Channels, channelInfo{Id: vs.id, Name: vs.name})
+	}
+	if err := reg.store.Save(&state); err != nil {
+		fmt.Printf("Error: unable to save channels: %v\n", err)
+	}
+}
+
+func (reg *Registry) Default() *VideoServer {
+	return reg.Get(defaultChannel)
+}
+
+func (reg *Registry) Get(id string) *VideoServer {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	return reg.channels[id]
+}
+
+func (reg *Registry) list() []channelInfo {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	channels := []channelInfo{}
+	for _, vs := range reg.channels {
+		vs.lock.Lock()
+		channels = append(channels, channelInfo{Id: vs.id, Name: vs.name, Status: vs.status})
+		vs.lock.Unlock()
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Id == defaultChannel || (channels[j].Id != defaultChannel && channels[i].Name < channels[j].Name)
+	})
+	return channels
+}
+
+// profileInUse tells who uses a profile, must be called with the lock held.
+func (reg *Registry) profileInUse(id string) string {
+	for _, vs := range reg.channels {
+		vs.lock.Lock()
+		user := vs.profileInUse(id)
+		vs.lock.Unlock()
+		if user != "" {
+			return fmt.Sprintf("%s del canal %s", user, vs.name)
+		}
+	}
+	return ""
+}
+
+// profileOnAir tells who plays or transcodes videos with a profile, they
+// can not be removed then. Must be called with the lock held.
+func (reg *Registry) profileOnAir(id string) string {
+	p, err := reg.profiles.Get(id)
+	if err != nil {
+		return ""
+	}
+	for _, vs := range reg.channels {
+		vs.lock.Lock()
+		onAir := vs.vc != nil && vs.profile == id
+		vs.lock.Unlock()
+		if onAir {
+			return fmt.Sprintf("el canal %s al aire", vs.name)
+		}
+	}
+	if reg.prefetcher.Transcoding(p) {
+		return "un video que se está preparando"
+	}
+	return ""
+}
+
+func (reg *Registry) HttpChannelsPost(w http.ResponseWriter, r *http.Request) {
+	var body channelInfo
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	if body.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", "unable to find name key")
+		return
+	}
+	vs := reg.newChannel(uuid.New().String(), body.Name)
+	reg.lock.Lock()
+	reg.channels[vs.id] = vs
+	reg.persist()
+	reg.lock.Unlock()
+	data, _ := json.Marshal(channelInfo{Id: vs.id, Name: vs.name, Status: "stop"})
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
+
+func (reg *Registry) HttpChannelPatch(w http.ResponseWriter, r *http.Request, vs *VideoServer) {
+	var body channelInfo
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	if body.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", "unable to find name key")
+		return
+	}
+	reg.lock.Lock()
+	vs.lock.Lock()
+	vs.name = body.Name
+	vs.lock.Unlock()
+	reg.persist()
+	reg.lock.Unlock()
+	setResponse(w, "message", fmt.Sprintf("El canal se llama <b>%s</b>", body.Name))
+}
+
+// HttpChannelDelete removes a stopped channel with its state, the assets are
+// kept for the rest of the channels.
+func (reg *Registry) HttpChannelDelete(w http.ResponseWriter, r *http.Request, vs *VideoServer) {
+	if vs.id == defaultChannel {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", "the default channel can not be removed")
+		return
+	}
+	// Held until the channel is out of the registry, it can not start between
+	reg.lock.Lock()
+	vs.lock.Lock()
+	running := vs.status != "stop" || vs.vc != nil
+	if !running {
+		vs.deleted = true
+	}
+	vs.lock.Unlock()
+	if running {
+		reg.lock.Unlock()
+		w.WriteHeader(http.StatusConflict)
+		setResponse(w, "error", fmt.Sprintf("No se pudo eliminar el canal <b>%s</b> porque se encuentra en play", vs.name))
+		return
+	}
+	delete(reg.channels, vs.id)
+	reg.persist()
+	reg.lock.Unlock()
+	if e := os.RemoveAll(filepath.Join(reg.dir, "channels", vs.id)); e != nil {
+		fmt.Printf("Error: %v\n", e)
+	}
+	if o := vs.hlsOutput(); o != nil {
+		os.RemoveAll(o.Dir)
+	}
+	setResponse(w, "message", fmt.Sprintf("Se eliminó el canal <b>%s</b>", vs.name))
+}
+
+// ServeHTTP serves /channels and the routes of every channel under
+// /channels/{id}.
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/channels"), "/")
+	if path == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, POST")
+		switch r.Method {
+		case "GET":
+			data, _ := json.Marshal(reg.list())
+			w.Write(data)
+		case "POST":
+			reg.HttpChannelsPost(w, r)
+		case "OPTIONS":
+			return
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, rest, _ := strings.Cut(path, "/")
+	vs := reg.Get(id)
+	if vs == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		setResponse(w, "error", "channel not found")
+		return
+	}
+	if rest != "" {
+		// The channel sees the same routes as the default one
+		sub := new(http.Request)
+		*sub = *r
+		sub.URL = new(url.URL)
+		*sub.URL = *r.URL
+		sub.URL.Path = "/" + rest
+		vs.ServeHTTP(w, sub)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, PATCH, DELETE")
+	switch r.Method {
+	case "GET":
+		vs.lock.Lock()
+		data, _ := json.Marshal(channelInfo{Id: vs.id, Name: vs.name, Status: vs.status})
+		vs.lock.Unlock()
+		w.Write(data)
+	case "PATCH":
+		reg.HttpChannelPatch(w, r, vs)
+	case "DELETE":
+		reg.HttpChannelDelete(w, r, vs)
+	case "OPTIONS":
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// ServeHTTP routes the requests of a channel, the paths are relative to the
+// channel.
+func (vs *VideoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, hlsPrefix) {
+		vs.ServeHls(w, r)
+		return
+	}
+	if r.URL.Path == flvPath {
+		vs.ServeFlv(w, r)
+		return
+	}
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/playlist", "/playlist/remote", "/playlist/live":
+		vs.ServePlaylist(w, r)
+	case "/playlist/outputs":
+		vs.ServeOutputs(w, r)
+	case "/playlist/schedule":
+		vs.ServeSchedule(w, r)
+	case "/playlist/overlays":
+		vs.ServeOverlays(w, r)
+	case "/playlist/progress":
+		vs.ServeProgress(w, r)
+	case "/playlist/events":
+		vs.ServeEvents(w, r)
+	case "/playlist/library":
+		if r.Method == "POST" {
+			w.Header().Set("Content-Type", "application/json")
+			vs.HttpLibraryAppend(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
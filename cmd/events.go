@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"saovivo"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	eventItemStarted        = "item.started"
+	eventItemFinished       = "item.finished"
+	eventIngestFailed       = "ingest.failed"
+	eventOutputReconnecting = "output.reconnecting"
+	eventOutputStatus       = "output.status"
+	eventPlaylistChanged    = "playlist.changed"
+	eventNotification       = "notification"
+	eventJobFinished        = "job.finished"
+	eventJobFailed          = "job.failed"
+	eventProgress           = "progress" // Sent live only, never replayed
+)
+
+// keptEvents is how many events are replayed to a client that reconnects
+const keptEvents = 200
+
+// keptNotifications is how many notifications GET /playlist returns when it is
+// not asked for the ones after an event
+const keptNotifications = 20
+
+// heartbeat keeps the event stream open through proxies
+var heartbeat = 15 * time.Second
+
+type event struct {
+	Id   int64       `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// eventHub sends the events of a channel to every client connected, the last
+// ones are kept so a client that reconnects gets what it missed and no
+// client takes them from the others.
+type eventHub struct {
+	last        int64
+	recent      []event
+	subscribers map[chan event]bool
+	lock        *sync.Mutex
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[chan event]bool), lock: &sync.Mutex{}}
+}
+
+func (h *eventHub) publish(kind string, data interface{}) event {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.last++
+	e := event{Id: h.last, Type: kind, Time: time.Now(), Data: data}
+	h.recent = append(h.recent, e)
+	if len(h.recent) > keptEvents {
+		h.recent = h.recent[len(h.recent)-keptEvents:]
+	}
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// A client that does not keep up gets the missed events when
+			// it reconnects
+		}
+	}
+	return e
+}
+
+// since returns the events kept after id, must be called with the lock held.
+func (h *eventHub) since(id int64) []event {
+	events := []event{}
+	for _, e := range h.recent {
+		if e.Id > id {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// subscribe returns the events kept after id and the ones published from now
+// on, with the function to stop receiving them.
+func (h *eventHub) subscribe(id int64) ([]event, <-chan event, func()) {
+	ch := make(chan event, 64)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.subscribers[ch] = true
+	return h.since(id), ch, func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		if h.subscribers[ch] {
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// lastId returns the id of the last event published.
+func (h *eventHub) lastId() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.last
+}
+
+// notifications returns the text of the notifications after id, the last
+// ones when id is negative.
+func (h *eventHub) notifications(id int64) ([]string, int64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	texts := []string{}
+	for _, e := range h.since(id) {
+		if e.Type == eventNotification {
+			texts = append(texts, e.Data.(string))
+		}
+	}
+	if id < 0 && len(texts) > keptNotifications {
+		texts = texts[len(texts)-keptNotifications:]
+	}
+	return texts, h.last
+}
+
+// notify sends a message to the users of the channel.
+func (vs *VideoServer) notify(format string, a ...interface{}) {
+	vs.events.publish(eventNotification, fmt.Sprintf(format, a...))
+}
+
+// playlistChanged sends the playlist to the clients, must be called with the
+// lock held.
+func (vs *VideoServer) playlistChanged() {
+	m := vs.playlist.Map()
+	m["status"] = vs.status
+	vs.events.publish(eventPlaylistChanged, m)
+}
+
+func writeEvent(w http.ResponseWriter, e event) error {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+	if e.Id > 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", e.Id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+	return err
+}
+
+// HttpEventStream sends the events of the channel as Server-Sent Events. A
+// client that reconnects with Last-Event-ID, or asks with ?since=, gets the
+// events it missed first. The progress of the transcodes is sent as it
+// happens and a failed one is sent as ingest.failed too.
+func (vs *VideoServer) HttpEventStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		setResponse(w, "error", "streaming not supported")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = r.URL.Query().Get("since")
+	}
+	since, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		// A new client only gets what happens from now on
+		since = -1
+	}
+	missed, events, stop := vs.events.subscribe(since)
+	defer stop()
+	ingest, stopIngest := vs.progress.Subscribe()
+	defer stopIngest()
+	uploads, stopUploads := vs.uploads.Subscribe()
+	defer stopUploads()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if since >= 0 {
+		for _, e := range missed {
+			if writeEvent(w, e) != nil {
+				return
+			}
+		}
+	}
+	flusher.Flush()
+
+	ping := time.NewTicker(heartbeat)
+	defer ping.Stop()
+	for {
+		var (
+			out  []event
+			e    event
+			p    saovivo.ProgressEvent
+			open = true
+		)
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case e, open = <-events:
+			out = append(out, e)
+		case p, open = <-ingest:
+		case p, open = <-uploads:
+		}
+		if !open {
+			return
+		}
+		if p.Kind != "" {
+			for _, pe := range vs.progressEvents(p) {
+				out = append(out, event{Type: eventProgress, Time: time.Now(), Data: pe})
+				if pe.State == "failed" {
+					out = append(out, event{Type: eventIngestFailed, Time: time.Now(), Data: pe})
+				}
+			}
+		}
+		for _, e := range out {
+			if writeEvent(w, e) != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func (vs *VideoServer) ServeEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET")
+	switch r.Method {
+	case "GET":
+		vs.HttpEventStream(w, r)
+	case "OPTIONS":
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"saovivo"
+	"strings"
+)
+
+// hlsPrefix is where the HLS of a channel is served, relative to the channel
+const hlsPrefix = "/playlist/hls/"
+
+// hlsStatus tells where the HLS of the channel is played and if it is being
+// written.
+type hlsStatus struct {
+	Url   string `json:"url"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+// hlsOutput returns where the channel publishes its HLS, nil when the server
+// does not publish it.
+func (vs *VideoServer) hlsOutput() *saovivo.HlsOutput {
+	if vs.hls == nil {
+		return nil
+	}
+	o := *vs.hls
+	o.Dir = filepath.Join(vs.hls.Dir, vs.id)
+	return &o
+}
+
+// hlsStatus returns the state of the HLS of the channel, must be called with
+// the lock held.
+func (vs *VideoServer) hlsStatus() *hlsStatus {
+	if vs.hls == nil {
+		return nil
+	}
+	s := &hlsStatus{Url: hlsPrefix + saovivo.HlsPlaylist, State: "idle"}
+	if vs.id != defaultChannel {
+		s.Url = "/channels/" + vs.id + s.Url
+	}
+	if vs.vc != nil {
+		for _, d := range vs.vc.Destinations() {
+			if d.Id == saovivo.HlsDestination {
+				s.State, s.Error = d.State, d.Error
+			}
+		}
+	}
+	return s
+}
+
+// ServeHls serves the playlist and the segments of the channel, the playlist
+// changes with every segment so it is never cached.
+func (vs *VideoServer) ServeHls(w http.ResponseWriter, r *http.Request) {
+	o := vs.hlsOutput()
+	if o == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, hlsPrefix)
+	if name == "" || name != path.Base(name) {
+		http.NotFound(w, r)
+		return
+	}
+	switch path.Ext(name) {
+	case ".m3u8":
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+	case ".ts":
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Header().Set("Cache-Control", "max-age=60")
+	case ".m4s", ".mp4":
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Cache-Control", "max-age=60")
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(o.Dir, name))
+}
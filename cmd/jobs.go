@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"saovivo"
+)
+
+// uploadDone adds a processed file to the playlist, or tells why it was not
+// added.
+func (vs *VideoServer) uploadDone(job saovivo.Job) {
+	if job.State == "failed" {
+		vs.events.publish(eventJobFailed, job)
+		vs.notify("El archivo <b>%s</b> no se agregó: %s", job.Name, job.Error)
+		return
+	}
+	vs.catalog([]*saovivo.Asset{job.Asset})
+	vs.appendToPlaylist(job.Asset)
+	vs.events.publish(eventJobFinished, job)
+	vs.notify("El video <b>%s</b> ha sido agregado a la lista de reproducción", job.Asset.Name)
+}
+
+func (vs *VideoServer) apiJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, r, "GET")
+		return
+	}
+	writeJSON(w, http.StatusOK, vs.receiver.Jobs())
+}
+
+func (vs *VideoServer) apiJob(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, r, "GET")
+		return
+	}
+	job, ok := vs.receiver.Job(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "job %s not found", id)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
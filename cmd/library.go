@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"saovivo"
+)
+
+type libraryRequest struct {
+	Id   string   `json:"id"`
+	Ids  []string `json:"ids"`
+	Name *string  `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// catalog adds the videos received by the channel to the shared library.
+func (vs *VideoServer) catalog(assets []*saovivo.Asset) {
+	for _, a := range assets {
+		vs.library.AddAsset(a)
+	}
+}
+
+// usesLibraryItem tells if a playlist or the schedule of the channel plays a
+// library item, must be called with the lock held.
+func (vs *VideoServer) usesLibraryItem(id string) bool {
+	for _, a := range vs.playlist.Assets() {
+		if a.Library == id {
+			return true
+		}
+	}
+	for _, e := range vs.schedule.List() {
+		if e.Asset.Library == id && (e.State == "pending" || e.State == "playing") {
+			return true
+		}
+	}
+	return false
+}
+
+// HttpLibraryAppend adds library items to the playlist of the channel, they
+// are not ingested again.
+func (vs *VideoServer) HttpLibraryAppend(w http.ResponseWriter, r *http.Request) {
+	var body libraryRequest
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	ids := body.Ids
+	if body.Id != "" {
+		ids = append([]string{body.Id}, ids...)
+	}
+	if len(ids) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", "unable to find id key")
+		return
+	}
+	assets := []*saovivo.Asset{}
+	for _, id := range ids {
+		a, err := vs.library.Asset(id)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			setResponse(w, "error", fmt.Sprintf("%v", err))
+			return
+		}
+		assets = append(assets, a)
+	}
+	for _, a := range assets {
+		vs.appendToPlaylist(a)
+		vs.lock.Lock()
+		vs.notify("El video <b>%s</b> ha sido agregado a la lista de reproducción", a.Name)
+		vs.lock.Unlock()
+	}
+	setResponse(w, "message", fmt.Sprintf("Se agregaron %d videos de la biblioteca", len(assets)))
+}
+
+func (reg *Registry) HttpLibraryPatch(w http.ResponseWriter, r *http.Request) {
+	var body libraryRequest
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	item, err := reg.library.Update(body.Id, body.Name, body.Tags)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", err))
+		return
+	}
+	data, _ := json.Marshal(item)
+	w.Write(data)
+}
+
+func (reg *Registry) HttpLibraryDelete(w http.ResponseWriter, r *http.Request) {
+	var body libraryRequest
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	item, err := reg.library.Get(body.Id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		setResponse(w, "error", fmt.Sprintf("%v", err))
+		return
+	}
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	for _, vs := range reg.channels {
+		vs.lock.Lock()
+		used := vs.usesLibraryItem(item.Id)
+		vs.lock.Unlock()
+		if used {
+			w.WriteHeader(http.StatusConflict)
+			setResponse(w, "error", fmt.Sprintf("No se pudo eliminar <b>%s</b> porque está en la lista del canal %s", item.Name, vs.name))
+			return
+		}
+	}
+	if err := reg.library.Remove(item.Id); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", err))
+		return
+	}
+	setResponse(w, "message", fmt.Sprintf("Se eliminó <b>%s</b> de la biblioteca", item.Name))
+}
+
+func (reg *Registry) ServeLibrary(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, PATCH, DELETE")
+	switch r.Method {
+	case "GET":
+		query := r.URL.Query()
+		data, _ := json.Marshal(reg.library.Search(query.Get("q"), query["tag"]))
+		w.Write(data)
+	case "PATCH":
+		reg.HttpLibraryPatch(w, r)
+	case "DELETE":
+		reg.HttpLibraryDelete(w, r)
+	case "OPTIONS":
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
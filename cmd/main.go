@@ -5,16 +5,19 @@ import (
 	"embed"
 	"encoding/json"
 	"ffbinaries"
+	"flag"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"saovivo"
+	"strconv"
 	"streaminfo"
 	"strings"
 	"sync"
@@ -26,74 +29,298 @@ var build embed.FS
 
 var version = "1.0.1"
 
+// defaultPrefetch is how many videos of the queue are transcoded ahead
+const defaultPrefetch = 3
+
 type VideoServer struct {
-	playlist      *saovivo.Playlist
-	vc            *saovivo.VideoChannel
-	receiver      *saovivo.FileReceiver
-	output        string
-	status        string
-	loop          bool
-	lock          *sync.Mutex
-	storage       string
-	notifications []string
+	*shared
+	id         string
+	name       string
+	playlist   *saovivo.Playlist
+	vc         *saovivo.VideoChannel
+	receiver   *saovivo.FileReceiver
+	uploads    *saovivo.ProgressHub // Processing of the files uploaded to the channel
+	outputs    []*saovivo.Destination
+	status     string
+	loop       bool
+	continuous bool
+	reconnect  saovivo.ReconnectPolicy
+	lock       *sync.Mutex
+	store      *saovivo.Store
+	events     *eventHub
+	overlays   *saovivo.Overlays
+	profile    string // Encoding of the channel
+	prefetch   int    // Videos of the queue transcoded ahead of their turn
+	deleted    bool   // Removed with its state, it does not start again
+
+	schedule        *saovivo.Schedule
+	playing         *saovivo.ScheduleEntry // Scheduled entry in play
+	scheduleChanged chan bool
+}
+
+// serverState is what survives a restart of the server
+type serverState struct {
+	Playlist   saovivo.PlaylistSnapshot      `json:"playlist"`
+	Schedule   []saovivo.StoredScheduleEntry `json:"schedule"`
+	Outputs    []saovivo.Destination         `json:"outputs"`
+	Output     string                        `json:"output,omitempty"` // Before multiple destinations
+	Loop       bool                          `json:"loop"`
+	Continuous bool                          `json:"continuous"`
+	Reconnect  *saovivo.ReconnectPolicy      `json:"reconnect,omitempty"`
+	Prefetch   *int                          `json:"prefetch,omitempty"`
+	Overlays   []saovivo.Overlay             `json:"overlays"`
+	Profile    string                        `json:"profile"`
 }
 
-func NewVideoServer(storage string, download string) *VideoServer {
+// NewVideoServer creates a channel that uses the resources shared with the
+// rest of the channels.
+func NewVideoServer(id string, name string, overlays string, store *saovivo.Store, shared *shared) *VideoServer {
 	var vs VideoServer
+	vs.id = id
+	vs.name = name
 	vs.lock = &sync.Mutex{}
 	vs.status = "stop"
 	vs.playlist = saovivo.NewPlaylist()
-	vs.storage = storage
+	vs.schedule = saovivo.NewSchedule()
+	vs.scheduleChanged = make(chan bool, 1)
+	vs.shared = shared
 	vs.loop = true
-	vs.receiver = saovivo.NewFileReceiver(download)
+	vs.reconnect = saovivo.DefaultReconnectPolicy
+	vs.prefetch = defaultPrefetch
+	vs.events = newEventHub()
+	vs.uploads = saovivo.NewProgressHub()
+	vs.receiver = saovivo.NewFileReceiver(shared.download, filepath.Join(shared.download, "partial", id), shared.jobs, vs.uploads)
+	vs.receiver.Done = vs.uploadDone
+	vs.overlays = saovivo.NewOverlays(overlays)
+	vs.profile = saovivo.DefaultProfile.Id
+	vs.store = store
+	vs.restore(overlays)
 	return &vs
 }
 
+func (vs *VideoServer) restore(overlays string) {
+	var state serverState
+	if err := vs.store.Load(&state); err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Error: unable to restore state: %v\n", err)
+		}
+		return
+	}
+	vs.playlist = saovivo.RestorePlaylist(state.Playlist)
+	vs.schedule = saovivo.RestoreSchedule(state.Schedule)
+	for i := range state.Outputs {
+		d := state.Outputs[i]
+		vs.outputs = append(vs.outputs, &d)
+	}
+	if len(vs.outputs) == 0 && state.Output != "" {
+		vs.outputs = append(vs.outputs, &saovivo.Destination{Id: defaultOutput, Name: "YouTube", Url: state.Output, Enabled: true})
+	}
+	vs.loop = state.Loop
+	vs.continuous = state.Continuous
+	if state.Reconnect != nil {
+		vs.reconnect = *state.Reconnect
+	}
+	if state.Prefetch != nil {
+		vs.prefetch = *state.Prefetch
+	}
+	vs.overlays = saovivo.RestoreOverlays(overlays, state.Overlays)
+	if _, err := vs.profiles.Get(state.Profile); err == nil {
+		vs.profile = state.Profile
+	}
+	fmt.Printf("State restored from %s, %d videos in the playlist\n", vs.store.Path(), vs.playlist.Len())
+}
+
+// persist saves the current state, must be called with the lock held.
+func (vs *VideoServer) persist() {
+	if vs.deleted {
+		return
+	}
+	state := serverState{
+		Playlist:   vs.playlist.Snapshot(),
+		Schedule:   vs.schedule.Snapshot(),
+		Outputs:    vs.destinations(),
+		Loop:       vs.loop,
+		Continuous: vs.continuous,
+		Reconnect:  &vs.reconnect,
+		Prefetch:   &vs.prefetch,
+		Overlays:   vs.overlays.Snapshot(),
+		Profile:    vs.profile,
+	}
+	if err := vs.store.Save(&state); err != nil {
+		fmt.Printf("Error: unable to save state: %v\n", err)
+	}
+	vs.playlistChanged()
+}
+
+// nextAsset chooses what to play next, a scheduled entry whose time has come
+// or the next asset of the playlist. When there is nothing to play but the
+// schedule has a pending entry it returns the time to wait for it.
+func (vs *VideoServer) nextAsset() (*saovivo.Asset, *saovivo.ScheduleEntry, time.Duration) {
+	now := time.Now()
+	if vs.status != "stop" {
+		if entry := vs.schedule.Due(now); entry != nil {
+			vs.playlist.Release()
+			entry.State = "playing"
+			return entry.Asset, entry, 0
+		}
+	}
+	if vs.playlist.InQueue() == 0 && !vs.loop || vs.playlist.Len() == 0 {
+		if next := vs.schedule.Next(now, false); next != nil && vs.status != "stop" {
+			vs.playlist.Release()
+			return nil, nil, next.Start.Sub(now)
+		}
+		vs.status = "stop"
+	}
+	if vs.status != "stop" {
+		// A video still transcoding waits for the next one that is ready
+		if vs.prefetch > 0 {
+			profile := vs.channelProfile()
+			vs.playlist.PromoteReady(func(a *saovivo.Asset) bool {
+				return !vs.prefetcher.Busy(a, profile)
+			})
+		}
+		return vs.playlist.Shift(false), nil, 0
+	}
+	return vs.playlist.Shift(true), nil, 0
+}
+
+// cutTimer fires when a hard cut entry has to interrupt the asset in play.
+func (vs *VideoServer) cutTimer() *time.Timer {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	now := time.Now()
+	if next := vs.schedule.Next(now, true); next != nil {
+		return time.NewTimer(next.Start.Sub(now))
+	}
+	return time.NewTimer(24 * time.Hour)
+}
+
+func (vs *VideoServer) scheduleUpdated() {
+	select {
+	case vs.scheduleChanged <- true:
+	default:
+	}
+}
+
+func (vs *VideoServer) channelOptions() saovivo.ChannelOptions {
+	return saovivo.ChannelOptions{
+		Continuous:      vs.continuous,
+		Reconnect:       vs.reconnect,
+		Notify:          vs.destinationChanged,
+		NotifyReconnect: vs.outputReconnecting,
+		Overlays:        vs.overlays,
+		Profile:         vs.channelProfile(),
+		Profiles:        vs.profiles,
+		Slate:           vs.slate,
+		Prefetcher:      vs.prefetcher,
+		Hls:             vs.hlsOutput(),
+		Rtmp:            vs.rtmpURL(),
+	}
+}
+
+func (vs *VideoServer) outputReconnecting(attempt int, err error) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	vs.events.publish(eventOutputReconnecting, map[string]interface{}{"attempt": attempt, "maxAttempts": vs.reconnect.MaxAttempts, "error": fmt.Sprint(err)})
+	vs.notify("Se cortó la transmisión (%v), reconectando: intento %d de %d", err, attempt, vs.reconnect.MaxAttempts)
+}
+
 func (vs *VideoServer) start() error {
 	vs.lock.Lock()
 	defer vs.lock.Unlock()
-	if vs.output != "" && vs.status == "stop" && vs.vc == nil && vs.playlist.Len() > 0 {
-		if vc, e := saovivo.NewVideoChannel(vs.output, vs.storage); e != nil {
+	if vs.deleted {
+		return fmt.Errorf("the channel was removed")
+	}
+	if vs.hasOutputs() && vs.status == "stop" && vs.vc == nil && (vs.playlist.Len() > 0 || vs.schedule.Next(time.Now(), false) != nil) {
+		if vc, e := saovivo.NewVideoChannel(vs.destinations(), vs.storage, vs.channelOptions()); e != nil {
 			return e
 		} else {
 			vs.vc = vc
 		}
 		vs.status = "start"
 		go func() {
-			var asset *saovivo.Asset
+			var (
+				asset *saovivo.Asset
+				entry *saovivo.ScheduleEntry
+				wait  time.Duration
+			)
 			for {
 				vs.lock.Lock()
-				if vs.playlist.InQueue() == 0 && !vs.loop {
-					vs.status = "stop"
-				}
-				if vs.status != "stop" {
-					asset = vs.playlist.Shift(false)
-				} else {
-					asset = vs.playlist.Shift(true)
-				}
+				asset, entry, wait = vs.nextAsset()
+				vs.playing = entry
+				vs.prefetchUpcoming()
+				vs.persist()
 				fmt.Println("Empieza la reproduccion de: ", asset)
 				vs.lock.Unlock()
+				if asset == nil && wait > 0 {
+					// Nothing to play until the next scheduled entry
+					timer := time.NewTimer(wait)
+					select {
+					case <-timer.C:
+					case <-vs.scheduleChanged:
+						timer.Stop()
+					case <-vs.vc.Output:
+						timer.Stop()
+						vs.lock.Lock()
+						vs.status = "stop"
+						vs.playlist.Shift(true)
+						vs.persist()
+						vs.vc = nil
+						vs.lock.Unlock()
+						return
+					}
+					continue
+				}
 				if asset != nil {
-					vs.vc.Input <- &(asset.Video)
-					err := <-vs.vc.Output
+					vs.events.publish(eventItemStarted, map[string]interface{}{"asset": asset, "scheduled": entry != nil})
+					vs.vc.Input <- asset
+					var err error
+					for waiting := true; waiting; {
+						cut := vs.cutTimer()
+						select {
+						case err = <-vs.vc.Output:
+							waiting = false
+						case <-cut.C:
+							fmt.Println("Corte programado")
+							vs.vc.Skip()
+						case <-vs.scheduleChanged:
+						}
+						cut.Stop()
+					}
 					fmt.Printf("Output from Video Channel: %v\n", err)
+					finished := map[string]interface{}{"asset": asset, "scheduled": entry != nil}
+					if err != nil {
+						finished["error"] = fmt.Sprint(err)
+					}
+					vs.events.publish(eventItemFinished, finished)
+					if entry != nil {
+						vs.lock.Lock()
+						entry.State = "done"
+						if err != nil && fmt.Sprint(err) == "Ingest" {
+							entry.State = "failed"
+						}
+						vs.playing = nil
+						vs.persist()
+						vs.lock.Unlock()
+					}
 					if err != nil {
 						if fmt.Sprint(err) == "Abort" {
 							vs.lock.Lock()
 							vs.status = "stop"
 							vs.playlist.Shift(true)
+							vs.persist()
 							vs.vc = nil
 							vs.lock.Unlock()
 							return
 						} else if fmt.Sprint(err) == "Ingest" {
 							fmt.Println("Fallo la ingesta")
+							vs.events.publish(eventIngestFailed, saovivo.ProgressEvent{Kind: "ingest", Asset: asset.Id, IngestState: saovivo.IngestState{State: "failed", Error: "Ingest"}})
 							vs.lock.Lock()
-							vs.notifications = append(vs.notifications, fmt.Sprintf("El video <b>%s</b> no se pudo reproducir por un error en la API de Youtube", asset.Name))
-							fmt.Println(vs.notifications)
+							vs.notify("El video <b>%s</b> no se pudo reproducir por un error en la API de Youtube", asset.Name)
 							vs.lock.Unlock()
 						} else {
 							fmt.Println("Estoy aca, esperando no se que")
-							vs.vc, _ = saovivo.NewVideoChannel(vs.output, vs.storage)
+							vs.vc, _ = saovivo.NewVideoChannel(vs.destinations(), vs.storage, vs.channelOptions())
 						}
 					}
 				} else {
@@ -126,30 +353,56 @@ func setResponse(w http.ResponseWriter, key string, message string) error {
 
 func (vs *VideoServer) stop() error {
 	vs.lock.Lock()
-	defer vs.lock.Unlock()
-	if vs.status == "start" {
-		vs.vc.Stop()
-		vs.status = "stop"
-		return nil
+	if vs.status != "start" {
+		vs.lock.Unlock()
+		return fmt.Errorf("impossible to stop, not started")
 	}
-	return fmt.Errorf("impossible to stop, not started")
-}
-
-func (vs *VideoServer) setOutput(rtmp string) {
-	vs.lock.Lock()
-	defer vs.lock.Unlock()
-	vs.output = rtmp
+	vc := vs.vc
+	vs.status = "stop"
+	vs.lock.Unlock()
+	// Out of the lock, the channel takes it to notify while it reconnects
+	if vc != nil {
+		vc.Stop()
+	}
+	return nil
 }
 
-func (vs *VideoServer) Json() (*bytes.Buffer, error) {
+// Json returns the state of the channel with the notifications sent after the
+// event since, the last ones when since is negative. The urls and keys of the
+// destinations are only included when keys is set.
+func (vs *VideoServer) Json(since int64, keys bool) (*bytes.Buffer, error) {
 	vs.lock.Lock()
 	defer vs.lock.Unlock()
 	m := vs.playlist.Map()
-	m["output"] = vs.output
+	m["output"] = ""
+	if d := vs.getDestination(defaultOutput); d != nil && keys {
+		m["output"] = d.Url
+	}
+	m["outputs"] = vs.outputsView(keys)
+	if hls := vs.hlsStatus(); hls != nil {
+		m["hls"] = hls
+	}
+	if rtmp := vs.rtmpStatus(); rtmp != nil {
+		m["rtmp"] = rtmp
+	}
+	m["schedule"] = vs.schedule.List()
+	if vs.playing != nil {
+		m["inPlay"] = vs.playing.Asset
+	}
 	m["status"] = vs.status
 	m["loop"] = vs.loop
-	m["notifications"] = vs.notifications
-	vs.notifications = []string{}
+	m["continuous"] = vs.continuous
+	m["reconnect"] = vs.reconnect
+	m["profile"] = vs.profile
+	m["prefetch"] = vs.prefetch
+	m["ingest"] = vs.ingestStatus()
+	m["uploads"] = vs.receiver.Status()
+	m["jobs"] = vs.receiver.Jobs()
+	m["reconnecting"] = 0
+	if vs.vc != nil {
+		m["reconnecting"] = vs.vc.Attempts()
+	}
+	m["notifications"], m["lastEvent"] = vs.events.notifications(since)
 	data, e := json.Marshal(m)
 	if e != nil {
 		return nil, e
@@ -160,7 +413,42 @@ func (vs *VideoServer) Json() (*bytes.Buffer, error) {
 func (vs *VideoServer) appendToPlaylist(asset *saovivo.Asset) string {
 	vs.lock.Lock()
 	defer vs.lock.Unlock()
-	return vs.playlist.Append(asset)
+	id := vs.playlist.Append(asset)
+	vs.prefetchUpcoming()
+	vs.persist()
+	return id
+}
+
+// prefetchUpcoming queues the transcode of the next videos while the channel
+// is on air, must be called with the lock held.
+func (vs *VideoServer) prefetchUpcoming() {
+	if vs.status != "start" {
+		return
+	}
+	profile := vs.channelProfile()
+	for _, a := range vs.playlist.Upcoming(vs.prefetch) {
+		vs.prefetcher.Prefetch(a, profile)
+	}
+	if next := vs.schedule.Next(time.Now(), false); next != nil && vs.prefetch > 0 {
+		vs.prefetcher.Prefetch(next.Asset, profile)
+	}
+}
+
+// ingestStatus returns the ingest state of every asset of the playlist, must
+// be called with the lock held.
+func (vs *VideoServer) ingestStatus() map[string]saovivo.IngestState {
+	profile := vs.channelProfile()
+	status := make(map[string]saovivo.IngestState)
+	for _, a := range vs.playlist.Assets() {
+		status[a.Id] = vs.prefetcher.State(a, profile)
+	}
+	return status
+}
+
+// wrongType answers to a key of a request with a value of the wrong type.
+func wrongType(w http.ResponseWriter, key string, kind string) {
+	w.WriteHeader(http.StatusBadRequest)
+	setResponse(w, "error", fmt.Sprintf("%s must be a %s", key, kind))
 }
 
 func (vs *VideoServer) HttpMethodPatch(w http.ResponseWriter, r *http.Request) {
@@ -173,8 +461,14 @@ func (vs *VideoServer) HttpMethodPatch(w http.ResponseWriter, r *http.Request) {
 	for key, value := range body {
 		switch key {
 		case "loop":
+			loop, ok := value.(bool)
+			if !ok {
+				wrongType(w, key, "boolean")
+				return
+			}
 			vs.lock.Lock()
-			vs.loop = value.(bool)
+			vs.loop = loop
+			vs.persist()
 			text := ""
 			if !vs.loop {
 				text = "La repetición de la lista está <b>DESACTIVADA</b>, el stream terminará al finalizar el ultimo video de la lista"
@@ -184,22 +478,128 @@ func (vs *VideoServer) HttpMethodPatch(w http.ResponseWriter, r *http.Request) {
 			vs.lock.Unlock()
 			setResponse(w, "message", text)
 		case "output":
-			vs.setOutput("rtmp://a.rtmp.youtube.com/live2/" + value.(string))
-			setResponse(w, "message", fmt.Sprintf("Destino de transmision: %s", value.(string)))
+			if !allowed(r, saovivo.RoleAdmin) {
+				w.WriteHeader(http.StatusForbidden)
+				setResponse(w, "error", "Solo un administrador puede cambiar el destino de transmision")
+				return
+			}
+			output, ok := value.(string)
+			if !ok {
+				wrongType(w, key, "string")
+				return
+			}
+			if e := vs.setOutput(output); e != nil {
+				setResponse(w, "error", fmt.Sprintf("No se pudo conectar el destino de transmision: %v", e))
+				return
+			}
+			setResponse(w, "message", fmt.Sprintf("Destino de transmision: %s", output))
+		case "continuous":
+			continuous, ok := value.(bool)
+			if !ok {
+				wrongType(w, key, "boolean")
+				return
+			}
+			vs.lock.Lock()
+			vs.continuous = continuous
+			vs.persist()
+			vs.lock.Unlock()
+			if continuous {
+				setResponse(w, "message", "La reproducción continua está <b>ACTIVADA</b>, se aplica al iniciar la transmisión")
+			} else {
+				setResponse(w, "message", "La reproducción continua está <b>DESACTIVADA</b>, se aplica al iniciar la transmisión")
+			}
+		case "reconnect":
+			policy := saovivo.DefaultReconnectPolicy
+			data, _ := json.Marshal(value)
+			if e := json.Unmarshal(data, &policy); e != nil || policy.Validate() != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				setResponse(w, "error", fmt.Sprintf("wrong reconnect policy: %v", policy.Validate()))
+				return
+			}
+			vs.lock.Lock()
+			vs.reconnect = policy
+			vs.persist()
+			vs.lock.Unlock()
+			setResponse(w, "message", fmt.Sprintf("Se reconectará hasta <b>%d</b> veces, se aplica al iniciar la transmisión", policy.MaxAttempts))
+		case "prefetch":
+			n, ok := value.(float64)
+			if !ok || n < 0 || n > 20 {
+				w.WriteHeader(http.StatusBadRequest)
+				setResponse(w, "error", "prefetch must be between 0 and 20")
+				return
+			}
+			vs.lock.Lock()
+			vs.prefetch = int(n)
+			vs.prefetchUpcoming()
+			vs.persist()
+			vs.lock.Unlock()
+			setResponse(w, "message", fmt.Sprintf("Se preparan <b>%d</b> videos antes de su turno", int(n)))
+		case "profile":
+			id, ok := value.(string)
+			if !ok {
+				wrongType(w, key, "string")
+				return
+			}
+			p, e := vs.profiles.Get(id)
+			if e != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				setResponse(w, "error", fmt.Sprintf("%v", e))
+				return
+			}
+			vs.lock.Lock()
+			vs.profile = p.Id
+			vs.persist()
+			vs.lock.Unlock()
+			setResponse(w, "message", fmt.Sprintf("El canal usa el perfil <b>%s</b>, se aplica al iniciar la transmisión", p.Name))
+		case "transition":
+			var transition saovivo.Transition
+			data, _ := json.Marshal(value)
+			if e := json.Unmarshal(data, &transition); e != nil || transition.Validate() != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				setResponse(w, "error", fmt.Sprintf("wrong transition: %v", transition.Validate()))
+				return
+			}
+			id, _ := body["id"].(string)
+			vs.lock.Lock()
+			asset := vs.playlist.GetAssetById(id)
+			if asset != nil {
+				asset.Transition = &transition
+				vs.persist()
+			}
+			vs.lock.Unlock()
+			if asset == nil {
+				w.WriteHeader(http.StatusNotFound)
+				setResponse(w, "error", "asset not found")
+				return
+			}
+			setResponse(w, "message", fmt.Sprintf("Nueva transición para el video <b>%s</b>", asset.Name))
 		case "id":
-			id := value.(string)
-			position, ok := body["position"]
+			id, ok := value.(string)
+			if !ok {
+				wrongType(w, key, "string")
+				return
+			}
+			value, ok := body["position"]
+			if _, transition := body["transition"]; !ok && transition {
+				continue
+			}
 			if !ok {
 				setResponse(w, "error", "unable to find position key")
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
+			position, ok := value.(float64)
+			if !ok {
+				wrongType(w, "position", "number")
+				return
+			}
 			vs.lock.Lock()
-			vs.playlist.MoveByAssetIdToPosition(id, int(position.(float64)))
+			vs.playlist.MoveByAssetIdToPosition(id, int(position))
+			vs.persist()
 
 			name := vs.playlist.GetAssetNameById(id)
 			vs.lock.Unlock()
-			setResponse(w, "message", fmt.Sprintf("Nueva posición %d para el video <b>%s</b>", int(position.(float64)), name))
+			setResponse(w, "message", fmt.Sprintf("Nueva posición %d para el video <b>%s</b>", int(position), name))
 		}
 	}
 }
@@ -217,7 +617,7 @@ func (vs *VideoServer) HttpMethodPost(w http.ResponseWriter, r *http.Request) {
 
 		return
 	}
-	if !strings.HasPrefix(url, "http") {
+	if !strings.Contains(url, "://") {
 		url = "http://" + url
 	}
 	asset, err := vs.receiver.GetRemote(url)
@@ -226,15 +626,57 @@ func (vs *VideoServer) HttpMethodPost(w http.ResponseWriter, r *http.Request) {
 		setResponse(w, "error", fmt.Sprintf("%v", err))
 		return
 	}
+	vs.catalog(asset)
 	for _, a := range asset {
 		vs.appendToPlaylist(a)
 		vs.lock.Lock()
-		vs.notifications = append(vs.notifications, fmt.Sprintf("El video <b>%s</b> ha sido agregado a la lista de reproducción", a.Name))
+		vs.notify("El video <b>%s</b> ha sido agregado a la lista de reproducción", a.Name)
 		vs.lock.Unlock()
 	}
 
 }
 
+type liveRequest struct {
+	Name string `json:"name"`
+	saovivo.LiveSource
+}
+
+// HttpMethodPostLive appends a live source to the playlist, it stays on air
+// for its duration or until the return to the playlist.
+func (vs *VideoServer) HttpMethodPostLive(w http.ResponseWriter, r *http.Request) {
+	var body liveRequest
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	if e := body.Validate(); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	if body.Name == "" {
+		body.Name = body.Url
+	}
+	a := saovivo.NewLiveAsset(body.Name, body.LiveSource)
+	vs.appendToPlaylist(a)
+	vs.lock.Lock()
+	vs.notify("La transmisión en vivo <b>%s</b> ha sido agregada a la lista de reproducción", a.Name)
+	vs.lock.Unlock()
+	setResponse(w, "message", fmt.Sprintf("Se agregó la transmisión en vivo <b>%s</b>", a.Name))
+}
+
+// back ends the video or live source in play and continues with the playlist.
+func (vs *VideoServer) back() error {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	if vs.status != "start" || vs.vc == nil {
+		return fmt.Errorf("la transmisión no está en curso")
+	}
+	vs.vc.Skip()
+	return nil
+}
+
 func (vs *VideoServer) HttpMethodPut(w http.ResponseWriter, r *http.Request) {
 	body := make(map[string]string)
 	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
@@ -269,9 +711,16 @@ func (vs *VideoServer) HttpMethodPut(w http.ResponseWriter, r *http.Request) {
 			setResponse(w, "message", "Reproducción finalizada")
 		}
 
+	} else if status == "return" {
+		if e := vs.back(); e != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			setResponse(w, "error", fmt.Sprintf("%v", e))
+			return
+		}
+		setResponse(w, "message", "Volviendo a la lista de reproducción")
 	} else {
 		w.WriteHeader(http.StatusBadRequest)
-		setResponse(w, "error", "wrong status, must be start or stop")
+		setResponse(w, "error", "wrong status, must be start, stop or return")
 
 		return
 	}
@@ -293,6 +742,7 @@ func (vs *VideoServer) HttpMethodDelete(w http.ResponseWriter, r *http.Request)
 	if value == "all" {
 		if vs.status == "stop" {
 			vs.playlist.RemoveAll()
+			vs.persist()
 			setResponse(w, "message", "Se borro toda la playlist")
 		} else {
 			setResponse(w, "message", "No se pudo borrar la playlist porque se encuentra en play")
@@ -301,6 +751,7 @@ func (vs *VideoServer) HttpMethodDelete(w http.ResponseWriter, r *http.Request)
 		name := vs.playlist.GetAssetNameById(value)
 		b := vs.playlist.Remove(value)
 		if b {
+			vs.persist()
 			setResponse(w, "message", fmt.Sprintf("Se eliminó <b>%s</b> de la lista de reproducción", name))
 		} else {
 			setResponse(w, "error", "item no se ha podido eliminar el item")
@@ -310,9 +761,8 @@ func (vs *VideoServer) HttpMethodDelete(w http.ResponseWriter, r *http.Request)
 	vs.lock.Unlock()
 }
 
-func (vs *VideoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (vs *VideoServer) ServePlaylist(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, PUT, PATCH, DELETE")
 	switch r.Method {
 	case "PATCH":
@@ -328,30 +778,29 @@ func (vs *VideoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			vs.HttpMethodPost(w, r)
 			return
 		}
-		assets, err := vs.receiver.Recv(r)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		if r.URL.Path == "/playlist/live" {
+			vs.HttpMethodPostLive(w, r)
 			return
 		}
-		notif := []string{}
-		for _, a := range assets {
-			vs.appendToPlaylist(a)
-
-			notif = append(notif, fmt.Sprintf("El video <b>%s</b> ha sido agregado a la lista de reproducción", a.Name))
-
+		since := vs.events.lastId()
+		// The files are added to the playlist as they are processed
+		if _, err := vs.receiver.Recv(r); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
-		buf, _ := vs.Json()
+		buf, _ := vs.Json(since, allowed(r, saovivo.RoleOperator))
 		//setResponse(w, "message", "Se agregaron nuevos videos a la reproduccion")
 
 		io.Copy(w, buf)
-		vs.lock.Lock()
-		vs.notifications = notif
-		vs.lock.Unlock()
 		//		w.WriteHeader(http.StatusCreated)
 	case "OPTIONS":
 		return
 	case "GET":
-		buf, _ := vs.Json()
+		since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		if err != nil {
+			since = -1
+		}
+		buf, _ := vs.Json(since, allowed(r, saovivo.RoleOperator))
 		io.Copy(w, buf)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -360,7 +809,6 @@ func (vs *VideoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func versionHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, PUT, PATCH, DELETE")
 	m := make(map[string]string)
 	m["version"] = version
@@ -372,26 +820,54 @@ func versionHandler(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func defaultDataDir() string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "saovivo")
+	}
+	return filepath.Join(os.TempDir(), "saovivo")
+}
+
 func main() {
+	dataDir := flag.String("data", defaultDataDir(), "directory where the state, downloads and assets are kept")
+	workers := flag.Int("workers", 2, "videos transcoded at the same time ahead of their turn")
+	port := flag.String("port", "4000", "port of the http server")
+	host := flag.String("host", "", "address the http server listens on, every interface when empty")
+	origins := flag.String("cors", "", "comma separated origins allowed to use the API from a browser, * for any")
+	jobs := flag.Int("jobs", 2, "uploaded files processed at the same time")
+	s3Endpoint := flag.String("s3-endpoint", "", "url of the S3 compatible server of the s3:// sources, AWS when empty")
+	s3Region := flag.String("s3-region", "us-east-1", "region of the s3:// sources")
+	hlsBandwidth := flag.Int64("hls-max-bandwidth", 0, "highest bandwidth in bits per second of the variant of an HLS source, no limit when 0")
+	hlsHeight := flag.Int("hls-max-height", 0, "highest resolution height of the variant of an HLS source, no limit when 0")
+	hlsOutput := flag.Bool("hls-output", true, "publish every channel as HLS under /playlist/hls/index.m3u8")
+	hlsSegment := flag.Float64("hls-segment", 4, "seconds of the segments of the HLS of the channels")
+	hlsWindow := flag.Int("hls-window", 6, "segments in the playlist of the HLS of the channels")
+	hlsLowLatency := flag.Bool("hls-low-latency", false, "publish the HLS of the channels in fMP4 segments as short as the keyframes")
+	rtmpAddr := flag.String("rtmp", ":1935", "address of the RTMP server the channels are pulled from, rtmp://host:1935/live/<channel>?token=<token>, on the address of -host when it has no host, disabled when empty")
+	flag.Parse()
+
+	// The keys are taken from the environment as the AWS tools do
+	saovivo.S3 = saovivo.S3Config{
+		Endpoint:     *s3Endpoint,
+		Region:       *s3Region,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	saovivo.HLS = saovivo.HlsConfig{MaxBandwidth: *hlsBandwidth, MaxHeight: *hlsHeight}
 
 	fmt.Println("SaoVivo start")
-	fmt.Println("Creating temporal directory")
-	dname, err := os.MkdirTemp("", "saovivo")
-	if err != nil {
-		fmt.Printf("Error: %v", err)
-		return
-	}
+	dname := *dataDir
 	fmt.Printf("Working Directory: %s\n", dname)
 
 	download := filepath.Join(dname, "download")
 	assets := filepath.Join(dname, "assets")
 
-	if e := os.Mkdir(download, os.ModePerm); e != nil {
-		fmt.Printf("Error: %v", err)
+	if e := os.MkdirAll(download, os.ModePerm); e != nil {
+		fmt.Printf("Error: %v", e)
 		return
 	}
-	if e := os.Mkdir(assets, os.ModePerm); e != nil {
-		fmt.Printf("Error: %v", err)
+	if e := os.MkdirAll(assets, os.ModePerm); e != nil {
+		fmt.Printf("Error: %v", e)
 		return
 	}
 
@@ -418,17 +894,46 @@ func main() {
 	}
 
 	fmt.Println("Starting Server")
-	videoServer := NewVideoServer(assets, download)
+	var hls *saovivo.HlsOutput
+	if *hlsOutput {
+		hls = &saovivo.HlsOutput{Dir: filepath.Join(dname, "hls"), Segment: *hlsSegment, Window: *hlsWindow, LowLatency: *hlsLowLatency}
+	}
+	auth := newAuth(dname, *origins)
+	var rtmp *saovivo.RtmpServer
+	if *rtmpAddr != "" {
+		addr := *rtmpAddr
+		if h, p, err := net.SplitHostPort(addr); err == nil && h == "" {
+			addr = net.JoinHostPort(*host, p)
+		}
+		s, err := saovivo.NewRtmpServer(addr, auth.viewer)
+		if err != nil {
+			fmt.Printf("Error: RTMP server not started: %v\n", err)
+		}
+		rtmp = s
+	}
+	registry := NewRegistry(dname, assets, download, *workers, *jobs, hls, rtmp)
 	mux := http.NewServeMux()
 	mux.HandleFunc("/version", versionHandler)
-	mux.Handle("/playlist", videoServer)
-	mux.Handle("/playlist/remote", videoServer)
+	mux.HandleFunc("/login", loginPageHandler)
+	mux.HandleFunc("/auth/", auth.ServeAuth)
+	mux.HandleFunc("/users", auth.ServeUsers)
+	mux.HandleFunc("/tokens", auth.ServeTokens)
+	mux.HandleFunc("/audit", auth.ServeAudit)
+	// The default channel keeps the routes it had before the registry
+	mux.Handle("/playlist", registry.Default())
+	mux.Handle("/playlist/", registry.Default())
+	mux.Handle("/channels", registry)
+	mux.Handle("/channels/", registry)
+	mux.HandleFunc("/platforms", platformsHandler)
+	mux.HandleFunc("/profiles", registry.ServeProfiles)
+	mux.HandleFunc("/library", registry.ServeLibrary)
+	mux.HandleFunc("/slate", registry.ServeSlate)
+	mux.Handle(apiPrefix+"/", &apiRouter{registry: registry})
 	build, err := fs.Sub(build, "build")
 	if err != nil {
 		fmt.Printf("Error: %v", err)
 	}
 
-	port := "4000"
 	if runtime.GOOS != "linux" {
 		browser := ""
 		if runtime.GOOS == "windows" {
@@ -439,14 +944,14 @@ func main() {
 		fmt.Println("Starting Browser...")
 		go func() {
 			time.Sleep(5 * time.Second)
-			cmd := exec.Command(browser, "http://127.0.0.1:4000")
+			cmd := exec.Command(browser, "http://127.0.0.1:"+*port)
 			cmd.Run()
 		}()
-		fmt.Println("Wait 10 seconds or go to http://127.0.0.1:4000")
+		fmt.Println("Wait 10 seconds or go to http://127.0.0.1:" + *port)
 
 	}
 
 	mux.Handle("/", http.FileServer(http.FS(build)))
-	err = http.ListenAndServe(":"+port, mux)
+	err = http.ListenAndServe(*host+":"+*port, auth.handler(mux))
 	log.Fatal(err)
 }
@@ -0,0 +1,324 @@
+package main
+
+// openAPI describes the routes of /api/v1, served at /api/v1/openapi.json.
+const openAPI = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "SAOViVO",
+    "version": "1.0.0",
+    "description": "Control API of a SAOViVO channel. Every path is also served for another channel under /api/v1/channels/{channel}."
+  },
+  "servers": [{"url": "/api/v1"}],
+  "security": [{"bearer": []}, {"session": []}],
+  "paths": {
+    "/items": {
+      "get": {
+        "summary": "List the playlist",
+        "responses": {"200": {"description": "Items in play order", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Item"}}}}}}
+      },
+      "post": {
+        "summary": "Add items from a url, the library, a live source or uploaded files",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {"schema": {"$ref": "#/components/schemas/ItemsRequest"}},
+            "multipart/form-data": {"schema": {"type": "object", "properties": {"files": {"type": "array", "items": {"type": "string", "format": "binary"}}}}}
+          }
+        },
+        "responses": {
+          "201": {"description": "Items added", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ItemsResponse"}}}},
+          "202": {"description": "Files received, the jobs add them when they are processed", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ItemsResponse"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Clear the playlist while the channel is stopped",
+        "responses": {"204": {"description": "Cleared"}, "409": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/items/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/Id"}],
+      "get": {
+        "summary": "Get an item",
+        "responses": {"200": {"$ref": "#/components/responses/Item"}, "404": {"$ref": "#/components/responses/Error"}}
+      },
+      "patch": {
+        "summary": "Rename an item, change its transition or trim it, the item in play can not be trimmed",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ItemRequest"}}}},
+        "responses": {"200": {"$ref": "#/components/responses/Item"}, "400": {"$ref": "#/components/responses/Error"}, "404": {"$ref": "#/components/responses/Error"}, "409": {"$ref": "#/components/responses/Error"}}
+      },
+      "delete": {
+        "summary": "Remove a queued item",
+        "responses": {"204": {"description": "Removed"}, "404": {"$ref": "#/components/responses/Error"}, "409": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/items/{id}/position": {
+      "parameters": [{"$ref": "#/components/parameters/Id"}],
+      "put": {
+        "summary": "Move an item to a position of the queue",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "object", "required": ["position"], "properties": {"position": {"type": "integer", "minimum": 0}}}}}},
+        "responses": {"200": {"$ref": "#/components/responses/Item"}, "400": {"$ref": "#/components/responses/Error"}, "404": {"$ref": "#/components/responses/Error"}, "409": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/output": {
+      "get": {
+        "summary": "Get the main destination",
+        "responses": {"200": {"$ref": "#/components/responses/Output"}}
+      },
+      "put": {
+        "summary": "Set the main destination, an rtmp url or a youtube stream key",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Output"}}}},
+        "responses": {"200": {"$ref": "#/components/responses/Output"}, "400": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/settings": {
+      "get": {
+        "summary": "Get the settings of the channel",
+        "responses": {"200": {"$ref": "#/components/responses/Settings"}}
+      },
+      "patch": {
+        "summary": "Change the settings given, they apply the next time the channel starts",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Settings"}}}},
+        "responses": {"200": {"$ref": "#/components/responses/Settings"}, "400": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/playback": {
+      "get": {
+        "summary": "Get the status of the channel",
+        "responses": {"200": {"$ref": "#/components/responses/Playback"}}
+      },
+      "put": {
+        "summary": "Start or stop the channel, or return from the live source in play to the playlist",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "object", "required": ["status"], "properties": {"status": {"type": "string", "enum": ["start", "stop", "return"]}}}}}},
+        "responses": {"200": {"$ref": "#/components/responses/Playback"}, "400": {"$ref": "#/components/responses/Error"}, "409": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/jobs": {
+      "get": {
+        "summary": "List the processing of the uploaded files, the finished ones are kept an hour",
+        "responses": {"200": {"description": "Jobs, the oldest first", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Job"}}}}}}
+      }
+    },
+    "/jobs/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/Id"}],
+      "get": {
+        "summary": "Get the processing of an uploaded file",
+        "responses": {"200": {"description": "Job", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}}, "404": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/uploads": {
+      "get": {
+        "summary": "List the uploads sent in chunks that are not finished",
+        "responses": {"200": {"description": "Uploads, the oldest first", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Upload"}}}}}}
+      },
+      "post": {
+        "summary": "Create a resumable upload (tus 1.0.0 creation), the filename and an optional sha256 in hex go in Upload-Metadata",
+        "parameters": [
+          {"name": "Upload-Length", "in": "header", "required": true, "schema": {"type": "integer"}},
+          {"name": "Upload-Metadata", "in": "header", "required": true, "schema": {"type": "string"}}
+        ],
+        "responses": {"201": {"description": "Created, its url is in Location", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Upload"}}}}, "400": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/uploads/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/Id"}],
+      "head": {
+        "summary": "Get the offset to resume the upload from in Upload-Offset",
+        "responses": {"200": {"description": "Upload"}, "404": {"description": "Not found"}}
+      },
+      "get": {
+        "summary": "Get an upload",
+        "responses": {"200": {"description": "Upload", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Upload"}}}}, "404": {"$ref": "#/components/responses/Error"}}
+      },
+      "patch": {
+        "summary": "Append a chunk at Upload-Offset, the last one adds the file to the playlist",
+        "parameters": [
+          {"name": "Upload-Offset", "in": "header", "required": true, "schema": {"type": "integer"}},
+          {"name": "Upload-Checksum", "in": "header", "schema": {"type": "string"}, "description": "sha256 and the base64 checksum of the chunk"}
+        ],
+        "requestBody": {"required": true, "content": {"application/offset+octet-stream": {"schema": {"type": "string", "format": "binary"}}}},
+        "responses": {
+          "204": {"description": "Received, the new offset is in Upload-Offset and the job that processes the whole file in Upload-Job"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "413": {"$ref": "#/components/responses/Error"},
+          "423": {"$ref": "#/components/responses/Error"},
+          "460": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Cancel an upload",
+        "responses": {"204": {"description": "Cancelled"}, "404": {"$ref": "#/components/responses/Error"}}
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": {"type": "http", "scheme": "bearer"},
+      "session": {"type": "apiKey", "in": "cookie", "name": "saovivo_session"}
+    },
+    "parameters": {
+      "Id": {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}
+    },
+    "responses": {
+      "Error": {"description": "Error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "Item": {"description": "Item", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Item"}}}},
+      "Output": {"description": "Main destination", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Output"}}}},
+      "Settings": {"description": "Settings", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Settings"}}}},
+      "Playback": {"description": "Status", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Playback"}}}}
+    },
+    "schemas": {
+      "Job": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "name": {"type": "string"},
+          "state": {"type": "string", "enum": ["pending", "transcoding", "ready", "failed"]},
+          "progress": {"type": "number"},
+          "error": {"type": "string"},
+          "asset": {"$ref": "#/components/schemas/Asset"},
+          "created": {"type": "string", "format": "date-time"},
+          "updated": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Upload": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "name": {"type": "string"},
+          "size": {"type": "integer"},
+          "offset": {"type": "integer"},
+          "checksum": {"type": "string"},
+          "created": {"type": "string", "format": "date-time"},
+          "updated": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "properties": {"error": {"type": "string"}, "status": {"type": "integer"}}
+      },
+      "Segment": {
+        "type": "object",
+        "required": ["in"],
+        "description": "Timecodes are seconds or [hh:]mm:ss[.fff], an out of 0 plays to the end",
+        "properties": {"in": {"oneOf": [{"type": "number"}, {"type": "string"}]}, "out": {"oneOf": [{"type": "number"}, {"type": "string"}]}}
+      },
+      "Transition": {
+        "type": "object",
+        "properties": {"kind": {"type": "string"}, "duration": {"type": "number"}}
+      },
+      "LiveSource": {
+        "type": "object",
+        "required": ["kind", "url"],
+        "properties": {"kind": {"type": "string", "enum": ["hls", "pull", "push"]}, "url": {"type": "string"}, "duration": {"type": "number"}}
+      },
+      "IngestState": {
+        "type": "object",
+        "properties": {
+          "state": {"type": "string", "enum": ["pending", "uploading", "downloading", "transcoding", "ready", "failed"]},
+          "progress": {"type": "number"},
+          "error": {"type": "string"}
+        }
+      },
+      "Asset": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "name": {"type": "string"},
+          "duration": {"type": "string"},
+          "transition": {"$ref": "#/components/schemas/Transition"},
+          "live": {"$ref": "#/components/schemas/LiveSource"},
+          "library": {"type": "string"},
+          "audioOnly": {"type": "boolean"},
+          "segments": {"type": "array", "items": {"$ref": "#/components/schemas/Segment"}, "description": "Of the source played, the duration is the one of the segments"},
+          "sourceDuration": {"type": "string", "description": "Of the whole source when it is trimmed"}
+        }
+      },
+      "Item": {
+        "allOf": [
+          {"$ref": "#/components/schemas/Asset"},
+          {
+            "type": "object",
+            "properties": {
+              "place": {"type": "string", "enum": ["inPlay", "queued", "reproduced"]},
+              "position": {"type": "integer"},
+              "ingest": {"$ref": "#/components/schemas/IngestState"}
+            }
+          }
+        ]
+      },
+      "ItemsRequest": {
+        "type": "object",
+        "description": "One of url, library or live",
+        "properties": {
+          "url": {"type": "string", "description": "Youtube video or playlist, media file, HLS playlist or DASH manifest over http(s), or s3://bucket/key"},
+          "library": {"type": "array", "items": {"type": "string"}},
+          "live": {"$ref": "#/components/schemas/LiveSource"},
+          "name": {"type": "string"}
+        }
+      },
+      "ItemsResponse": {
+        "type": "object",
+        "properties": {
+          "items": {"type": "array", "items": {"$ref": "#/components/schemas/Item"}},
+          "jobs": {"type": "array", "items": {"$ref": "#/components/schemas/Job"}}
+        }
+      },
+      "ItemRequest": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "transition": {"$ref": "#/components/schemas/Transition"},
+          "segments": {"type": "array", "maxItems": 50, "items": {"$ref": "#/components/schemas/Segment"}, "description": "In order and without overlapping, empty plays the whole source"}
+        }
+      },
+      "Output": {
+        "type": "object",
+        "required": ["url"],
+        "properties": {"url": {"type": "string"}}
+      },
+      "Settings": {
+        "type": "object",
+        "properties": {
+          "loop": {"type": "boolean"},
+          "continuous": {"type": "boolean"},
+          "reconnect": {"type": "object"},
+          "prefetch": {"type": "integer", "minimum": 0, "maximum": 20},
+          "profile": {"type": "string"}
+        }
+      },
+      "Playback": {
+        "type": "object",
+        "properties": {
+          "status": {"type": "string", "enum": ["start", "stop"]},
+          "inPlay": {"$ref": "#/components/schemas/Asset"},
+          "reconnecting": {"type": "integer"},
+          "outputs": {"type": "array", "items": {"type": "object"}},
+          "hls": {
+            "type": "object",
+            "description": "The channel published as HLS, absent when the server does not publish it",
+            "properties": {
+              "url": {"type": "string", "description": "Of the media playlist, served by this server"},
+              "state": {"type": "string", "enum": ["idle", "connecting", "online", "reconnecting", "failed"]},
+              "error": {"type": "string"}
+            }
+          },
+          "rtmp": {
+            "type": "object",
+            "description": "The channel pulled from the RTMP server of the process, absent when it does not run",
+            "properties": {
+              "port": {"type": "integer"},
+              "path": {"type": "string", "description": "Of the stream, rtmp://host:port/live/<channel>?token=<token>"},
+              "flv": {"type": "string", "description": "Of the stream as HTTP-FLV, served by this server, the token can be given as ?token="},
+              "state": {"type": "string", "enum": ["idle", "connecting", "online", "reconnecting", "failed"]},
+              "error": {"type": "string"},
+              "players": {"type": "integer", "description": "Connected to the stream by RTMP or HTTP-FLV"}
+            }
+          }
+        }
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"saovivo"
+	"strings"
+)
+
+// defaultOutput is the destination configured through the "output" key of
+// the playlist, as it was done before having multiple destinations.
+const defaultOutput = "default"
+
+type outputStatus struct {
+	saovivo.Destination
+	State    string `json:"state"`
+	Error    string `json:"error,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+}
+
+// publicOutput is a destination as seen by who can not read its stream key.
+type publicOutput struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Platform string `json:"platform,omitempty"`
+	Enabled  bool   `json:"enabled"`
+	State    string `json:"state"`
+	Error    string `json:"error,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+}
+
+type outputRequest struct {
+	Id       string  `json:"id"`
+	Name     *string `json:"name"`
+	Platform *string `json:"platform"`
+	Key      *string `json:"key"`
+	Url      *string `json:"url"`
+	Enabled  *bool   `json:"enabled"`
+	Profile  *string `json:"profile"`
+}
+
+// resolve applies the platform, key and url of the request to d, the url is
+// built from the platform and key when a platform is given.
+func (body *outputRequest) resolve(d *saovivo.Destination) error {
+	platform, key, url := d.Platform, d.Key, d.Url
+	if body.Url != nil {
+		platform, key, url = "", "", *body.Url
+	}
+	if body.Platform != nil {
+		platform = *body.Platform
+	}
+	if body.Key != nil {
+		key = *body.Key
+	}
+	if platform != "" {
+		u, err := saovivo.PlatformURL(platform, key)
+		if err != nil {
+			return err
+		}
+		url = u
+	} else if err := saovivo.ValidateOutputURL(url); err != nil {
+		return err
+	}
+	d.Platform, d.Key, d.Url = platform, key, url
+	return nil
+}
+
+// resolveProfile applies the profile of the request to d, an empty profile
+// copies the stream of the channel.
+func (body *outputRequest) resolveProfile(profiles *saovivo.Profiles, d *saovivo.Destination) error {
+	if body.Profile == nil {
+		return nil
+	}
+	if *body.Profile != "" {
+		if _, err := profiles.Get(*body.Profile); err != nil {
+			return err
+		}
+	}
+	d.Profile = *body.Profile
+	return nil
+}
+
+// destinations returns a copy of the configured destinations, must be called
+// with the lock held.
+func (vs *VideoServer) destinations() []saovivo.Destination {
+	destinations := []saovivo.Destination{}
+	for _, d := range vs.outputs {
+		destinations = append(destinations, *d)
+	}
+	return destinations
+}
+
+// hasOutputs tells if the channel has where to send, the HLS or the RTMP of
+// the channel are enough.
+func (vs *VideoServer) hasOutputs() bool {
+	if vs.hls != nil || vs.rtmp != nil {
+		return true
+	}
+	for _, d := range vs.outputs {
+		if d.Enabled {
+			return true
+		}
+	}
+	return false
+}
+
+func (vs *VideoServer) getDestination(id string) *saovivo.Destination {
+	for _, d := range vs.outputs {
+		if d.Id == id {
+			return d
+		}
+	}
+	return nil
+}
+
+func (vs *VideoServer) outputsStatus() []outputStatus {
+	running := map[string]saovivo.DestinationStatus{}
+	if vs.vc != nil {
+		for _, s := range vs.vc.Destinations() {
+			running[s.Id] = s
+		}
+	}
+	status := []outputStatus{}
+	for _, d := range vs.outputs {
+		o := outputStatus{Destination: *d, State: "idle"}
+		if !d.Enabled {
+			o.State = "disabled"
+		} else if s, ok := running[d.Id]; ok {
+			o.State = s.State
+			o.Error = s.Error
+			o.Attempts = s.Attempts
+		}
+		status = append(status, o)
+	}
+	return status
+}
+
+// outputsView returns the state of the destinations, with their urls and
+// keys only when keys is set. Must be called with the lock held.
+func (vs *VideoServer) outputsView(keys bool) interface{} {
+	status := vs.outputsStatus()
+	if keys {
+		return status
+	}
+	public := []publicOutput{}
+	for _, o := range status {
+		public = append(public, publicOutput{Id: o.Id, Name: o.Name, Platform: o.Platform, Enabled: o.Enabled, State: o.State, Error: o.Error, Attempts: o.Attempts})
+	}
+	return public
+}
+
+func (vs *VideoServer) destinationChanged(s saovivo.DestinationStatus) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	name := s.Id
+	if d := vs.getDestination(s.Id); d != nil {
+		name = d.Name
+	} else if s.Id == saovivo.HlsDestination {
+		name = "HLS"
+	} else if s.Id == saovivo.RtmpDestination {
+		name = "RTMP"
+	}
+	kind := eventOutputStatus
+	if s.State == "reconnecting" {
+		kind = eventOutputReconnecting
+	}
+	vs.events.publish(kind, map[string]interface{}{"destination": s.Id, "name": name, "state": s.State, "error": s.Error, "attempts": s.Attempts})
+	switch s.State {
+	case "reconnecting":
+		vs.notify("El destino <b>%s</b> se cortó (%s), reconectando: intento %d", name, s.Error, s.Attempts)
+	case "online":
+		vs.notify("El destino <b>%s</b> volvió a transmitir", name)
+	default:
+		vs.notify("El destino <b>%s</b> dejó de transmitir: %s", name, s.Error)
+	}
+}
+
+// applyDestination updates a destination in the running channel, the rest of
+// the destinations are not affected.
+func applyDestination(vc *saovivo.VideoChannel, d saovivo.Destination, reconnect bool) error {
+	if vc == nil {
+		return nil
+	}
+	if !d.Enabled || reconnect {
+		vc.RemoveDestination(d.Id)
+	}
+	if d.Enabled {
+		return vc.AddDestination(d)
+	}
+	return nil
+}
+
+// setOutput configures the default destination, output is a YouTube stream
+// key or a complete output url.
+func (vs *VideoServer) setOutput(output string) error {
+	body := outputRequest{}
+	if strings.Contains(output, "://") {
+		body.Url = &output
+	} else {
+		platform := "youtube"
+		body.Platform, body.Key = &platform, &output
+	}
+	vs.lock.Lock()
+	d := vs.getDestination(defaultOutput)
+	if d == nil {
+		d = &saovivo.Destination{Id: defaultOutput, Name: "YouTube", Enabled: true}
+		if e := body.resolve(d); e != nil {
+			vs.lock.Unlock()
+			return e
+		}
+		vs.outputs = append(vs.outputs, d)
+	} else if e := body.resolve(d); e != nil {
+		vs.lock.Unlock()
+		return e
+	}
+	vs.persist()
+	vc, dst := vs.vc, *d
+	vs.lock.Unlock()
+	return applyDestination(vc, dst, true)
+}
+
+func (vs *VideoServer) HttpOutputsPost(w http.ResponseWriter, r *http.Request) {
+	var body outputRequest
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	if body.Url == nil && body.Platform == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", "unable to find url or platform key")
+		return
+	}
+	d := saovivo.NewDestination("", "")
+	if e := body.resolveProfile(vs.profiles, d); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	if e := body.resolve(d); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	d.Name = d.Url
+	if p := saovivo.GetPlatform(d.Platform); p != nil {
+		d.Name = p.Name
+	}
+	if body.Name != nil {
+		d.Name = *body.Name
+	}
+	if body.Enabled != nil {
+		d.Enabled = *body.Enabled
+	}
+	vs.lock.Lock()
+	vs.outputs = append(vs.outputs, d)
+	vs.persist()
+	vc, dst := vs.vc, *d
+	vs.lock.Unlock()
+
+	if e := applyDestination(vc, dst, false); e != nil {
+		setResponse(w, "error", fmt.Sprintf("Se agregó el destino <b>%s</b> pero no se pudo conectar: %v", d.Name, e))
+		return
+	}
+	data, _ := json.Marshal(dst)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
+
+func (vs *VideoServer) HttpOutputsPatch(w http.ResponseWriter, r *http.Request) {
+	var body outputRequest
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	vs.lock.Lock()
+	d := vs.getDestination(body.Id)
+	if d == nil {
+		vs.lock.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		setResponse(w, "error", "destination not found")
+		return
+	}
+	updated := *d
+	e := body.resolve(&updated)
+	if e == nil {
+		e = body.resolveProfile(vs.profiles, &updated)
+	}
+	if e != nil {
+		vs.lock.Unlock()
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	reconnect := updated.Url != d.Url || updated.Profile != d.Profile
+	*d = updated
+	if body.Name != nil {
+		d.Name = *body.Name
+	}
+	if body.Enabled != nil {
+		d.Enabled = *body.Enabled
+	}
+	vs.persist()
+	vc, dst := vs.vc, *d
+	vs.lock.Unlock()
+
+	if reconnect || body.Enabled != nil {
+		if e := applyDestination(vc, dst, reconnect); e != nil {
+			setResponse(w, "error", fmt.Sprintf("No se pudo conectar el destino <b>%s</b>: %v", dst.Name, e))
+			return
+		}
+	}
+	if dst.Enabled {
+		setResponse(w, "message", fmt.Sprintf("El destino <b>%s</b> está <b>ACTIVADO</b>", dst.Name))
+	} else {
+		setResponse(w, "message", fmt.Sprintf("El destino <b>%s</b> está <b>DESACTIVADO</b>", dst.Name))
+	}
+}
+
+func (vs *VideoServer) HttpOutputsDelete(w http.ResponseWriter, r *http.Request) {
+	var body outputRequest
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	vs.lock.Lock()
+	name, found := "", false
+	for i, d := range vs.outputs {
+		if d.Id == body.Id {
+			name, found = d.Name, true
+			vs.outputs = append(vs.outputs[:i], vs.outputs[i+1:]...)
+			break
+		}
+	}
+	if !found {
+		vs.lock.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		setResponse(w, "error", "destination not found")
+		return
+	}
+	vs.persist()
+	vc := vs.vc
+	vs.lock.Unlock()
+
+	if vc != nil {
+		vc.RemoveDestination(body.Id)
+	}
+	setResponse(w, "message", fmt.Sprintf("Se eliminó el destino <b>%s</b>", name))
+}
+
+func (vs *VideoServer) ServeOutputs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, POST, PATCH, DELETE")
+	switch r.Method {
+	case "GET":
+		vs.lock.Lock()
+		data, _ := json.Marshal(vs.outputsStatus())
+		vs.lock.Unlock()
+		w.Write(data)
+	case "POST":
+		vs.HttpOutputsPost(w, r)
+	case "PATCH":
+		vs.HttpOutputsPatch(w, r)
+	case "DELETE":
+		vs.HttpOutputsDelete(w, r)
+	case "OPTIONS":
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func platformsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET")
+	data, e := json.Marshal(saovivo.Platforms)
+	if e == nil {
+		w.Write(data)
+	} else {
+		setResponse(w, "error", "error encoding platforms")
+	}
+}
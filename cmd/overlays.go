@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"saovivo"
+	"strconv"
+)
+
+type overlayRequest struct {
+	Id      string   `json:"id"`
+	Kind    string   `json:"kind"`
+	Name    *string  `json:"name"`
+	Text    *string  `json:"text"`
+	X       *float64 `json:"x"`
+	Y       *float64 `json:"y"`
+	Opacity *float64 `json:"opacity"`
+	Scale   *float64 `json:"scale"`
+	Enabled *bool    `json:"enabled"`
+}
+
+func (body *overlayRequest) apply(o *saovivo.Overlay) {
+	if body.Name != nil {
+		o.Name = *body.Name
+	}
+	if body.Text != nil {
+		o.Text = *body.Text
+	}
+	if body.X != nil {
+		o.X = *body.X
+	}
+	if body.Y != nil {
+		o.Y = *body.Y
+	}
+	if body.Opacity != nil {
+		o.Opacity = *body.Opacity
+	}
+	if body.Scale != nil {
+		o.Scale = *body.Scale
+	}
+	if body.Enabled != nil {
+		o.Enabled = *body.Enabled
+	}
+}
+
+// formOverlay reads a logo upload, the fields of the overlay come with the
+// image in the form.
+func formOverlay(r *http.Request) (*overlayRequest, error) {
+	body := overlayRequest{Kind: saovivo.LogoOverlay}
+	if name := r.FormValue("name"); name != "" {
+		body.Name = &name
+	}
+	numbers := map[string]**float64{"x": &body.X, "y": &body.Y, "opacity": &body.Opacity, "scale": &body.Scale}
+	for key, field := range numbers {
+		if value := r.FormValue(key); value != "" {
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("wrong %s: %v", key, err)
+			}
+			*field = &n
+		}
+	}
+	if value := r.FormValue("enabled"); value != "" {
+		enabled := value == "true"
+		body.Enabled = &enabled
+	}
+	return &body, nil
+}
+
+func (vs *VideoServer) HttpOverlaysPost(w http.ResponseWriter, r *http.Request) {
+	var (
+		body  *overlayRequest
+		image string
+	)
+	if err := r.ParseMultipartForm(8 << 20); err == nil {
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			setResponse(w, "error", "unable to find the logo file")
+			return
+		}
+		defer file.Close()
+		if body, err = formOverlay(r); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			setResponse(w, "error", fmt.Sprintf("%v", err))
+			return
+		}
+		if body.Name == nil {
+			body.Name = &header.Filename
+		}
+		if image, err = vs.overlays.SaveImage(file); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			setResponse(w, "error", fmt.Sprintf("%v", err))
+			return
+		}
+	} else {
+		body = &overlayRequest{}
+		if e := json.NewDecoder(r.Body).Decode(body); e != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			setResponse(w, "error", fmt.Sprintf("%v", e))
+			return
+		}
+	}
+
+	o := saovivo.NewOverlay(body.Kind)
+	o.Image = image
+	o.Name = body.Kind
+	body.apply(&o)
+	added, err := vs.overlays.Add(o)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", err))
+		return
+	}
+	vs.lock.Lock()
+	vs.persist()
+	onAir := vs.status == "start"
+	vs.lock.Unlock()
+	if onAir && added.Kind != saovivo.LogoOverlay {
+		vs.lock.Lock()
+		vs.notify("El texto <b>%s</b> toma su posición y tamaño desde el próximo video", added.Name)
+		vs.lock.Unlock()
+	}
+	data, _ := json.Marshal(added)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
+
+func (vs *VideoServer) HttpOverlaysPatch(w http.ResponseWriter, r *http.Request) {
+	var body overlayRequest
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	o, err := vs.overlays.Update(body.Id, body.apply)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", err))
+		return
+	}
+	vs.lock.Lock()
+	vs.persist()
+	vs.lock.Unlock()
+	if o.Enabled {
+		setResponse(w, "message", fmt.Sprintf("El gráfico <b>%s</b> está <b>ACTIVADO</b>", o.Name))
+	} else {
+		setResponse(w, "message", fmt.Sprintf("El gráfico <b>%s</b> está <b>DESACTIVADO</b>", o.Name))
+	}
+}
+
+func (vs *VideoServer) HttpOverlaysDelete(w http.ResponseWriter, r *http.Request) {
+	var body overlayRequest
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	if !vs.overlays.Remove(body.Id) {
+		w.WriteHeader(http.StatusNotFound)
+		setResponse(w, "error", "overlay not found")
+		return
+	}
+	vs.lock.Lock()
+	vs.persist()
+	vs.lock.Unlock()
+	setResponse(w, "message", "Se eliminó el gráfico")
+}
+
+func (vs *VideoServer) ServeOverlays(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, POST, PATCH, DELETE")
+	switch r.Method {
+	case "GET":
+		data, _ := json.Marshal(vs.overlays.Snapshot())
+		w.Write(data)
+	case "POST":
+		vs.HttpOverlaysPost(w, r)
+	case "PATCH":
+		vs.HttpOverlaysPatch(w, r)
+	case "DELETE":
+		vs.HttpOverlaysDelete(w, r)
+	case "OPTIONS":
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
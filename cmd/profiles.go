@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"saovivo"
+)
+
+// profileInUse tells who uses a profile, must be called with the lock held.
+func (vs *VideoServer) profileInUse(id string) string {
+	if vs.profile == id {
+		return "el canal"
+	}
+	for _, d := range vs.outputs {
+		if d.Profile == id {
+			return fmt.Sprintf("el destino %s", d.Name)
+		}
+	}
+	return ""
+}
+
+// channelProfile returns the profile of the channel, must be called with the
+// lock held.
+func (vs *VideoServer) channelProfile() saovivo.Profile {
+	p, err := vs.profiles.Get(vs.profile)
+	if err != nil {
+		return saovivo.DefaultProfile
+	}
+	return p
+}
+
+func (reg *Registry) HttpProfilesPost(w http.ResponseWriter, r *http.Request) {
+	body := saovivo.DefaultProfile
+	body.VideoProfile, body.Level = "", ""
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	p, err := reg.profiles.Add(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", err))
+		return
+	}
+	reg.lock.Lock()
+	reg.persist()
+	reg.lock.Unlock()
+	data, _ := json.Marshal(p)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
+
+func (reg *Registry) HttpProfilesPatch(w http.ResponseWriter, r *http.Request) {
+	var id struct {
+		Id string `json:"id"`
+	}
+	var raw json.RawMessage
+	if e := json.NewDecoder(r.Body).Decode(&raw); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	json.Unmarshal(raw, &id)
+	p, err := reg.profiles.Get(id.Id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		setResponse(w, "error", fmt.Sprintf("%v", err))
+		return
+	}
+	// The fields not given keep their value
+	if e := json.Unmarshal(raw, &p); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	p.Id = id.Id
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	// The videos transcoded with the profile are removed when it changes
+	if user := reg.profileOnAir(p.Id); user != "" {
+		w.WriteHeader(http.StatusConflict)
+		setResponse(w, "error", fmt.Sprintf("El perfil está en uso por %s", user))
+		return
+	}
+	if err := reg.profiles.Update(p); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", err))
+		return
+	}
+	reg.persist()
+	setResponse(w, "message", fmt.Sprintf("Se actualizó el perfil <b>%s</b>, se aplica al iniciar la transmisión", p.Name))
+}
+
+func (reg *Registry) HttpProfilesDelete(w http.ResponseWriter, r *http.Request) {
+	body := make(map[string]string)
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	user := reg.profileInUse(body["id"])
+	if user == "" {
+		user = reg.profileOnAir(body["id"])
+	}
+	if user != "" {
+		w.WriteHeader(http.StatusConflict)
+		setResponse(w, "error", fmt.Sprintf("El perfil está en uso por %s", user))
+		return
+	}
+	if err := reg.profiles.Remove(body["id"]); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", err))
+		return
+	}
+	reg.persist()
+	setResponse(w, "message", "Se eliminó el perfil")
+}
+
+func (reg *Registry) ServeProfiles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, POST, PATCH, DELETE")
+	switch r.Method {
+	case "GET":
+		data, _ := json.Marshal(reg.profiles.List())
+		w.Write(data)
+	case "POST":
+		reg.HttpProfilesPost(w, r)
+	case "PATCH":
+		reg.HttpProfilesPatch(w, r)
+	case "DELETE":
+		reg.HttpProfilesDelete(w, r)
+	case "OPTIONS":
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"saovivo"
+)
+
+// progressEvents returns the events of the channel for an event of the hubs,
+// a transcode shared by several assets of the playlist is sent for each one.
+// A transcode of no asset of the channel is dropped.
+func (vs *VideoServer) progressEvents(e saovivo.ProgressEvent) []saovivo.ProgressEvent {
+	if e.Kind != "ingest" {
+		return []saovivo.ProgressEvent{e}
+	}
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	profile := vs.channelProfile()
+	events := []saovivo.ProgressEvent{}
+	for _, a := range vs.playlist.Assets() {
+		if vs.prefetcher.Key(a, profile) == e.Id {
+			e.Asset = a.Id
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// HttpProgressStream sends the progress of the transcodes and uploads of the
+// channel as they happen, one JSON object per line. It starts with the state
+// of the ones in progress.
+func (vs *VideoServer) HttpProgressStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		setResponse(w, "error", "streaming not supported")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ingest, stopIngest := vs.progress.Subscribe()
+	defer stopIngest()
+	uploads, stopUploads := vs.uploads.Subscribe()
+	defer stopUploads()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+
+	vs.lock.Lock()
+	for id, s := range vs.ingestStatus() {
+		if s.State != "ready" && s.State != "pending" {
+			enc.Encode(saovivo.ProgressEvent{Kind: "ingest", Asset: id, IngestState: s})
+		}
+	}
+	vs.lock.Unlock()
+	for _, u := range vs.receiver.Status() {
+		enc.Encode(saovivo.ProgressEvent{Kind: "upload", Id: u.Name, IngestState: u.IngestState})
+	}
+	flusher.Flush()
+
+	for {
+		var e saovivo.ProgressEvent
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok = <-ingest:
+		case e, ok = <-uploads:
+		}
+		if !ok {
+			return
+		}
+		for _, event := range vs.progressEvents(e) {
+			if err := enc.Encode(event); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func (vs *VideoServer) ServeProgress(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET")
+	switch r.Method {
+	case "GET":
+		vs.HttpProgressStream(w, r)
+	case "OPTIONS":
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"saovivo"
+)
+
+// flvPath is where the HTTP-FLV of a channel is served, relative to the
+// channel
+const flvPath = "/playlist/live.flv"
+
+// rtmpStatus tells where the RTMP of the channel is pulled from, the host is
+// the one of the server.
+type rtmpStatus struct {
+	Port    int    `json:"port"`
+	Path    string `json:"path"` // rtmp://host:port/live/<channel>?token=<token>
+	Flv     string `json:"flv"`
+	State   string `json:"state"`
+	Error   string `json:"error,omitempty"`
+	Players int    `json:"players"`
+}
+
+// rtmpURL returns where the channel publishes to the RTMP server, empty when
+// the server does not run.
+func (vs *VideoServer) rtmpURL() string {
+	if vs.rtmp == nil {
+		return ""
+	}
+	return vs.rtmp.PublishURL(vs.id)
+}
+
+// rtmpStatus returns the state of the RTMP of the channel, must be called
+// with the lock held.
+func (vs *VideoServer) rtmpStatus() *rtmpStatus {
+	if vs.rtmp == nil {
+		return nil
+	}
+	s := &rtmpStatus{
+		Port:    vs.rtmp.Port(),
+		Path:    fmt.Sprintf("/%s/%s", saovivo.RtmpApp, vs.id),
+		Flv:     flvPath,
+		State:   "idle",
+		Players: vs.rtmp.Players()[vs.id],
+	}
+	if vs.id != defaultChannel {
+		s.Flv = "/channels/" + vs.id + s.Flv
+	}
+	if vs.vc != nil {
+		for _, d := range vs.vc.Destinations() {
+			if d.Id == saovivo.RtmpDestination {
+				s.State, s.Error = d.State, d.Error
+			}
+		}
+	}
+	return s
+}
+
+// flushWriter sends every write to the client as it is made.
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.f.Flush()
+	return n, err
+}
+
+// ServeFlv sends the stream of the channel as HTTP-FLV until the client goes
+// away, from the last keyframe.
+func (vs *VideoServer) ServeFlv(w http.ResponseWriter, r *http.Request) {
+	if vs.rtmp == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "video/x-flv")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	vs.rtmp.WriteFLV(flushWriter{w: w, f: flusher}, vs.id, r.Context().Done())
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"saovivo"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type scheduleRequest struct {
+	Id    string     `json:"id"`    // Schedule entry
+	Asset string     `json:"asset"` // Asset of the playlist to schedule
+	Url   string     `json:"url"`   // Remote video to schedule
+	Item  string     `json:"item"`  // Library item to schedule
+	Start *time.Time `json:"start"`
+	Cut   *string    `json:"cut"`
+}
+
+func (vs *VideoServer) HttpSchedulePost(w http.ResponseWriter, r *http.Request) {
+	var body scheduleRequest
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	if body.Start == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", "unable to find start key")
+		return
+	}
+	cut := saovivo.SoftCut
+	if body.Cut != nil {
+		cut = *body.Cut
+	}
+
+	assets := []*saovivo.Asset{}
+	if body.Asset != "" {
+		vs.lock.Lock()
+		asset := vs.playlist.GetAssetById(body.Asset)
+		vs.lock.Unlock()
+		if asset == nil {
+			w.WriteHeader(http.StatusNotFound)
+			setResponse(w, "error", "asset not found")
+			return
+		}
+		a := *asset
+		assets = append(assets, &a)
+	} else if body.Url != "" {
+		url := body.Url
+		if !strings.Contains(url, "://") {
+			url = "http://" + url
+		}
+		remote, err := vs.receiver.GetRemote(url)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			setResponse(w, "error", fmt.Sprintf("%v", err))
+			return
+		}
+		vs.catalog(remote)
+		assets = remote
+	} else if body.Item != "" {
+		a, err := vs.library.Asset(body.Item)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			setResponse(w, "error", fmt.Sprintf("%v", err))
+			return
+		}
+		assets = append(assets, a)
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", "unable to find asset, url or item key")
+		return
+	}
+
+	vs.lock.Lock()
+	start := *body.Start
+	for i, a := range assets {
+		// The videos of a remote playlist are scheduled one after the other
+		c := cut
+		if i > 0 {
+			c = saovivo.SoftCut
+		}
+		if _, e := vs.schedule.Add(start, a, c); e != nil {
+			vs.lock.Unlock()
+			w.WriteHeader(http.StatusBadRequest)
+			setResponse(w, "error", fmt.Sprintf("%v", e))
+			return
+		}
+		if d, e := strconv.ParseFloat(a.Duration, 64); e == nil {
+			start = start.Add(time.Duration(d * float64(time.Second)))
+		}
+		vs.notify("El video <b>%s</b> se programó para las %s", a.Name, body.Start.Local().Format("02/01 15:04"))
+	}
+	vs.persist()
+	vs.lock.Unlock()
+	vs.scheduleUpdated()
+	w.WriteHeader(http.StatusCreated)
+	setResponse(w, "message", "Se agregaron videos a la programación")
+}
+
+func (vs *VideoServer) HttpSchedulePatch(w http.ResponseWriter, r *http.Request) {
+	var body scheduleRequest
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	vs.lock.Lock()
+	err := vs.schedule.Update(body.Id, body.Start, body.Cut)
+	if err == nil {
+		vs.persist()
+	}
+	vs.lock.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", err))
+		return
+	}
+	vs.scheduleUpdated()
+	setResponse(w, "message", "Se modificó la programación")
+}
+
+func (vs *VideoServer) HttpScheduleDelete(w http.ResponseWriter, r *http.Request) {
+	var body scheduleRequest
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	vs.lock.Lock()
+	if vs.playing != nil && vs.playing.Id == body.Id {
+		vs.lock.Unlock()
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", "No se puede borrar un video programado que está en reproducción")
+		return
+	}
+	b := vs.schedule.Remove(body.Id)
+	if b {
+		vs.persist()
+	}
+	vs.lock.Unlock()
+	if !b {
+		w.WriteHeader(http.StatusNotFound)
+		setResponse(w, "error", "schedule entry not found")
+		return
+	}
+	vs.scheduleUpdated()
+	setResponse(w, "message", "Se eliminó el video de la programación")
+}
+
+func (vs *VideoServer) ServeSchedule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, POST, PATCH, DELETE")
+	switch r.Method {
+	case "GET":
+		vs.lock.Lock()
+		data, _ := json.Marshal(vs.schedule.List())
+		vs.lock.Unlock()
+		w.Write(data)
+	case "POST":
+		vs.HttpSchedulePost(w, r)
+	case "PATCH":
+		vs.HttpSchedulePatch(w, r)
+	case "DELETE":
+		vs.HttpScheduleDelete(w, r)
+	case "OPTIONS":
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"saovivo"
+)
+
+// maxSlate is the biggest image accepted as slate
+const maxSlate = 16 << 20
+
+func (reg *Registry) HttpSlatePut(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	r.Body = http.MaxBytesReader(w, r.Body, maxSlate)
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", err))
+		return
+	}
+	defer file.Close()
+	if err := saovivo.SaveSlate(reg.slate, file); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", err))
+		return
+	}
+	setResponse(w, "message", "La imagen de los audios fue actualizada")
+}
+
+func (reg *Registry) HttpSlateDelete(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := os.Remove(reg.slate); err != nil && !os.IsNotExist(err) {
+		w.WriteHeader(http.StatusInternalServerError)
+		setResponse(w, "error", fmt.Sprintf("%v", err))
+		return
+	}
+	setResponse(w, "message", "Los audios se muestran sobre negro")
+}
+
+// ServeSlate handles the image shown under the assets that only have audio,
+// without it they are shown over black. The transcodes done before a change
+// keep the previous image.
+func (reg *Registry) ServeSlate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, PUT, POST, DELETE")
+	switch r.Method {
+	case "GET":
+		if _, err := os.Stat(reg.slate); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeFile(w, r, reg.slate)
+	case "PUT", "POST":
+		reg.HttpSlatePut(w, r)
+	case "DELETE":
+		reg.HttpSlateDelete(w, r)
+	case "OPTIONS":
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"saovivo"
+	"strconv"
+	"strings"
+)
+
+// The uploads sent in chunks follow the tus protocol (https://tus.io) with
+// the creation, checksum, termination and expiration extensions, so a tus
+// client resumes an interrupted upload from where it was cut.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,checksum,termination,expiration"
+	tusChecksums  = "sha256"
+)
+
+// statusChecksumMismatch is the status of the tus checksum extension for a
+// chunk that does not match its checksum
+const statusChecksumMismatch = 460
+
+// tusMetadata decodes the Upload-Metadata header, pairs of a key and a base64
+// value separated by commas.
+func tusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, " ")
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata, nil
+}
+
+// tusChecksum decodes the Upload-Checksum header, the algorithm and the
+// base64 checksum of the chunk.
+func tusChecksum(header string) ([]byte, error) {
+	if header == "" {
+		return nil, nil
+	}
+	algorithm, value, _ := strings.Cut(header, " ")
+	if algorithm != "sha256" {
+		return nil, errors.New("unsupported checksum algorithm " + algorithm)
+	}
+	return base64.StdEncoding.DecodeString(value)
+}
+
+// uploadHeaders sets the state of the upload for the tus client.
+func uploadHeaders(w http.ResponseWriter, u saovivo.Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Size, 10))
+	w.Header().Set("Upload-Expires", u.Expires().UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func uploadError(w http.ResponseWriter, err error) {
+	switch err {
+	case saovivo.ErrUploadNotFound:
+		writeError(w, http.StatusNotFound, "%v", err)
+	case saovivo.ErrUploadOffset:
+		writeError(w, http.StatusConflict, "%v", err)
+	case saovivo.ErrUploadBusy:
+		writeError(w, http.StatusLocked, "%v", err)
+	case saovivo.ErrUploadSize:
+		writeError(w, http.StatusRequestEntityTooLarge, "%v", err)
+	case saovivo.ErrUploadChecksum:
+		writeError(w, statusChecksumMismatch, "%v", err)
+	default:
+		writeError(w, http.StatusInternalServerError, "%v", err)
+	}
+}
+
+// tusOptions lets a tus client discover what the server supports.
+func tusOptions(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if !strings.HasPrefix(path, apiPrefix+"/") || !(strings.HasSuffix(path, "/uploads") || strings.Contains(path, "/uploads/")) {
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Checksum-Algorithm", tusChecksums)
+}
+
+// tusRequest answers with the version of the protocol, a client of another
+// version is refused.
+func tusRequest(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if v := r.Header.Get("Tus-Resumable"); v != "" && v != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeError(w, http.StatusPreconditionFailed, "tus version %s not supported", v)
+		return false
+	}
+	return true
+}
+
+// apiUploadsPost creates an upload from its Upload-Length and the filename
+// of its Upload-Metadata, a sha256 in hex in the metadata is verified once
+// the whole file arrives.
+func (vs *VideoServer) apiUploadsPost(w http.ResponseWriter, r *http.Request) {
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "wrong Upload-Length: %v", err)
+		return
+	}
+	metadata, err := tusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "wrong Upload-Metadata: %v", err)
+		return
+	}
+	name := metadata["filename"]
+	if name == "" {
+		name = metadata["name"]
+	}
+	u, err := vs.receiver.CreateUpload(name, size, metadata["sha256"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	uploadHeaders(w, u)
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+u.Id)
+	writeJSON(w, http.StatusCreated, u)
+}
+
+// apiUploadPatch appends a chunk, the file is processed after the last one
+// and added to the playlist when it is ready.
+func (vs *VideoServer) apiUploadPatch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeError(w, http.StatusUnsupportedMediaType, "the chunk must be sent as application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "wrong Upload-Offset: %v", err)
+		return
+	}
+	checksum, err := tusChecksum(r.Header.Get("Upload-Checksum"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "wrong Upload-Checksum: %v", err)
+		return
+	}
+	u, job, err := vs.receiver.WriteChunk(id, offset, r.Body, checksum)
+	if err != nil {
+		if u.Id != "" {
+			uploadHeaders(w, u)
+		}
+		uploadError(w, err)
+		return
+	}
+	if job != nil {
+		// The job that processes the file, see /jobs
+		w.Header().Set("Upload-Job", job.Id)
+	}
+	uploadHeaders(w, u)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (vs *VideoServer) apiUploads(w http.ResponseWriter, r *http.Request) {
+	if !tusRequest(w, r) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, vs.receiver.Uploads())
+	case "POST":
+		vs.apiUploadsPost(w, r)
+	default:
+		methodNotAllowed(w, r, "GET", "POST")
+	}
+}
+
+func (vs *VideoServer) apiUpload(w http.ResponseWriter, r *http.Request, id string) {
+	if !tusRequest(w, r) {
+		return
+	}
+	switch r.Method {
+	case "HEAD", "GET":
+		u, err := vs.receiver.Upload(id)
+		if err != nil {
+			uploadError(w, err)
+			return
+		}
+		uploadHeaders(w, u)
+		writeJSON(w, http.StatusOK, u)
+	case "PATCH":
+		vs.apiUploadPatch(w, r, id)
+	case "DELETE":
+		if err := vs.receiver.CancelUpload(id); err != nil {
+			uploadError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, r, "HEAD", "GET", "PATCH", "DELETE")
+	}
+}
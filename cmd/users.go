@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"saovivo"
+	"strconv"
+	"time"
+)
+
+type loginRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type userRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+type tokenRequest struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	User string `json:"user"` // Only an admin creates tokens for other users
+}
+
+// loginPage lets a browser log in before the web UI is opened.
+const loginPage = `<!DOCTYPE html>
+<html lang="es">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>SAOViVO</title>
+<style>
+body { font-family: sans-serif; background: #1d1f24; color: #eee; display: flex; align-items: center; justify-content: center; height: 100vh; margin: 0; }
+form { background: #2a2d34; padding: 2em; border-radius: 8px; width: 280px; }
+input, button { display: block; width: 100%; box-sizing: border-box; margin: 0.5em 0; padding: 0.6em; }
+#error { color: #f66; min-height: 1.2em; }
+</style>
+</head>
+<body>
+<form id="login">
+<h2>SAOViVO</h2>
+<input name="name" placeholder="Usuario" autocomplete="username" required>
+<input name="password" type="password" placeholder="Contraseña" autocomplete="current-password" required>
+<button type="submit">Ingresar</button>
+<div id="error"></div>
+</form>
+<script>
+document.getElementById("login").addEventListener("submit", function (e) {
+  e.preventDefault();
+  var f = e.target;
+  fetch("/auth/login", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ name: f.name.value, password: f.password.value })
+  }).then(function (r) {
+    return r.json().then(function (body) {
+      if (r.ok) { window.location = "/"; } else { document.getElementById("error").innerHTML = body.error; }
+    });
+  });
+});
+</script>
+</body>
+</html>
+`
+
+func loginPageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(loginPage))
+}
+
+func (a *auth) HttpLogin(w http.ResponseWriter, r *http.Request) {
+	var body loginRequest
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	key, user, err := a.users.Login(body.Name, body.Password)
+	entry := saovivo.AuditEntry{Time: time.Now(), User: body.Name, Remote: remoteAddr(r), Method: r.Method, Path: r.URL.Path, Status: http.StatusOK}
+	if err != nil {
+		entry.Status = http.StatusUnauthorized
+		a.audit.Record(entry)
+		w.WriteHeader(http.StatusUnauthorized)
+		setResponse(w, "error", "Usuario o contraseña incorrectos")
+		return
+	}
+	entry.Role = user.Role
+	a.audit.Record(entry)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    key,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   r.TLS != nil,
+	})
+	data, _ := json.Marshal(map[string]interface{}{"user": user, "token": key})
+	w.Write(data)
+}
+
+func (a *auth) HttpLogout(w http.ResponseWriter, r *http.Request) {
+	a.users.Logout(credential(r))
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	setResponse(w, "message", "Sesión cerrada")
+}
+
+// ServeAuth handles the login of the web UI, /auth/me returns who is logged.
+func (a *auth) ServeAuth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, POST")
+	switch {
+	case r.URL.Path == "/auth/login" && r.Method == "POST":
+		a.HttpLogin(w, r)
+	case r.URL.Path == "/auth/logout" && r.Method == "POST":
+		a.HttpLogout(w, r)
+	case r.URL.Path == "/auth/me" && r.Method == "GET":
+		user, _ := userOf(r)
+		data, _ := json.Marshal(user)
+		w.Write(data)
+	case r.Method == "OPTIONS":
+		return
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (a *auth) HttpUsersPost(w http.ResponseWriter, r *http.Request) {
+	var body userRequest
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	user, err := a.users.Add(body.Name, body.Password, body.Role)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	data, _ := json.Marshal(user)
+	w.Write(data)
+}
+
+func (a *auth) HttpUsersPatch(w http.ResponseWriter, r *http.Request) {
+	var body userRequest
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	user, err := a.users.Update(body.Name, body.Password, body.Role)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", err))
+		return
+	}
+	data, _ := json.Marshal(user)
+	w.Write(data)
+}
+
+func (a *auth) HttpUsersDelete(w http.ResponseWriter, r *http.Request) {
+	var body userRequest
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	if err := a.users.Remove(body.Name); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", err))
+		return
+	}
+	setResponse(w, "message", fmt.Sprintf("El usuario <b>%s</b> fue eliminado", body.Name))
+}
+
+func (a *auth) ServeUsers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, POST, PATCH, DELETE")
+	switch r.Method {
+	case "GET":
+		data, _ := json.Marshal(a.users.List())
+		w.Write(data)
+	case "POST":
+		a.HttpUsersPost(w, r)
+	case "PATCH":
+		a.HttpUsersPatch(w, r)
+	case "DELETE":
+		a.HttpUsersDelete(w, r)
+	case "OPTIONS":
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// tokenOwner returns whose tokens the request manages, an admin manages the
+// tokens of every user.
+func tokenOwner(r *http.Request, requested string) (string, bool) {
+	user, _ := userOf(r)
+	if requested == "" || requested == user.Name {
+		return user.Name, true
+	}
+	return requested, user.Role == saovivo.RoleAdmin
+}
+
+func (a *auth) HttpTokensPost(w http.ResponseWriter, r *http.Request) {
+	var body tokenRequest
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	owner, ok := tokenOwner(r, body.User)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		setResponse(w, "error", "Solo un administrador crea tokens para otros usuarios")
+		return
+	}
+	if body.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", "token without name")
+		return
+	}
+	token, key, err := a.users.AddToken(owner, body.Name)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", err))
+		return
+	}
+	// The key is shown only once
+	w.WriteHeader(http.StatusCreated)
+	data, _ := json.Marshal(map[string]interface{}{"token": token, "key": key})
+	w.Write(data)
+}
+
+func (a *auth) HttpTokensDelete(w http.ResponseWriter, r *http.Request) {
+	var body tokenRequest
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		setResponse(w, "error", fmt.Sprintf("%v", e))
+		return
+	}
+	owner := ""
+	if !allowed(r, saovivo.RoleAdmin) {
+		owner, _ = tokenOwner(r, "")
+	}
+	if err := a.users.RemoveToken(body.Id, owner); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		setResponse(w, "error", fmt.Sprintf("%v", err))
+		return
+	}
+	setResponse(w, "message", "El token fue eliminado")
+}
+
+func (a *auth) ServeTokens(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, POST, DELETE")
+	switch r.Method {
+	case "GET":
+		owner, _ := tokenOwner(r, "")
+		if allowed(r, saovivo.RoleAdmin) {
+			owner = r.URL.Query().Get("user")
+		}
+		data, _ := json.Marshal(a.users.Tokens(owner))
+		w.Write(data)
+	case "POST":
+		a.HttpTokensPost(w, r)
+	case "DELETE":
+		a.HttpTokensDelete(w, r)
+	case "OPTIONS":
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// ServeAudit returns the last changes, ?limit= of them (100 by default) and
+// only the ones of ?user= when given.
+func (a *auth) ServeAudit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET")
+	switch r.Method {
+	case "GET":
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 100
+		}
+		entries, err := a.audit.Recent(limit, r.URL.Query().Get("user"))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			setResponse(w, "error", fmt.Sprintf("%v", err))
+			return
+		}
+		data, _ := json.Marshal(entries)
+		w.Write(data)
+	case "OPTIONS":
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,456 @@
+package saovivo
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The elements of a DASH manifest (ISO/IEC 23009-1) used to list the
+// segments of a static presentation.
+type mpd struct {
+	Type     string      `xml:"type,attr"`
+	Duration string      `xml:"mediaPresentationDuration,attr"`
+	BaseURL  []string    `xml:"BaseURL"`
+	Periods  []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	Start          string             `xml:"start,attr"`
+	Duration       string             `xml:"duration,attr"`
+	BaseURL        []string           `xml:"BaseURL"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ContentType     string              `xml:"contentType,attr"`
+	MimeType        string              `xml:"mimeType,attr"`
+	BaseURL         []string            `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+	SegmentBase     *mpdSegmentBase     `xml:"SegmentBase"`
+	Representations []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	Id              string              `xml:"id,attr"`
+	Bandwidth       int64               `xml:"bandwidth,attr"`
+	MimeType        string              `xml:"mimeType,attr"`
+	BaseURL         []string            `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+	SegmentBase     *mpdSegmentBase     `xml:"SegmentBase"`
+}
+
+type mpdSegmentTemplate struct {
+	Media          string       `xml:"media,attr"`
+	Initialization string       `xml:"initialization,attr"`
+	StartNumber    *int64       `xml:"startNumber,attr"`
+	Timescale      *int64       `xml:"timescale,attr"`
+	Duration       *int64       `xml:"duration,attr"`
+	Offset         *int64       `xml:"presentationTimeOffset,attr"` // Time of the start of the period
+	Timeline       *mpdTimeline `xml:"SegmentTimeline"`
+}
+
+type mpdTimeline struct {
+	S []mpdTimelineS `xml:"S"`
+}
+
+type mpdTimelineS struct {
+	T *int64 `xml:"t,attr"`
+	D int64  `xml:"d,attr"`
+	R int64  `xml:"r,attr"`
+}
+
+type mpdSegmentList struct {
+	Initialization *mpdURL         `xml:"Initialization"`
+	SegmentURLs    []mpdSegmentURL `xml:"SegmentURL"`
+}
+
+type mpdSegmentURL struct {
+	Media      string `xml:"media,attr"`
+	MediaRange string `xml:"mediaRange,attr"`
+}
+
+type mpdSegmentBase struct {
+	Initialization *mpdURL `xml:"Initialization"`
+}
+
+type mpdURL struct {
+	SourceURL string `xml:"sourceURL,attr"`
+	Range     string `xml:"range,attr"`
+}
+
+// mpdSegments is the most segments listed for a representation, a wrong
+// duration in the manifest must not make an endless list
+const mpdSegments = 200000
+
+var isoDuration = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseDuration returns the seconds of an ISO 8601 duration as DASH uses
+// them, PT1H2M3.5S.
+func parseDuration(s string) (float64, error) {
+	m := isoDuration.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil || s == "P" || s == "PT" {
+		return 0, fmt.Errorf("wrong duration %q", s)
+	}
+	seconds := 0.0
+	for i, unit := range []float64{86400, 3600, 60, 1} {
+		if m[i+1] != "" {
+			v, _ := strconv.ParseFloat(m[i+1], 64)
+			seconds += v * unit
+		}
+	}
+	return seconds, nil
+}
+
+var templateIdentifier = regexp.MustCompile(`\$(RepresentationID|Number|Bandwidth|Time|)(?:%0(\d+)d)?\$`)
+
+// expandTemplate replaces the identifiers of a SegmentTemplate url, $$ is a
+// dollar.
+func expandTemplate(template string, r mpdRepresentation, number int64, time int64) string {
+	return templateIdentifier.ReplaceAllStringFunc(template, func(id string) string {
+		m := templateIdentifier.FindStringSubmatch(id)
+		var value string
+		switch m[1] {
+		case "":
+			return "$"
+		case "RepresentationID":
+			return r.Id
+		case "Number":
+			value = strconv.FormatInt(number, 10)
+		case "Bandwidth":
+			value = strconv.FormatInt(r.Bandwidth, 10)
+		case "Time":
+			value = strconv.FormatInt(time, 10)
+		}
+		if width, _ := strconv.Atoi(m[2]); len(value) < width {
+			value = strings.Repeat("0", width-len(value)) + value
+		}
+		return value
+	})
+}
+
+// parseRange reads a byte range of the manifest, first-last.
+func parseRange(s string) (int64, int64, error) {
+	first, last, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("wrong byte range %q", s)
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("wrong byte range %q", s)
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, fmt.Errorf("wrong byte range %q", s)
+	}
+	return start, end - start + 1, nil
+}
+
+// resolveBase applies the BaseURL of an element to the base of its parent.
+func resolveBase(base *url.URL, baseURLs []string) *url.URL {
+	if len(baseURLs) == 0 {
+		return base
+	}
+	ref, err := url.Parse(strings.TrimSpace(baseURLs[0]))
+	if err != nil {
+		return base
+	}
+	return base.ResolveReference(ref)
+}
+
+func resolveSegment(base *url.URL, uri string, byteRange string) (segment, error) {
+	s := segment{uri: base.String()}
+	if uri != "" {
+		ref, err := url.Parse(uri)
+		if err != nil {
+			return s, err
+		}
+		s.uri = base.ResolveReference(ref).String()
+	}
+	if byteRange != "" {
+		var err error
+		if s.offset, s.length, err = parseRange(byteRange); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// mergeTemplate fills the attributes of the template of a representation
+// that it inherits from the one of its adaptation set.
+func mergeTemplate(set *mpdSegmentTemplate, rep *mpdSegmentTemplate) *mpdSegmentTemplate {
+	if rep == nil {
+		return set
+	}
+	if set == nil {
+		return rep
+	}
+	t := *rep
+	if t.Media == "" {
+		t.Media = set.Media
+	}
+	if t.Initialization == "" {
+		t.Initialization = set.Initialization
+	}
+	if t.StartNumber == nil {
+		t.StartNumber = set.StartNumber
+	}
+	if t.Timescale == nil {
+		t.Timescale = set.Timescale
+	}
+	if t.Duration == nil {
+		t.Duration = set.Duration
+	}
+	if t.Offset == nil {
+		t.Offset = set.Offset
+	}
+	if t.Timeline == nil {
+		t.Timeline = set.Timeline
+	}
+	return &t
+}
+
+// templateSegments lists the segments of a SegmentTemplate, from its
+// SegmentTimeline or from the duration of every segment.
+func templateSegments(base *url.URL, t *mpdSegmentTemplate, r mpdRepresentation, period float64) ([]segment, error) {
+	var (
+		segments  []segment
+		number    int64 = 1
+		timescale int64 = 1
+		offset    int64
+	)
+	if t.StartNumber != nil {
+		number = *t.StartNumber
+	}
+	if t.Offset != nil {
+		offset = *t.Offset
+	}
+	first := number
+	if t.Timescale != nil && *t.Timescale > 0 {
+		timescale = *t.Timescale
+	}
+	if t.Initialization != "" {
+		s, err := resolveSegment(base, expandTemplate(t.Initialization, r, 0, 0), "")
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, s)
+	}
+	add := func(time int64) error {
+		if len(segments) > mpdSegments {
+			return fmt.Errorf("too many segments in the manifest")
+		}
+		s, err := resolveSegment(base, expandTemplate(t.Media, r, number, time), "")
+		if err != nil {
+			return err
+		}
+		segments = append(segments, s)
+		number++
+		return nil
+	}
+
+	switch {
+	case t.Timeline != nil:
+		var time int64
+		// The times of the timeline count from the offset
+		end := offset + int64(period*float64(timescale))
+		for i, s := range t.Timeline.S {
+			if s.T != nil {
+				time = *s.T
+			}
+			if s.D <= 0 {
+				return nil, fmt.Errorf("segment without duration in the timeline")
+			}
+			repeat := s.R
+			if repeat < 0 {
+				// Until the next S or the end of the period
+				next := end
+				if i+1 < len(t.Timeline.S) && t.Timeline.S[i+1].T != nil {
+					next = *t.Timeline.S[i+1].T
+				}
+				repeat = int64(math.Ceil(float64(next-time)/float64(s.D))) - 1
+				if repeat < 0 {
+					repeat = 0
+				}
+			}
+			for j := int64(0); j <= repeat; j++ {
+				if err := add(time); err != nil {
+					return nil, err
+				}
+				time += s.D
+			}
+		}
+	case t.Duration != nil && *t.Duration > 0:
+		if period <= 0 {
+			return nil, fmt.Errorf("the manifest has no duration")
+		}
+		count := int64(math.Ceil(period * float64(timescale) / float64(*t.Duration)))
+		for i := int64(0); i < count; i++ {
+			if err := add(i * *t.Duration); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("segment template without duration or timeline")
+	}
+	if number == first {
+		return nil, fmt.Errorf("representation %s without media segments", r.Id)
+	}
+	return segments, nil
+}
+
+// representationSegments lists the init and media segments of a
+// representation, a SegmentBase is a single file.
+func representationSegments(base *url.URL, set mpdAdaptationSet, r mpdRepresentation, period float64) ([]segment, error) {
+	base = resolveBase(base, r.BaseURL)
+	if t := mergeTemplate(set.SegmentTemplate, r.SegmentTemplate); t != nil {
+		return templateSegments(base, t, r, period)
+	}
+	list := r.SegmentList
+	if list == nil {
+		list = set.SegmentList
+	}
+	if list != nil {
+		segments := []segment{}
+		if list.Initialization != nil {
+			s, err := resolveSegment(base, list.Initialization.SourceURL, list.Initialization.Range)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, s)
+		}
+		if len(list.SegmentURLs) == 0 {
+			return nil, fmt.Errorf("representation %s without media segments", r.Id)
+		}
+		for _, u := range list.SegmentURLs {
+			s, err := resolveSegment(base, u.Media, u.MediaRange)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, s)
+		}
+		return segments, nil
+	}
+	// SegmentBase or only a BaseURL, the file has its own index
+	return []segment{{uri: base.String()}}, nil
+}
+
+// setKind tells if an adaptation set is video or audio, empty for the rest.
+func setKind(set mpdAdaptationSet) string {
+	kind := set.ContentType
+	if kind == "" {
+		mime := set.MimeType
+		if mime == "" && len(set.Representations) > 0 {
+			mime = set.Representations[0].MimeType
+		}
+		kind, _, _ = strings.Cut(mime, "/")
+	}
+	if kind == "video" || kind == "audio" {
+		return kind
+	}
+	return ""
+}
+
+// bestRepresentation returns the representation of the highest bandwidth of
+// the first adaptation set of a kind.
+func bestRepresentation(period mpdPeriod, kind string) (mpdAdaptationSet, mpdRepresentation, bool) {
+	for _, set := range period.AdaptationSets {
+		if setKind(set) != kind || len(set.Representations) == 0 {
+			continue
+		}
+		best := set.Representations[0]
+		for _, r := range set.Representations[1:] {
+			if r.Bandwidth > best.Bandwidth {
+				best = r
+			}
+		}
+		return set, best, true
+	}
+	return mpdAdaptationSet{}, mpdRepresentation{}, false
+}
+
+// periodDurations returns how long each period lasts, from its duration, the
+// start of the next one or the duration of the presentation.
+func periodDurations(m mpd) []float64 {
+	total, _ := parseDuration(m.Duration)
+	starts := make([]float64, len(m.Periods))
+	durations := make([]float64, len(m.Periods))
+	for i, p := range m.Periods {
+		if p.Start != "" {
+			starts[i], _ = parseDuration(p.Start)
+		} else if i > 0 {
+			starts[i] = starts[i-1] + durations[i-1]
+		}
+		if p.Duration != "" {
+			durations[i], _ = parseDuration(p.Duration)
+		}
+		if i > 0 && durations[i-1] == 0 && p.Start != "" {
+			durations[i-1] = starts[i] - starts[i-1]
+		}
+	}
+	if n := len(m.Periods); n > 0 && durations[n-1] == 0 && total > 0 {
+		durations[n-1] = total - starts[n-1]
+	}
+	return durations
+}
+
+// getDashSegments reads a static DASH manifest and returns the segments of
+// the video and of the audio of the representations of highest bandwidth,
+// the init segments first. audio is empty when it is in the video or there is
+// no audio, video is empty for an audio.
+func getDashSegments(uri string) ([]segment, []segment, error) {
+	rsp, err := remoteClient.Get(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != 200 {
+		return nil, nil, fmt.Errorf("the manifest answered %s", rsp.Status)
+	}
+	var m mpd
+	if err := xml.NewDecoder(rsp.Body).Decode(&m); err != nil {
+		return nil, nil, fmt.Errorf("wrong DASH manifest: %v", err)
+	}
+	if m.Type == "dynamic" {
+		return nil, nil, fmt.Errorf("the DASH manifest is live, add it as a live source")
+	}
+	base, err := url.Parse(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	base = resolveBase(base, m.BaseURL)
+
+	var video, audio []segment
+	durations := periodDurations(m)
+	for i, p := range m.Periods {
+		pbase := resolveBase(base, p.BaseURL)
+		for _, kind := range []string{"video", "audio"} {
+			set, r, ok := bestRepresentation(p, kind)
+			if !ok {
+				continue
+			}
+			segments, err := representationSegments(resolveBase(pbase, set.BaseURL), set, r, durations[i])
+			if err != nil {
+				return nil, nil, err
+			}
+			if kind == "video" {
+				video = append(video, segments...)
+			} else {
+				audio = append(audio, segments...)
+			}
+		}
+	}
+	if len(video) == 0 {
+		if len(audio) == 0 {
+			return nil, nil, fmt.Errorf("no audio or video in the DASH manifest")
+		}
+		return audio, nil, nil
+	}
+	return video, audio, nil
+}
@@ -0,0 +1,193 @@
+package saovivo
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// dashManifest returns a static manifest of a period of seconds with the
+// adaptation sets given.
+func dashManifest(seconds int, sets string) string {
+	return fmt.Sprintf(`<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT%dS">
+  <Period>%s</Period>
+</MPD>`, seconds, sets)
+}
+
+// segmentNames returns the urls of the segments relative to the server, with
+// the byte range when there is one.
+func segmentNames(server string, segments []segment) []string {
+	names := []string{}
+	for _, s := range segments {
+		name := strings.TrimPrefix(s.uri, server)
+		if s.length > 0 {
+			name += fmt.Sprintf("@%d+%d", s.offset, s.length)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestDashSegments(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		video    []string
+		audio    []string
+		err      string
+	}{
+		{
+			name: "template with duration",
+			manifest: dashManifest(10, `<AdaptationSet contentType="video">
+  <SegmentTemplate media="v_$Number%03d$.m4s" initialization="v_init.mp4" startNumber="1" timescale="1000" duration="4000"/>
+  <Representation id="v" bandwidth="1000"/>
+</AdaptationSet>`),
+			video: []string{"/dash/v_init.mp4", "/dash/v_001.m4s", "/dash/v_002.m4s", "/dash/v_003.m4s"},
+		},
+		{
+			name: "timeline with repeats",
+			manifest: dashManifest(4, `<AdaptationSet mimeType="video/mp4">
+  <SegmentTemplate media="$RepresentationID$/$Time$.m4s" initialization="$RepresentationID$/init.mp4" timescale="1000">
+    <SegmentTimeline><S t="0" d="1000" r="2"/><S d="500"/></SegmentTimeline>
+  </SegmentTemplate>
+  <Representation id="low" bandwidth="1000"/>
+  <Representation id="high" bandwidth="5000"/>
+</AdaptationSet>`),
+			video: []string{"/dash/high/init.mp4", "/dash/high/0.m4s", "/dash/high/1000.m4s", "/dash/high/2000.m4s", "/dash/high/3000.m4s"},
+		},
+		{
+			name: "timeline repeated until the next S",
+			manifest: dashManifest(5, `<AdaptationSet contentType="video">
+  <SegmentTemplate media="$Time$.m4s" timescale="1000">
+    <SegmentTimeline><S t="0" d="1000" r="-1"/><S t="3000" d="2000"/></SegmentTimeline>
+  </SegmentTemplate>
+  <Representation id="v" bandwidth="1000"/>
+</AdaptationSet>`),
+			video: []string{"/dash/0.m4s", "/dash/1000.m4s", "/dash/2000.m4s", "/dash/3000.m4s"},
+		},
+		{
+			name: "timeline repeated until the end with an offset",
+			manifest: dashManifest(6, `<AdaptationSet contentType="video">
+  <SegmentTemplate media="$Time$.m4s" timescale="1000" presentationTimeOffset="50000">
+    <SegmentTimeline><S t="50000" d="2000" r="-1"/></SegmentTimeline>
+  </SegmentTemplate>
+  <Representation id="v" bandwidth="1000"/>
+</AdaptationSet>`),
+			video: []string{"/dash/50000.m4s", "/dash/52000.m4s", "/dash/54000.m4s"},
+		},
+		{
+			name: "timeline repeated past the end",
+			manifest: dashManifest(2, `<AdaptationSet contentType="video">
+  <SegmentTemplate media="$Time$.m4s" timescale="1000">
+    <SegmentTimeline><S t="4000" d="1000" r="-1"/></SegmentTimeline>
+  </SegmentTemplate>
+  <Representation id="v" bandwidth="1000"/>
+</AdaptationSet>`),
+			video: []string{"/dash/4000.m4s"},
+		},
+		{
+			name: "segment list with ranges",
+			manifest: dashManifest(4, `<AdaptationSet contentType="video">
+  <Representation id="v" bandwidth="1000">
+    <BaseURL>media/</BaseURL>
+    <SegmentList>
+      <Initialization sourceURL="video.mp4" range="0-99"/>
+      <SegmentURL media="video.mp4" mediaRange="100-199"/>
+      <SegmentURL media="video.mp4" mediaRange="200-349"/>
+    </SegmentList>
+  </Representation>
+</AdaptationSet>`),
+			video: []string{"/dash/media/video.mp4@0+100", "/dash/media/video.mp4@100+100", "/dash/media/video.mp4@200+150"},
+		},
+		{
+			name: "base url of the video and the audio",
+			manifest: dashManifest(4, `<AdaptationSet contentType="video">
+  <Representation id="v" bandwidth="1000"><BaseURL>video.mp4</BaseURL><SegmentBase/></Representation>
+</AdaptationSet>
+<AdaptationSet contentType="audio">
+  <Representation id="a" bandwidth="128"><BaseURL>https://cdn.example.com/audio.mp4</BaseURL></Representation>
+</AdaptationSet>`),
+			video: []string{"/dash/video.mp4"},
+			audio: []string{"https://cdn.example.com/audio.mp4"},
+		},
+		{
+			name: "only audio",
+			manifest: dashManifest(4, `<AdaptationSet contentType="audio">
+  <Representation id="a" bandwidth="128"><BaseURL>audio.mp4</BaseURL></Representation>
+</AdaptationSet>`),
+			video: []string{"/dash/audio.mp4"},
+		},
+		{
+			name: "segment list without media segments",
+			manifest: dashManifest(4, `<AdaptationSet contentType="video">
+  <Representation id="v" bandwidth="1000">
+    <SegmentList><Initialization sourceURL="init.mp4"/></SegmentList>
+  </Representation>
+</AdaptationSet>`),
+			err: "without media segments",
+		},
+		{
+			name: "template without duration",
+			manifest: dashManifest(4, `<AdaptationSet contentType="video">
+  <SegmentTemplate media="$Number$.m4s"/>
+  <Representation id="v" bandwidth="1000"/>
+</AdaptationSet>`),
+			err: "without duration or timeline",
+		},
+		{
+			name:     "live manifest",
+			manifest: `<MPD type="dynamic"><Period/></MPD>`,
+			err:      "live",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.manifest))
+			}))
+			defer server.Close()
+			video, audio, err := getDashSegments(server.URL + "/dash/manifest.mpd")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := segmentNames(server.URL, video); !reflect.DeepEqual(got, tt.video) {
+				t.Errorf("video %v, want %v", got, tt.video)
+			}
+			if got := segmentNames(server.URL, audio); len(got) > 0 || len(tt.audio) > 0 {
+				if !reflect.DeepEqual(got, tt.audio) {
+					t.Errorf("audio %v, want %v", got, tt.audio)
+				}
+			}
+		})
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		duration string
+		want     float64
+		err      bool
+	}{
+		{duration: "PT1H2M3.5S", want: 3723.5},
+		{duration: "PT10S", want: 10},
+		{duration: "P1DT1S", want: 86401},
+		{duration: "PT", err: true},
+		{duration: "10S", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseDuration(tt.duration)
+		if (err != nil) != tt.err || (!tt.err && got != tt.want) {
+			t.Errorf("%q is %v %v, want %v", tt.duration, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package saovivo
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+type Destination struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Platform string `json:"platform,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Url      string `json:"url"`
+	Enabled  bool   `json:"enabled"`
+	Profile  string `json:"profile,omitempty"` // Re-encodes the stream of the channel
+}
+
+// Platform is a well known streaming service, the stream key given by the
+// service is appended to its ingest url.
+type Platform struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Url  string `json:"url"`
+}
+
+var Platforms = []Platform{
+	{Id: "youtube", Name: "YouTube", Url: "rtmp://a.rtmp.youtube.com/live2/"},
+	{Id: "facebook", Name: "Facebook", Url: "rtmps://live-api-s.facebook.com:443/rtmp/"},
+	{Id: "twitch", Name: "Twitch", Url: "rtmp://live.twitch.tv/app/"},
+	{Id: "custom", Name: "Personalizado", Url: ""},
+}
+
+func NewDestination(name string, url string) *Destination {
+	return &Destination{Id: uuid.New().String(), Name: name, Url: url, Enabled: true}
+}
+
+func GetPlatform(id string) *Platform {
+	for i := range Platforms {
+		if Platforms[i].Id == id {
+			return &Platforms[i]
+		}
+	}
+	return nil
+}
+
+// PlatformURL builds the output url for a platform and a stream key, the
+// custom platform takes the key as the whole url.
+func PlatformURL(platform string, key string) (string, error) {
+	p := GetPlatform(platform)
+	if p == nil {
+		return "", fmt.Errorf("unknown platform %s", platform)
+	}
+	if key == "" {
+		return "", fmt.Errorf("empty stream key")
+	}
+	uri := p.Url + key
+	return uri, ValidateOutputURL(uri)
+}
+
+func ValidateOutputURL(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "rtmp", "rtmps", "srt", "udp":
+	default:
+		return fmt.Errorf("unsupported output scheme %q, must be rtmp, rtmps, srt or udp", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("output url without host")
+	}
+	return nil
+}
+
+// outputPreset returns the preset with the muxer expected by the protocol,
+// flv for rtmp and mpegts for srt and udp. The stream is copied unless a
+// profile is given.
+func outputPreset(uri string, profile *Profile) Preset {
+	ts := false
+	if u, err := url.Parse(uri); err == nil {
+		switch strings.ToLower(u.Scheme) {
+		case "srt", "udp":
+			ts = true
+		}
+	}
+	if profile == nil {
+		if ts {
+			return CopyTsPreset
+		}
+		return CopyPreset
+	}
+	config := profile.config()
+	if ts {
+		config = append(config, "-f", "mpegts")
+	} else {
+		config = append(config, "-f", "flv", "-flvflags", "no_duration_filesize")
+	}
+	return Preset{flags: []string{}, config: config}
+}
+
+// validOutputCodec tells if the video encoded with the profile can be sent to
+// the url, hevc does not fit in flv.
+func validOutputCodec(uri string, profile Profile) error {
+	if !profile.hevc() {
+		return nil
+	}
+	if u, err := url.Parse(uri); err == nil {
+		switch strings.ToLower(u.Scheme) {
+		case "srt", "udp":
+			return nil
+		}
+	}
+	return fmt.Errorf("profile %s uses hevc, it can only be sent over srt or udp", profile.Name)
+}
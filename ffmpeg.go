@@ -14,46 +14,59 @@ type Preset struct {
 }
 
 func (p *Preset) Command(input string, output string) []string {
-	preset := append(p.flags, "-i", input)
+	preset := append([]string{}, p.flags...)
+	preset = append(preset, "-i", input)
 	preset = append(preset, p.config...)
 	return append(preset, output)
 }
 
-var (
-	SavePreset = Preset{flags: []string{ /*"-v", "quiet", "-stats"*/ }, config: []string{
-		"-err_detect", "ignore_err",
-		"-vcodec",
-		"libx264",
-		"-preset",
-		"fast",
-		"-r",
-		"30",
-		"-bf",
-		"0",
-		"-g",
-		"60",
-		"-vb",
-		"1500k",
-		"-vprofile",
-		"baseline",
-		"-level",
-		"3.0",
-		"-pix_fmt", "yuv420p",
-		"-acodec",
-		"aac",
-		"-ab",
-		"128k",
-		"-ar",
-		"44100",
-		"-ac",
-		"2",
+// withOutputOptions returns a copy of the preset with more output options.
+func (p Preset) withOutputOptions(options ...string) Preset {
+	config := append([]string{}, p.config...)
+	return Preset{flags: p.flags, config: append(config, options...)}
+}
+
+// savePreset transcodes a video with the profile, the result is written to
+// the file and sent to the channel at the same time. An audio is shown over
+// the slate, empty for a video.
+func savePreset(p Profile, slate string) Preset {
+	inputs, maps := sourceOptions(p, slate)
+	config := append(inputs, "-err_detect", "ignore_err")
+	config = append(config, p.config()...)
+	config = append(config,
 		"-ignore_unknown",
 		"-strict",
 		"experimental",
-		"-f", "tee", "-map", "0:v", "-map", "0:a?",
+		"-f", "tee",
+	)
+	config = append(config, maps...)
+	return Preset{flags: []string{ /*"-v", "quiet", "-stats"*/ }, config: config}
+}
+
+// storePreset transcodes a video with the profile to a file only.
+func storePreset(p Profile, slate string) Preset {
+	inputs, maps := sourceOptions(p, slate)
+	config := append(inputs, "-err_detect", "ignore_err")
+	config = append(config, p.config()...)
+	config = append(config,
+		"-ignore_unknown",
+		"-strict",
+		"experimental",
+	)
+	config = append(config, maps...)
+	config = append(config, "-f", "mpegts")
+	return Preset{flags: []string{"-y"}, config: config}
+}
+
+var (
+	PacePreset = Preset{flags: []string{ /*"-v", "quiet", "-stats",*/ "-re"}, config: []string{
+		"-codec",
+		"copy",
+		"-f",
+		"mpegts",
 	}}
 
-	CopyPreset = Preset{flags: []string{ /*"-v", "quiet", "-stats",*/ "-re"}, config: []string{
+	CopyPreset = Preset{flags: []string{ /*"-v", "quiet", "-stats",*/ }, config: []string{
 		"-vcodec",
 		"copy",
 		"-acodec",
@@ -64,6 +77,13 @@ var (
 		"no_duration_filesize",
 	}}
 
+	CopyTsPreset = Preset{flags: []string{ /*"-v", "quiet", "-stats",*/ }, config: []string{
+		"-codec",
+		"copy",
+		"-f",
+		"mpegts",
+	}}
+
 	FastStart = Preset{flags: []string{"-y", "-v", "quiet"}, config: []string{
 		"-codec",
 		"copy",
@@ -72,52 +92,13 @@ var (
 	}}
 )
 
-/*
-	rtmp []string = []string{
-		"-re",
-		"-i",
-		"",
-
-		"-i",
-		"logo.png",
-		"-vcodec",
-		"libx264",
-		"-preset",
-		"ultrafast",
-		"-bf",
-		"0",
-		"-g",
-		"60",
-		"-vb",
-		"1500k",
-		"-vprofile",
-		"baseline",
-		"-level",
-		"3.0",
-		"-acodec",
-		"aac",
-		"-ab",
-		"96000",
-		"-ar",
-		"48000",
-		"-ac",
-		"2",
-		"-strict",
-		"experimental",
-		"-filter_complex",
-		"overlay='x=main_w-overlay_w-(main_w*0.01):y=main_h*0.01'",
-		"-f",
-		"flv",
-		"-flvflags",
-		"no_duration_filesize",
-	}
-*/
-
 type FFMPEG struct {
-	cmd     *exec.Cmd
-	err     chan error
-	running bool
-	lock    *sync.Mutex
+	cmd      *exec.Cmd
+	err      chan error
+	running  bool
+	progress chan Progress
+	last     Progress
+	lock     *sync.Mutex
 }
 
 var ffmpeg_exec string
@@ -151,6 +132,48 @@ func FFMPEGStream(input string, output string, preset Preset) *FFMPEG {
 	return &ffmpeg
 }
 
+// Progress makes ffmpeg report its progress, it must be called before Run.
+// The channel keeps only the last report and it is closed when ffmpeg ends.
+func (f *FFMPEG) Progress() <-chan Progress {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.progress != nil {
+		return f.progress
+	}
+	f.progress = make(chan Progress, 1)
+	f.cmd.Args = append([]string{f.cmd.Args[0], "-progress", "pipe:1", "-nostats"}, f.cmd.Args[1:]...)
+	f.cmd.Stdout = &progressParser{report: f.report}
+	return f.progress
+}
+
+func (f *FFMPEG) report(p Progress) {
+	f.lock.Lock()
+	f.last = p
+	f.lock.Unlock()
+	// Only written from here, the stale report is replaced
+	select {
+	case <-f.progress:
+	default:
+	}
+	f.progress <- p
+}
+
+// LastProgress returns the last report of ffmpeg, empty when Progress was
+// not called.
+func (f *FFMPEG) LastProgress() Progress {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.last
+}
+
+func (f *FFMPEG) closeProgress() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.progress != nil {
+		close(f.progress)
+	}
+}
+
 func (f *FFMPEG) IsRunning() bool {
 	f.lock.Lock()
 	defer f.lock.Unlock()
@@ -165,6 +188,7 @@ func (f *FFMPEG) RunAndWait() error {
 	f.lock.Lock()
 	f.running = false
 	f.lock.Unlock()
+	f.closeProgress()
 	return err
 }
 
@@ -172,17 +196,22 @@ func (f *FFMPEG) Run() {
 	f.lock.Lock()
 	f.running = true
 	f.lock.Unlock()
+	// Started here so Stop can kill the process as soon as Run returns
+	err := f.cmd.Start()
 	go func() {
-		err := f.cmd.Run()
+		if err == nil {
+			err = f.cmd.Wait()
+		}
 		f.lock.Lock()
 		f.running = false
 		f.lock.Unlock()
+		f.closeProgress()
 		f.err <- err
 	}()
 }
 
 func (f *FFMPEG) StopAndWait() error {
-	f.cmd.Process.Kill()
+	f.Stop()
 	return <-f.err
 }
 
@@ -191,5 +220,7 @@ func (f *FFMPEG) Wait() error {
 }
 
 func (f *FFMPEG) Stop() {
-	f.cmd.Process.Kill()
+	if f.cmd.Process != nil {
+		f.cmd.Process.Kill()
+	}
 }
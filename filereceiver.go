@@ -3,27 +3,94 @@ package saovivo
 import (
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
-	"streaminfo"
-	"strings"
+	"sort"
+	"sync"
 
+	"github.com/google/uuid"
 	"github.com/kkdai/youtube"
 )
 
 type FileReceiver struct {
 	localpath string
+	partial   string                  // Parts of the uploads sent in chunks
+	uploads   map[string]*IngestState // By file name, while it is processed
+	resumable map[string]*Upload      // By id, until the last chunk arrives
+	busy      map[string]bool         // Uploads receiving a chunk
+	jobs      map[string]*Job         // By id
+	queue     *JobQueue
+	hub       *ProgressHub
+	lock      *sync.Mutex
+
+	// Done is called when the processing of an uploaded file ends, ready
+	// with its asset or failed with the reason.
+	Done func(Job)
 }
 
-func validExtension(filename string) bool {
-	return strings.HasSuffix(filename, ".mp4")
+// UploadState is the processing of an uploaded file.
+type UploadState struct {
+	Name string `json:"name"`
+	IngestState
 }
 
+// Status returns the uploaded files that are still processed.
+func (f *FileReceiver) Status() []UploadState {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	uploads := []UploadState{}
+	for name, s := range f.uploads {
+		uploads = append(uploads, UploadState{Name: name, IngestState: *s})
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].Name < uploads[j].Name
+	})
+	return uploads
+}
+
+// report keeps the state of an upload until it is ready or failed, every
+// change is published.
+func (f *FileReceiver) report(name string, s IngestState) {
+	f.lock.Lock()
+	if s.State == "ready" || s.State == "failed" {
+		delete(f.uploads, name)
+	} else {
+		f.uploads[name] = &s
+	}
+	f.lock.Unlock()
+	f.hub.publish(ProgressEvent{Kind: "upload", Id: name, IngestState: s})
+}
+
+// fastStart moves the index of the file to the beginning, the progress is
+// reported out of the duration of the video.
+func fastStart(src string, dst string, duration float64, report func(IngestState)) error {
+	ffmpeg := FFMPEGStream(src, dst, FastStart)
+	progress := ffmpeg.Progress()
+	followed := make(chan bool)
+	go func() {
+		for pr := range progress {
+			pr := pr
+			report(IngestState{State: "transcoding", Progress: transcoded(pr, duration), Ffmpeg: &pr})
+		}
+		close(followed)
+	}()
+	err := ffmpeg.RunAndWait()
+	<-followed
+	return err
+}
+
+// GetRemote returns the assets of a youtube video or playlist, or of a media
+// file, an HLS playlist or a DASH manifest over http(s) or in S3.
 func (f *FileReceiver) GetRemote(url string) ([]*Asset, error) {
 	var urls []string
 	if !isYoutubeDomain(url) {
-		return nil, fmt.Errorf("the video is not a youtube content")
+		a, err := probeRemote(url)
+		if err != nil {
+			return nil, err
+		}
+		return []*Asset{a}, nil
 	}
 	if playlist := isYoutubePlaylist(url); playlist != nil {
 		urls = getYoutubeUrlsFromPlaylist(playlist)
@@ -45,63 +112,99 @@ func (f *FileReceiver) GetRemote(url string) ([]*Asset, error) {
 	return assets, nil
 }
 
-func (f *FileReceiver) Recv(r *http.Request) ([]*Asset, error) {
+// remuxFormats are moved to the beginning of the file with FastStart, the
+// rest are kept as they were uploaded.
+var remuxFormats = "mov,mp4,m4a,3gp,3g2,mj2"
 
-	assets := []*Asset{}
+// receive copies an uploaded file next to the uploaded files, so it is moved
+// instead of copied once it is processed.
+func (f *FileReceiver) receive(fileHeader *multipart.FileHeader) (string, error) {
+	rFile, err := fileHeader.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rFile.Close()
+	lFile, err := os.CreateTemp(f.localpath, "*.upload"+filepath.Ext(fileHeader.Filename))
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(lFile, rFile)
+	lFile.Close()
+	if err != nil {
+		os.Remove(lFile.Name())
+		return "", err
+	}
+	return lFile.Name(), nil
+}
+
+// keep moves a received file to the uploaded files when ffprobe finds audio
+// or video in it, an audio is played over the slate.
+func (f *FileReceiver) keep(name string, path string, report func(IngestState)) (*Asset, error) {
+	info, err := Probe(path)
+	if err != nil {
+		return nil, fmt.Errorf("not an audio or video file")
+	}
+	if info.Video == nil && info.Audio == nil {
+		return nil, fmt.Errorf("no audio or video stream in %s", info.Format)
+	}
+	if info.Duration < 1 {
+		return nil, fmt.Errorf("shorter than a second, an image can not be played")
+	}
+
+	// Every upload gets its own file, a file uploaded again with the same name
+	// is a new video and not the one already in the library
+	localFilename := filepath.Join(f.localpath, uuid.New().String()[:8]+"-"+name)
+	if info.Format == remuxFormats && info.Video != nil {
+		err = fastStart(path, localFilename, info.Duration, report)
+	} else {
+		err = os.Rename(path, localFilename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	a := NewAsset(name, localFilename, fmt.Sprintf("%.2f", info.Duration))
+	a.AudioOnly = info.Video == nil
+	return a, nil
+}
+
+// Recv receives the uploaded files and returns the jobs that process them,
+// the files that can be played are handed to Done as they are ready.
+func (f *FileReceiver) Recv(r *http.Request) ([]Job, error) {
+	jobs := []Job{}
 
 	err := r.ParseMultipartForm((32 << 20))
 	if err != nil {
 		return nil, err
 	}
+	defer r.MultipartForm.RemoveAll()
 
 	files := r.MultipartForm.File["files"]
 	for _, fileHeader := range files {
-
-		rFile, err := fileHeader.Open()
+		name := filepath.Base(fileHeader.Filename)
+		path, err := f.receive(fileHeader)
 		if err != nil {
-			fmt.Println("Error: ", err)
-			continue
+			return jobs, fmt.Errorf("unable to receive %s: %v", name, err)
 		}
-
-		if !validExtension(fileHeader.Filename) {
-			fmt.Println("Error: invalid extension")
-			continue
-		}
-
-		lFile, err := os.CreateTemp("", "*.mp4")
-		if err != nil {
-			fmt.Println("Create Error: ", err)
-			continue
-		}
-		_, err = io.Copy(lFile, rFile)
-		if err != nil {
-			fmt.Println("Copy Error: ", err)
-			continue
-		}
-
-		lFile.Close()
-		rFile.Close()
-
-		info, err := streaminfo.ExtractStreamInfo(lFile.Name())
-		if err != nil {
-			fmt.Println("Error: Stream Info", err)
-			os.Remove(lFile.Name())
-			continue
-		}
-		if duration, ok := info.Video.Get("duration"); ok {
-			localFilename := filepath.Join(f.localpath, fileHeader.Filename)
-			ffmpeg := FFMPEGStream(lFile.Name(), localFilename, FastStart)
-			if err := ffmpeg.RunAndWait(); err == nil {
-				assets = append(assets, NewAsset(fileHeader.Filename, localFilename, duration.(string)))
-			} else {
-				fmt.Println("Error ffmpeg: ", err)
-			}
-		}
-		os.Remove(lFile.Name())
+		jobs = append(jobs, f.submit(name, path, ""))
 	}
-	return assets, nil
+	return jobs, nil
 }
 
-func NewFileReceiver(path string) *FileReceiver {
-	return &FileReceiver{localpath: path}
+// NewFileReceiver keeps the uploaded files in path, the uploads sent in
+// chunks are received in partial. The files are processed by queue and the
+// processing of each one is published to hub.
+func NewFileReceiver(path string, partial string, queue *JobQueue, hub *ProgressHub) *FileReceiver {
+	f := &FileReceiver{
+		localpath: path,
+		partial:   partial,
+		uploads:   make(map[string]*IngestState),
+		resumable: make(map[string]*Upload),
+		busy:      make(map[string]bool),
+		jobs:      make(map[string]*Job),
+		queue:     queue,
+		hub:       hub,
+		lock:      &sync.Mutex{},
+	}
+	f.restoreUploads()
+	return f
 }
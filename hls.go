@@ -2,77 +2,391 @@ package saovivo
 
 import (
 	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
-	"net/http"
+	"io"
 	"net/url"
-	"path/filepath"
-	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/grafov/m3u8"
 )
 
+// HlsConfig is how the variant of a master playlist is chosen, the one of
+// the highest bandwidth within the limits or the lowest when none fits. 0 is
+// no limit.
+type HlsConfig struct {
+	MaxBandwidth int64 // Bits per second
+	MaxHeight    int   // Of the resolution
+}
+
+// HLS is used by every HLS source, it is set once at start.
+var HLS = HlsConfig{}
+
 func addHlsBaseURI(originalUri string, uri string) string {
-	if !strings.HasPrefix(uri, "http") {
-		u, _ := url.Parse(originalUri)
-		u.RawQuery = ""
-		u.Path = filepath.Dir(u.Path)
-		uri = u.String() + "/" + uri
+	base, err := url.Parse(originalUri)
+	if err != nil {
+		return uri
 	}
-	return uri
+	ref, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	return base.ResolveReference(ref).String()
 }
 
-func getHlsStreamURI(uri string) (string, error) {
-	originalUri := uri
-	file, err := http.Get(uri)
+// readHlsPlaylist reads a master or a media playlist.
+func readHlsPlaylist(uri string) (m3u8.Playlist, m3u8.ListType, error) {
+	file, err := remoteClient.Get(uri)
 	if err != nil {
-		return "", err
+		return nil, 0, err
 	}
 	defer file.Body.Close()
-	p, t, e := m3u8.DecodeFrom(bufio.NewReader(file.Body), false)
-	if e != nil {
-		return "", err
+	if file.StatusCode != 200 {
+		return nil, 0, fmt.Errorf("the playlist answered %s", file.Status)
+	}
+	p, t, err := m3u8.DecodeFrom(bufio.NewReader(file.Body), false)
+	if err != nil {
+		return nil, 0, fmt.Errorf("wrong HLS playlist: %v", err)
 	}
+	return p, t, nil
+}
 
-	switch t {
-	case m3u8.MASTER:
-		master := p.(*m3u8.MasterPlaylist)
+// variantHeight returns the height of the resolution of a variant, 0 when
+// it is not given.
+func variantHeight(v *m3u8.Variant) int {
+	_, height, _ := strings.Cut(v.Resolution, "x")
+	h, _ := strconv.Atoi(height)
+	return h
+}
 
-		sort.Slice(master.Variants, func(i, j int) bool {
-			return master.Variants[i].Bandwidth > master.Variants[j].Bandwidth
-		})
+func (c HlsConfig) fits(v *m3u8.Variant) bool {
+	if c.MaxBandwidth > 0 && int64(v.Bandwidth) > c.MaxBandwidth {
+		return false
+	}
+	return c.MaxHeight <= 0 || variantHeight(v) <= c.MaxHeight
+}
 
-		uri = master.Variants[0].URI
+// variant chooses the variant ingested of a master playlist, the i-frame
+// playlists are never taken.
+func (c HlsConfig) variant(variants []*m3u8.Variant) *m3u8.Variant {
+	var best, lowest *m3u8.Variant
+	for _, v := range variants {
+		if v == nil || v.Iframe {
+			continue
+		}
+		if lowest == nil || v.Bandwidth < lowest.Bandwidth {
+			lowest = v
+		}
+		if !c.fits(v) {
+			continue
+		}
+		if best == nil || v.Bandwidth > best.Bandwidth || v.Bandwidth == best.Bandwidth && variantHeight(v) > variantHeight(best) {
+			best = v
+		}
+	}
+	if best == nil {
+		return lowest
+	}
+	return best
+}
 
-	case m3u8.MEDIA:
-		uri = uri
+// audioRendition returns the uri of the audio of a variant when it is apart,
+// the default rendition of its group first. Empty when the audio is in the
+// variant.
+func audioRendition(v *m3u8.Variant) string {
+	if v.Audio == "" {
+		return ""
 	}
+	var chosen *m3u8.Alternative
+	for _, alt := range v.Alternatives {
+		if alt == nil || alt.Type != "AUDIO" || alt.GroupId != v.Audio || alt.URI == "" {
+			continue
+		}
+		if chosen == nil || alt.Default && !chosen.Default || alt.Autoselect == "YES" && !chosen.Default && chosen.Autoselect != "YES" {
+			chosen = alt
+		}
+	}
+	if chosen == nil {
+		return ""
+	}
+	return chosen.URI
+}
 
-	return addHlsBaseURI(originalUri, uri), nil
+// getHlsStreams returns the media playlist of the video and the one of the
+// audio when it is apart, uri is itself the video when it is not a master
+// playlist.
+func getHlsStreams(uri string) (string, string, error) {
+	p, t, err := readHlsPlaylist(uri)
+	if err != nil {
+		return "", "", err
+	}
+	if t != m3u8.MASTER {
+		return uri, "", nil
+	}
+	v := HLS.variant(p.(*m3u8.MasterPlaylist).Variants)
+	if v == nil {
+		return "", "", fmt.Errorf("the HLS playlist has no variants")
+	}
+	audio := audioRendition(v)
+	if audio != "" {
+		audio = addHlsBaseURI(uri, audio)
+	}
+	return addHlsBaseURI(uri, v.URI), audio, nil
 }
 
-func getHlsSegmentsFromURI(uri string) ([]string, error) {
-	var segments []string
+// hlsReader lists the segments of a media playlist, the keys are read once
+// and the init section is sent again only when it changes.
+type hlsReader struct {
+	keys map[string][]byte
+	init string // Of the last segments listed
+}
 
-	file, err := http.Get(uri)
+func newHlsReader() *hlsReader {
+	return &hlsReader{keys: make(map[string][]byte)}
+}
+
+// key returns an AES-128 key of the playlist.
+func (h *hlsReader) key(uri string) ([]byte, error) {
+	if key, ok := h.keys[uri]; ok {
+		return key, nil
+	}
+	rsp, err := remoteClient.Get(uri)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Body.Close()
-	p, t, e := m3u8.DecodeFrom(bufio.NewReader(file.Body), false)
-	if e != nil {
+	defer rsp.Body.Close()
+	if rsp.StatusCode != 200 {
+		return nil, fmt.Errorf("the key of the HLS segments answered %s", rsp.Status)
+	}
+	key, err := io.ReadAll(io.LimitReader(rsp.Body, aes.BlockSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("the key of the HLS segments must have 16 bytes")
+	}
+	h.keys[uri] = key
+	return key, nil
+}
+
+// hlsIV returns the IV of a segment, the one of the key or its media
+// sequence number.
+func hlsIV(iv string, seq uint64) ([]byte, error) {
+	if iv == "" {
+		b := make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(b[8:], seq)
+		return b, nil
+	}
+	b, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X"))
+	if err != nil || len(b) != aes.BlockSize {
+		return nil, fmt.Errorf("wrong IV %q of the HLS segments", iv)
+	}
+	return b, nil
+}
+
+// decryptSegment decrypts an AES-128 segment in place and removes its
+// padding.
+func decryptSegment(data []byte, key []byte, iv []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("the encrypted segment is not a multiple of the block size")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
 		return nil, err
 	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, fmt.Errorf("wrong padding of the encrypted segment, the key may be wrong")
+	}
+	return data[:len(data)-pad], nil
+}
+
+// segments returns the segments of a media playlist from the sequence from
+// on, with the init section before them when it changes, and the sequence
+// that follows the last one.
+func (h *hlsReader) segments(uri string, media *m3u8.MediaPlaylist, from uint64) ([]segment, uint64, error) {
+	var (
+		segments []segment
+		key      *m3u8.Key
+		xmap     *m3u8.Map
+		prev     segment
+		next     = from
+	)
+	for i, s := range media.Segments {
+		if s == nil {
+			continue
+		}
+		seq := media.SeqNo + uint64(i)
+		// The key and the map apply until the next ones
+		if s.Key != nil {
+			key = s.Key
+		}
+		if s.Map != nil {
+			xmap = s.Map
+		}
+		sg := segment{uri: addHlsBaseURI(uri, s.URI), offset: s.Offset, length: s.Limit}
+		if sg.length > 0 && sg.offset == 0 && prev.length > 0 && prev.uri == sg.uri {
+			// A byte range without offset follows the previous one
+			sg.offset = prev.offset + prev.length
+		}
+		prev = sg
+		if seq < from {
+			continue
+		}
+
+		var err error
+		if key != nil && key.Method != "" && key.Method != "NONE" {
+			if key.Method != "AES-128" {
+				return nil, 0, fmt.Errorf("the HLS segments encrypted with %s can not be ingested", key.Method)
+			}
+			if sg.key, err = h.key(addHlsBaseURI(uri, key.URI)); err != nil {
+				return nil, 0, err
+			}
+			if sg.iv, err = hlsIV(key.IV, seq); err != nil {
+				return nil, 0, err
+			}
+		}
+		if xmap != nil {
+			init := segment{uri: addHlsBaseURI(uri, xmap.URI), offset: xmap.Offset, length: xmap.Limit}
+			id := fmt.Sprintf("%s@%d+%d", init.uri, init.offset, init.length)
+			if id != h.init {
+				// Encrypted as well only when the key gives its IV
+				if sg.key != nil && key.IV != "" {
+					init.key, init.iv = sg.key, sg.iv
+				}
+				segments = append(segments, init)
+				h.init = id
+			}
+		}
+		segments = append(segments, sg)
+		next = seq + 1
+	}
+	return segments, next, nil
+}
 
-	switch t {
-	case m3u8.MASTER:
+// mediaPlaylist reads a media playlist, a master playlist is an error.
+func mediaPlaylist(uri string) (*m3u8.MediaPlaylist, error) {
+	p, t, err := readHlsPlaylist(uri)
+	if err != nil {
+		return nil, err
+	}
+	if t != m3u8.MEDIA {
 		return nil, fmt.Errorf("Expected media file, master found")
-	case m3u8.MEDIA:
-		for _, s := range p.(*m3u8.MediaPlaylist).Segments {
+	}
+	return p.(*m3u8.MediaPlaylist), nil
+}
+
+// isHlsLive tells if the playlist still grows, a VOD playlist has an end.
+func isHlsLive(media *m3u8.MediaPlaylist) bool {
+	return !media.Closed && media.MediaType != m3u8.VOD
+}
+
+func getHlsMediaSegments(uri string) ([]segment, error) {
+	media, err := mediaPlaylist(uri)
+	if err != nil {
+		return nil, err
+	}
+	if isHlsLive(media) {
+		return nil, fmt.Errorf("the HLS playlist is live, add it as a live source")
+	}
+	segments, _, err := newHlsReader().segments(uri, media, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("the HLS playlist has no segments")
+	}
+	return segments, nil
+}
+
+// getHlsSegments returns the segments of the video of a VOD playlist and the
+// ones of its audio when it is apart.
+func getHlsSegments(uri string) ([]segment, []segment, error) {
+	video, audio, err := getHlsStreams(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	vsegments, err := getHlsMediaSegments(video)
+	if err != nil {
+		return nil, nil, err
+	}
+	if audio == "" {
+		return vsegments, nil, nil
+	}
+	asegments, err := getHlsMediaSegments(audio)
+	if err != nil {
+		return nil, nil, err
+	}
+	return vsegments, asegments, nil
+}
+
+// liveEdgeSegments is the number of segments taken from a live playlist when
+// it is read for the first time.
+const liveEdgeSegments = 3
+
+// copyHlsLive polls a live media playlist and writes its new segments to dst,
+// until stop is closed or the playlist ends. An audio rendition apart from
+// the video is not read.
+func copyHlsLive(dst io.Writer, uri string, stop <-chan struct{}) error {
+	uri, audio, err := getHlsStreams(uri)
+	if err != nil {
+		return err
+	}
+	if audio != "" {
+		lerr.Printf("copyHlsLive: the audio of %s is apart and it is not played", uri)
+	}
+	var (
+		next   uint64
+		first  = true
+		reader = newHlsReader()
+	)
+	for {
+		media, err := mediaPlaylist(uri)
+		if err != nil {
+			return err
+		}
+		count := 0
+		for _, s := range media.Segments {
 			if s != nil {
-				segments = append(segments, addHlsBaseURI(uri, s.URI))
+				count++
 			}
 		}
+		if first && count > liveEdgeSegments && isHlsLive(media) {
+			next = media.SeqNo + uint64(count-liveEdgeSegments)
+		}
+		first = false
+		segments, last, err := reader.segments(uri, media, next)
+		if err != nil {
+			return err
+		}
+		for _, s := range segments {
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+			if err := writeSegment(dst, s, false); err != nil {
+				return err
+			}
+		}
+		next = last
+		if media.Closed {
+			return nil
+		}
+		wait := time.Duration(media.TargetDuration * float64(time.Second) / 2)
+		if wait <= 0 {
+			wait = time.Second
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(wait):
+		}
 	}
-	return segments, nil
 }
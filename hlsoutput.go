@@ -0,0 +1,74 @@
+package saovivo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// HlsDestination is the id of the output that publishes the channel as HLS,
+// it is reported with the rest of the destinations.
+const HlsDestination = "hls"
+
+// HlsPlaylist is the media playlist written in the directory of the output.
+const HlsPlaylist = "index.m3u8"
+
+// HlsOutput publishes the channel as HLS in a directory, a rolling playlist
+// with the last segments. The segments are cut at the keyframes of the
+// profile of the channel, they can not be shorter.
+type HlsOutput struct {
+	Dir        string
+	Segment    float64 // Seconds of every segment, 4 when 0
+	Window     int     // Segments in the playlist, 6 when 0
+	LowLatency bool    // fMP4 segments as short as the keyframes allow
+}
+
+// hlsPreset copies the stream of the channel to the segments, the numbers
+// start at the time of the start so a restart does not repeat them.
+func (o HlsOutput) hlsPreset(profile Profile) Preset {
+	segment, window := o.Segment, o.Window
+	if segment <= 0 {
+		segment = 4
+	}
+	if window <= 0 {
+		window = 6
+	}
+	config := []string{"-c", "copy"}
+	name := "seg%d.ts"
+	if o.LowLatency {
+		if profile.Keyframe > 0 {
+			segment = profile.Keyframe
+		}
+		if o.Window <= 0 {
+			window = 4
+		}
+		name = "seg%d.m4s"
+		if profile.hevc() {
+			config = append(config, "-tag:v", "hvc1")
+		}
+		config = append(config, "-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", "init.mp4")
+	}
+	return Preset{flags: []string{"-y"}, config: append(config,
+		"-f", "hls",
+		"-hls_time", fmt.Sprintf("%.3f", segment),
+		"-hls_list_size", fmt.Sprint(window),
+		"-hls_flags", "delete_segments+temp_file+independent_segments+program_date_time",
+		"-hls_start_number_source", "epoch",
+		"-hls_segment_filename", filepath.Join(o.Dir, name),
+	)}
+}
+
+// NewHlsOutput starts writing the HLS of the channel, the segments of a
+// previous run are removed.
+func NewHlsOutput(o HlsOutput, profile Profile) (*RtmpOutput, error) {
+	if o.Dir == "" {
+		return nil, fmt.Errorf("hls output without directory")
+	}
+	if err := os.RemoveAll(o.Dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(o.Dir, 0755); err != nil {
+		return nil, err
+	}
+	return newOutput(filepath.Join(o.Dir, HlsPlaylist), o.hlsPreset(profile))
+}
@@ -1,6 +1,7 @@
 package saovivo
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"net"
@@ -10,18 +11,21 @@ import (
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/kkdai/youtube"
 )
 
 type VideoIngest struct {
-	dst string
-	uri []string
+	dst   string
+	uri   []segment
+	audio []segment // Of a DASH or HLS source with the audio apart, empty otherwise
 
 	preset      Preset
 	localfile   bool
 	contentType string // http content type
-	multipart   bool   // Is an m3u8 file
+	multipart   bool   // Is an m3u8 file or a DASH manifest
 	ffmpeg      *FFMPEG
+	progress    chan Progress
 
 	Output chan error
 
@@ -36,6 +40,25 @@ func (v *VideoIngest) Dst() string {
 	return v.dst
 }
 
+// Progress returns the reports of the transcode, only the last one is kept.
+// The channel is closed when the ingest ends.
+func (v *VideoIngest) Progress() <-chan Progress {
+	return v.progress
+}
+
+// forwardProgress passes the reports of src to dst, replacing the one that
+// was not read, and closes dst when src is closed.
+func forwardProgress(src <-chan Progress, dst chan Progress) {
+	for p := range src {
+		select {
+		case <-dst:
+		default:
+		}
+		dst <- p
+	}
+	close(dst)
+}
+
 func isYoutubePlaylist(uri string) *youtube.Playlist {
 	if isYoutubeDomain(uri) {
 		client := youtube.Client{}
@@ -63,12 +86,15 @@ func isYoutubeDomain(uri string) bool {
 		return false
 	}
 	hparts := strings.Split(url.Hostname(), ".")
+	if len(hparts) < 2 {
+		return false
+	}
 	domain := hparts[len(hparts)-2] + "." + hparts[len(hparts)-1]
 	return domain == "youtube.com" || domain == "youtu.be"
 }
 
 func getContentType(uri string) (string, error) {
-	client := &http.Client{}
+	client := remoteClient
 
 	req, err := http.NewRequest("HEAD", uri, nil)
 	if err != nil {
@@ -94,7 +120,7 @@ func sendToWriter(dst io.Writer, uri string, localfile bool) error {
 				return e
 			}
 		} else {
-			client := &http.Client{}
+			client := remoteClient
 			if _, e := url.ParseRequestURI(uri); e != nil {
 				return e
 			}
@@ -126,10 +152,140 @@ func sendToWriter(dst io.Writer, uri string, localfile bool) error {
 	return nil
 }
 
+// segment is a part of a source, only the length bytes from offset of uri
+// when length is not 0.
+type segment struct {
+	uri    string
+	offset int64
+	length int64
+	key    []byte // AES-128 of an encrypted HLS segment
+	iv     []byte
+}
+
+// writeSegment sends a segment to dst, a byte range is read with a single
+// request and an encrypted segment is decrypted whole.
+func writeSegment(dst io.Writer, s segment, localfile bool) error {
+	if s.key != nil {
+		var data bytes.Buffer
+		encrypted := s
+		encrypted.key = nil
+		if err := writeSegment(&data, encrypted, localfile); err != nil {
+			return err
+		}
+		clear, err := decryptSegment(data.Bytes(), s.key, s.iv)
+		if err != nil {
+			return err
+		}
+		_, err = dst.Write(clear)
+		return err
+	}
+	if s.length == 0 {
+		return sendToWriter(dst, s.uri, localfile)
+	}
+	if localfile {
+		file, err := os.Open(s.uri)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if _, err := file.Seek(s.offset, io.SeekStart); err != nil {
+			return err
+		}
+		_, err = io.CopyN(dst, file, s.length)
+		return err
+	}
+	request, err := http.NewRequest("GET", s.uri, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", s.offset, s.offset+s.length-1))
+	rsp, err := remoteClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("%s does not answer the byte range: %s", s.uri, rsp.Status)
+	}
+	_, err = io.CopyN(dst, rsp.Body, s.length)
+	return err
+}
+
+// sendSegments writes the segments one after the other, wrap can replace
+// the writer of each one.
+func (v *VideoIngest) sendSegments(dst io.Writer, segments []segment, wrap func(segment, io.Writer) io.Writer) error {
+	for _, s := range segments {
+		if err := writeSegment(wrap(s, dst), s, v.localfile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendSource writes the whole source to dst, the video and the audio sent
+// apart by a DASH source are muxed to mpegts on the way.
+func (v *VideoIngest) sendSource(dst io.Writer, wrap func(segment, io.Writer) io.Writer) error {
+	if len(v.audio) == 0 {
+		return v.sendSegments(dst, v.uri, wrap)
+	}
+	return v.muxTracks(dst, wrap)
+}
+
+// muxTracks joins the video and the audio segments without transcoding, each
+// track is an input of ffmpeg.
+func (v *VideoIngest) muxTracks(dst io.Writer, wrap func(segment, io.Writer) io.Writer) error {
+	vsrv, vtcp, err := listenLocal()
+	if err != nil {
+		return err
+	}
+	defer vsrv.Close()
+	asrv, atcp, err := listenLocal()
+	if err != nil {
+		return err
+	}
+	defer asrv.Close()
+
+	mux := FFMPEGStream(vtcp, "pipe:1", Preset{flags: []string{"-v", "error"}, config: []string{
+		"-i", atcp,
+		"-map", "0:v",
+		"-map", "1:a",
+		"-c", "copy",
+		"-f", "mpegts",
+	}})
+	mux.cmd.Stdout = dst
+	mux.Run()
+
+	errs := make(chan error, 2)
+	send := func(srv *net.TCPListener, segments []segment) {
+		conn, err := srv.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		err = v.sendSegments(conn, segments, wrap)
+		conn.Close()
+		errs <- err
+	}
+	go send(vsrv, v.uri)
+	go send(asrv, v.audio)
+
+	err = nil
+	for i := 0; i < 2; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+			mux.Stop()
+		}
+	}
+	if e := mux.Wait(); err == nil {
+		err = e
+	}
+	return err
+}
+
 func (v *VideoIngest) verifySource(uri string) error {
 	var format *youtube.Format
 	formatList := []string{"medium", "large", "720p"}
-	if strings.HasPrefix(uri, "http") {
+	if isRemote(uri) {
 		v.localfile = false
 		if isYoutubeDomain(uri) {
 			client := youtube.Client{}
@@ -156,37 +312,41 @@ func (v *VideoIngest) verifySource(uri string) error {
 			uri = stream
 		}
 
-		if contentType, err := getContentType(uri); err != nil {
+		uri, err := resolveRemote(uri)
+		if err != nil {
 			return err
-		} else {
-			v.contentType = contentType
 		}
+		var kind string
+		kind, v.contentType = remoteKind(uri)
 
-		switch v.contentType {
-		case "application/x-mpegURL":
-		case "application/vnd.apple.mpegurl":
+		switch kind {
+		case sourceDash:
 			v.multipart = true
-			uri, err := getHlsStreamURI(uri)
+			v.uri, v.audio, err = getDashSegments(uri)
 			if err != nil {
 				return err
 			}
-
-			v.uri, err = getHlsSegmentsFromURI(uri)
+		case sourceHls:
+			v.multipart = true
+			v.uri, v.audio, err = getHlsSegments(uri)
 			if err != nil {
 				return err
 			}
 		default:
 			v.multipart = false
-			v.uri = []string{uri}
+			v.uri = []segment{{uri: uri}}
 		}
 	} else {
 		v.localfile = true
-		v.uri = []string{uri}
+		v.uri = []segment{{uri: uri}}
 	}
 	return nil
 }
 
-func NewVideoIngest(uri string, dst string) (*VideoIngest, error) {
+// NewVideoIngest transcodes the video with the profile, it is kept in dst
+// while it is sent to the channel. slate is the image shown when the source
+// only has audio, empty for a video.
+func NewVideoIngest(uri string, dst string, profile Profile, slate string) (*VideoIngest, error) {
 	var ingest VideoIngest
 
 	if err := ingest.verifySource(uri); err != nil {
@@ -195,7 +355,8 @@ func NewVideoIngest(uri string, dst string) (*VideoIngest, error) {
 
 	ingest.dst = dst
 	ingest.Output = make(chan error)
-	ingest.preset = SavePreset
+	ingest.progress = make(chan Progress, 1)
+	ingest.preset = savePreset(profile, slate)
 
 	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
 	out, err := net.ListenTCP("tcp4", addr)
@@ -210,12 +371,15 @@ func NewVideoIngest(uri string, dst string) (*VideoIngest, error) {
 			dst io.WriteCloser
 			err error
 			tcp string
+			// Unique, the same video can be ingested by several channels
+			part = ingest.dst + "." + uuid.New().String()[:8] + ".part"
 		)
 
 		// Crear encoder
 		addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
 		srv, err = net.ListenTCP("tcp4", addr)
 		if err != nil {
+			close(ingest.progress)
 			ingest.Output <- err
 			goto end_loop
 		}
@@ -223,7 +387,10 @@ func NewVideoIngest(uri string, dst string) (*VideoIngest, error) {
 		srv.SetDeadline(time.Now().Add(10 * time.Second))
 		tcp = "tcp://" + srv.Addr().String()
 		lout.Printf("VideoIngest: Start, listen on: %s, sending to: %s and %s", tcp, "tcp://"+out.Addr().String(), ingest.dst)
-		ingest.ffmpeg = FFMPEGStream(tcp, "'[f=mpegts]"+ingest.dst+"'|[f=mpegts]"+"tcp://"+out.Addr().String(), ingest.preset)
+		// The transcode is written to a partial file and renamed when it ends,
+		// so an interrupted ingest is never taken as a finished asset.
+		ingest.ffmpeg = FFMPEGStream(tcp, "'[f=mpegts]"+part+"'|[f=mpegts]"+"tcp://"+out.Addr().String(), ingest.preset)
+		go forwardProgress(ingest.ffmpeg.Progress(), ingest.progress)
 		ingest.ffmpeg.Run()
 
 		dst, err = srv.Accept()
@@ -236,22 +403,22 @@ func NewVideoIngest(uri string, dst string) (*VideoIngest, error) {
 			goto end_loop
 		}
 
-		for _, uri := range ingest.uri {
-			lout.Printf("VideoIngest: process uri: %s", uri)
-			err = sendToWriter(dst, uri, ingest.localfile)
-			lout.Printf("Send to Writer finish: %v", err)
-			if err != nil {
-				lerr.Printf("VideoIngest: process with error: %v", err)
+		err = ingest.sendSource(dst, func(s segment, w io.Writer) io.Writer {
+			lout.Printf("VideoIngest: process uri: %s", s.uri)
+			return w
+		})
+		lout.Printf("Send to Writer finish: %v", err)
+		if err != nil {
+			lerr.Printf("VideoIngest: process with error: %v", err)
 
-				if ingest.ffmpeg.IsRunning() {
-					ingest.ffmpeg.StopAndWait()
-				} else {
-					ingest.ffmpeg.Wait()
-				}
-				ingest.Output <- err
-				os.Remove(ingest.dst)
-				goto end_loop
+			if ingest.ffmpeg.IsRunning() {
+				ingest.ffmpeg.StopAndWait()
+			} else {
+				ingest.ffmpeg.Wait()
 			}
+			ingest.Output <- err
+			os.Remove(part)
+			goto end_loop
 		}
 		dst.Close()
 		srv.Close()
@@ -259,6 +426,9 @@ func NewVideoIngest(uri string, dst string) (*VideoIngest, error) {
 		err = <-ingest.ffmpeg.err
 		if err != nil {
 			out.Close()
+			os.Remove(part)
+		} else {
+			err = os.Rename(part, ingest.dst)
 		}
 		ingest.Output <- err
 	end_loop:
@@ -0,0 +1,182 @@
+package saovivo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// jobKeep is how long a finished job can still be queried
+var jobKeep = time.Hour
+
+// queuedJobs is how many uploaded files can wait for a worker
+const queuedJobs = 1024
+
+// Job is the processing of an uploaded file, the upload returns at once and
+// the file is probed and kept by a worker of the JobQueue.
+type Job struct {
+	Id   string `json:"id"`
+	Name string `json:"name"` // Of the file
+	IngestState
+	Asset    *Asset    `json:"asset,omitempty"` // When it is ready
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+	path     string    // Received file
+	checksum string    // sha256 of the whole file in hex, empty when not given
+}
+
+// JobQueue processes the uploaded files of every channel, no more than its
+// workers at the same time.
+type JobQueue struct {
+	jobs chan func()
+}
+
+func NewJobQueue(workers int) *JobQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	q := &JobQueue{jobs: make(chan func(), queuedJobs)}
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+func (q *JobQueue) worker() {
+	for run := range q.jobs {
+		run()
+	}
+}
+
+// add queues run, false when too many jobs are waiting.
+func (q *JobQueue) add(run func()) bool {
+	select {
+	case q.jobs <- run:
+		return true
+	default:
+		return false
+	}
+}
+
+// submit queues the processing of a received file, the file belongs to the
+// job from now on.
+func (f *FileReceiver) submit(name string, path string, checksum string) Job {
+	job := &Job{Id: uuid.New().String(), Name: name, IngestState: IngestState{State: "pending"}, Created: time.Now(), Updated: time.Now(), path: path, checksum: checksum}
+	f.lock.Lock()
+	f.pruneJobs()
+	f.jobs[job.Id] = job
+	f.lock.Unlock()
+	f.report(name, job.IngestState)
+	if !f.queue.add(func() { f.process(job.Id) }) {
+		os.Remove(path)
+		f.finish(job.Id, nil, fmt.Errorf("too many files waiting to be processed"))
+	}
+	done, _ := f.Job(job.Id)
+	return done
+}
+
+// process verifies and keeps the file of a job.
+func (f *FileReceiver) process(id string) {
+	f.lock.Lock()
+	job := *f.jobs[id]
+	f.lock.Unlock()
+	defer os.Remove(job.path)
+
+	report := func(s IngestState) {
+		f.lock.Lock()
+		f.jobs[id].IngestState = s
+		f.jobs[id].Updated = time.Now()
+		f.lock.Unlock()
+		f.report(job.Name, s)
+	}
+	var a *Asset
+	err := verifyChecksum(job.path, job.checksum)
+	if err == nil {
+		a, err = f.keep(job.Name, job.path, report)
+	}
+	f.finish(id, a, err)
+}
+
+// finish ends a job and hands it to Done.
+func (f *FileReceiver) finish(id string, a *Asset, err error) {
+	f.lock.Lock()
+	job := f.jobs[id]
+	job.Updated = time.Now()
+	job.Asset = a
+	if err != nil {
+		lerr.Printf("FileReceiver: %s rejected: %v", job.Name, err)
+		job.IngestState = IngestState{State: "failed", Error: err.Error()}
+	} else {
+		job.IngestState = IngestState{State: "ready", Progress: 1}
+	}
+	done := *job
+	f.lock.Unlock()
+	f.report(done.Name, done.IngestState)
+	if f.Done != nil {
+		f.Done(done)
+	}
+}
+
+// verifyChecksum compares the sha256 of a file with the one in hex given by
+// the client, an empty checksum is not verified.
+func verifyChecksum(path string, checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, file); err != nil {
+		return err
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != checksum {
+		return fmt.Errorf("the checksum of the file does not match, it must be uploaded again")
+	}
+	return nil
+}
+
+// pruneJobs forgets the jobs finished long ago, must be called with the lock
+// held.
+func (f *FileReceiver) pruneJobs() {
+	for id, job := range f.jobs {
+		if (job.State == "ready" || job.State == "failed") && time.Since(job.Updated) > jobKeep {
+			delete(f.jobs, id)
+		}
+	}
+}
+
+// Job returns a job in process or finished in the last hour.
+func (f *FileReceiver) Job(id string) (Job, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	job, ok := f.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Jobs returns the jobs in process and the ones finished in the last hour,
+// the oldest first.
+func (f *FileReceiver) Jobs() []Job {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.pruneJobs()
+	jobs := []Job{}
+	for _, job := range f.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Created.Before(jobs[j].Created)
+	})
+	return jobs
+}
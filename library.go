@@ -0,0 +1,283 @@
+package saovivo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// LibraryItem is a video cataloged once and played by any playlist of any
+// channel, all of them share the same transcode.
+type LibraryItem struct {
+	Id        string     `json:"id"`
+	Name      string     `json:"name"`
+	Source    string     `json:"source"` // Remote url or uploaded file
+	Duration  string     `json:"duration"`
+	Size      int64      `json:"size"` // Bytes of the source, 0 when unknown
+	Media     *MediaInfo `json:"media,omitempty"`
+	AudioOnly bool       `json:"audioOnly,omitempty"` // Played over the slate
+	State     string     `json:"state"`               // pending or ready
+	Tags      []string   `json:"tags"`
+	Added     time.Time  `json:"added"`
+	Local     string     `json:"local"`
+}
+
+// rescanInterval is how often the library looks for the videos transcoded
+// since the last time.
+const rescanInterval = time.Minute
+
+// Library catalogs every uploaded or remote video, it saves itself on every
+// change since the probes end in background.
+type Library struct {
+	storage string
+	store   *Store
+	items   []*LibraryItem
+	probing map[string]bool
+	lock    *sync.Mutex
+}
+
+func NewLibrary(storage string, store *Store) *Library {
+	l := &Library{storage: storage, store: store, items: []*LibraryItem{}, probing: make(map[string]bool), lock: &sync.Mutex{}}
+	if err := store.Load(&l.items); err != nil && !os.IsNotExist(err) {
+		lerr.Printf("Library: unable to restore: %v", err)
+	}
+	go l.rescan()
+	return l
+}
+
+// save must be called with the lock held.
+func (l *Library) save() {
+	if err := l.store.Save(l.items); err != nil {
+		lerr.Printf("Library: unable to save: %v", err)
+	}
+}
+
+// cached tells if the video was transcoded with any profile.
+func (l *Library) cached(local string) bool {
+	if _, err := os.Stat(filepath.Join(l.storage, local)); err == nil {
+		return true
+	}
+	matches, _ := filepath.Glob(filepath.Join(l.storage, "*", local))
+	return len(matches) > 0
+}
+
+// state returns ready when the video of the item was transcoded.
+func (l *Library) state(item *LibraryItem) string {
+	if l.cached(item.Local) {
+		return "ready"
+	}
+	return "pending"
+}
+
+// rescan refreshes the items from time to time.
+func (l *Library) rescan() {
+	for {
+		l.lock.Lock()
+		l.refresh()
+		l.lock.Unlock()
+		time.Sleep(rescanInterval)
+	}
+}
+
+// refresh updates the state of the items, the ones transcoded and never
+// probed are probed in background. Must be called with the lock held.
+func (l *Library) refresh() {
+	changed := false
+	for _, item := range l.items {
+		state := l.state(item)
+		changed = changed || state != item.State
+		item.State = state
+		if state == "ready" && item.Media == nil {
+			l.probe(item.Id, filepath.Join(l.storage, item.Local))
+		}
+	}
+	if changed {
+		l.save()
+	}
+}
+
+// probe fills the media info of an item in background, must be called with
+// the lock held.
+func (l *Library) probe(id string, uri string) {
+	if l.probing[id] {
+		return
+	}
+	l.probing[id] = true
+	go func() {
+		info, err := Probe(uri)
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		delete(l.probing, id)
+		if err != nil {
+			lerr.Printf("Library: unable to probe %s: %v", uri, err)
+			return
+		}
+		if item := l.get(id); item != nil {
+			item.Media = info
+			if item.Size == 0 && !strings.HasPrefix(item.Source, "http") {
+				item.Size = info.Size
+			}
+			if item.Duration == "" && info.Duration > 0 {
+				item.Duration = fmt.Sprintf("%.2f", info.Duration)
+			}
+			l.save()
+		}
+	}()
+}
+
+// AddAsset catalogs the video of an asset, a source already in the library
+// is not added twice. The asset is linked to the item.
+func (l *Library) AddAsset(a *Asset) *LibraryItem {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, item := range l.items {
+		if item.Source == a.Video.Remote {
+			a.Library, a.Video.Local = item.Id, item.Local
+			c := *item
+			return &c
+		}
+	}
+	item := &LibraryItem{
+		Id:        uuid.New().String(),
+		Name:      a.Name,
+		Source:    a.Video.Remote,
+		Duration:  a.Duration,
+		AudioOnly: a.AudioOnly,
+		State:     "pending",
+		Tags:      []string{},
+		Added:     time.Now(),
+		Local:     a.Video.Local,
+	}
+	l.items = append(l.items, item)
+	if !strings.HasPrefix(item.Source, "http") {
+		l.probe(item.Id, item.Source)
+	}
+	l.save()
+	a.Library = item.Id
+	c := *item
+	return &c
+}
+
+func (l *Library) get(id string) *LibraryItem {
+	for _, item := range l.items {
+		if item.Id == id {
+			return item
+		}
+	}
+	return nil
+}
+
+func (l *Library) Get(id string) (LibraryItem, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if item := l.get(id); item != nil {
+		return *item, nil
+	}
+	return LibraryItem{}, fmt.Errorf("library item %s not found", id)
+}
+
+// Asset returns a new asset that plays a library item, every playlist gets
+// its own asset but they share the transcode.
+func (l *Library) Asset(id string) (*Asset, error) {
+	item, err := l.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	a := NewAsset(item.Name, item.Source, item.Duration)
+	a.Video.Local = item.Local
+	a.Library = item.Id
+	a.AudioOnly = item.AudioOnly
+	return a, nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Search returns the items whose name or source contains query and that have
+// every tag given, the newest first.
+func (l *Library) Search(query string, tags []string) []LibraryItem {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	query = strings.ToLower(query)
+	items := []LibraryItem{}
+	for _, item := range l.items {
+		if query != "" && !strings.Contains(strings.ToLower(item.Name), query) && !strings.Contains(strings.ToLower(item.Source), query) {
+			continue
+		}
+		match := true
+		for _, tag := range tags {
+			match = match && hasTag(item.Tags, tag)
+		}
+		if match {
+			c := *item
+			c.State = l.state(item)
+			items = append(items, c)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Added.After(items[j].Added)
+	})
+	return items
+}
+
+// Update renames or tags an item, nil leaves the field as it is.
+func (l *Library) Update(id string, name *string, tags []string) (LibraryItem, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	item := l.get(id)
+	if item == nil {
+		return LibraryItem{}, fmt.Errorf("library item %s not found", id)
+	}
+	if name != nil {
+		if *name == "" {
+			return LibraryItem{}, fmt.Errorf("empty name")
+		}
+		item.Name = *name
+	}
+	if tags != nil {
+		item.Tags = []string{}
+		for _, t := range tags {
+			if t = strings.TrimSpace(t); t != "" && !hasTag(item.Tags, t) {
+				item.Tags = append(item.Tags, t)
+			}
+		}
+	}
+	l.save()
+	return *item, nil
+}
+
+// Remove drops an item with its transcodes, an uploaded source is removed
+// too.
+func (l *Library) Remove(id string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i, item := range l.items {
+		if item.Id != id {
+			continue
+		}
+		l.items = append(l.items[:i], l.items[i+1:]...)
+		os.Remove(filepath.Join(l.storage, item.Local))
+		matches, _ := filepath.Glob(filepath.Join(l.storage, "*", item.Local))
+		for _, m := range matches {
+			os.Remove(m)
+		}
+		if !isRemote(item.Source) {
+			os.Remove(item.Source)
+		}
+		l.save()
+		return nil
+	}
+	return fmt.Errorf("library item %s not found", id)
+}
@@ -0,0 +1,193 @@
+package saovivo
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	LiveHls  = "hls"  // Live HLS playlist polled for new segments
+	LivePull = "pull" // Remote RTMP or SRT stream
+	LivePush = "push" // RTMP or SRT stream pushed to the server
+)
+
+type LiveSource struct {
+	Kind     string  `json:"kind"`
+	Url      string  `json:"url"`
+	Duration float64 `json:"duration"` // Seconds on air, 0 until the return to the playlist
+}
+
+func (l LiveSource) Validate() error {
+	u, err := url.Parse(l.Url)
+	if err != nil {
+		return err
+	}
+	scheme := strings.ToLower(u.Scheme)
+	switch l.Kind {
+	case LiveHls:
+		if scheme != "http" && scheme != "https" {
+			return fmt.Errorf("live hls source must be an http url")
+		}
+	case LivePull, LivePush:
+		if scheme != "rtmp" && scheme != "rtmps" && scheme != "srt" {
+			return fmt.Errorf("live %s source must be an rtmp or srt url", l.Kind)
+		}
+	default:
+		return fmt.Errorf("wrong live source %q, must be hls, pull or push", l.Kind)
+	}
+	if l.Duration < 0 {
+		return fmt.Errorf("live duration can not be negative")
+	}
+	return nil
+}
+
+// NewLiveAsset creates an asset that plays a live source, it is never stored
+// so it is transcoded every time it goes on air.
+func NewLiveAsset(name string, live LiveSource) *Asset {
+	var a Asset
+	a.Id = uuid.New().String()
+	a.Name = name
+	if live.Duration > 0 {
+		a.Duration = fmt.Sprintf("%.2f", live.Duration)
+	}
+	a.Live = &live
+	a.Video = VideoFile{Remote: live.Url, Local: a.Id + ".ts"}
+	return &a
+}
+
+// LiveIngest transcodes a live source to the format of the channel until it
+// is stopped or the source ends.
+type LiveIngest struct {
+	File   io.ReadCloser
+	Output chan error
+
+	ffmpeg  *FFMPEG
+	out     *net.TCPListener
+	stop    chan struct{}
+	once    *sync.Once
+	stopped bool
+	lock    *sync.Mutex
+}
+
+// livePreset returns the input of ffmpeg and the preset for a live source, a
+// pushed source is listened by ffmpeg itself.
+func livePreset(live LiveSource, profile Profile) (string, Preset) {
+	config := profile.config()
+	config = append(config, "-f", "mpegts")
+	preset := Preset{flags: []string{}, config: config}
+	input := live.Url
+	if live.Kind == LivePush {
+		if strings.HasPrefix(strings.ToLower(live.Url), "srt") {
+			if !strings.Contains(input, "mode=listener") {
+				if strings.Contains(input, "?") {
+					input += "&mode=listener"
+				} else {
+					input += "?mode=listener"
+				}
+			}
+		} else {
+			preset.flags = []string{"-listen", "1"}
+		}
+	}
+	return input, preset
+}
+
+func NewLiveIngest(live LiveSource, profile Profile) (*LiveIngest, error) {
+	var (
+		l    LiveIngest
+		feed *net.TCPListener
+		err  error
+	)
+	if err := live.Validate(); err != nil {
+		return nil, err
+	}
+
+	input, preset := livePreset(live, profile)
+	if live.Kind == LiveHls {
+		// The segments are polled here and written to ffmpeg
+		if feed, input, err = listenLocal(); err != nil {
+			return nil, err
+		}
+	}
+	out, outtcp, err := listenLocal()
+	if err != nil {
+		if feed != nil {
+			feed.Close()
+		}
+		return nil, err
+	}
+	// A pushed source connects whenever the publisher starts
+	out.SetDeadline(time.Time{})
+
+	pr, pw := io.Pipe()
+	l.File = pr
+	l.Output = make(chan error, 1)
+	l.out = out
+	l.stop = make(chan struct{})
+	l.once = &sync.Once{}
+	l.lock = &sync.Mutex{}
+	l.ffmpeg = FFMPEGStream(input, outtcp, preset)
+	l.ffmpeg.Run()
+	lout.Printf("LiveIngest: Start %s, sending to: %s", live.Url, outtcp)
+
+	if feed != nil {
+		go func() {
+			defer feed.Close()
+			dst, err := feed.Accept()
+			if err != nil {
+				return
+			}
+			if err := copyHlsLive(dst, live.Url, l.stop); err != nil {
+				lerr.Printf("LiveIngest: hls source with error: %v", err)
+			}
+			dst.Close()
+		}()
+	}
+
+	copied := make(chan struct{})
+	go func() {
+		if src, err := out.Accept(); err == nil {
+			io.Copy(pw, src)
+			src.Close()
+		}
+		pw.Close()
+		close(copied)
+	}()
+
+	go func() {
+		err := l.ffmpeg.Wait()
+		out.Close()
+		<-copied
+		l.lock.Lock()
+		if l.stopped {
+			err = nil
+		}
+		l.lock.Unlock()
+		lout.Printf("LiveIngest: End %v", err)
+		l.Output <- err
+	}()
+	return &l, nil
+}
+
+// Stop ends the live source, used to return to the playlist.
+func (l *LiveIngest) Stop() {
+	l.once.Do(func() {
+		l.lock.Lock()
+		l.stopped = true
+		l.lock.Unlock()
+		close(l.stop)
+		l.ffmpeg.Stop()
+		l.out.Close()
+	})
+}
+
+func (l *LiveIngest) Wait() error {
+	return <-l.Output
+}
@@ -24,7 +24,7 @@ func (c *chunk) String() string {
 }
 
 func supportRangeDownload(uri string) (bool, int, error) {
-	client := &http.Client{}
+	client := remoteClient
 
 	req, err := http.NewRequest("HEAD", uri, nil)
 	if err != nil {
@@ -80,7 +80,7 @@ func shuffleChunks(chunks []chunk, threads int) [][]chunk {
 }
 
 func getChunk(uri string, c *chunk) error {
-	client := &http.Client{}
+	client := remoteClient
 
 	req, err := http.NewRequest("GET", uri, nil)
 	if err != nil {
@@ -0,0 +1,415 @@
+package saovivo
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+const (
+	LogoOverlay   = "logo"   // PNG image
+	TickerOverlay = "ticker" // Text scrolling from right to left
+	ClockOverlay  = "clock"  // Local time
+)
+
+// Overlay is a graphic burned over the video sent to the destinations. X and
+// Y are the top left corner as a fraction of the frame, Scale is the width of
+// a logo as a fraction of the frame or the size of a text in pixels.
+type Overlay struct {
+	Id      string  `json:"id"`
+	Kind    string  `json:"kind"`
+	Name    string  `json:"name"`
+	Image   string  `json:"image,omitempty"`
+	Text    string  `json:"text,omitempty"`
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	Opacity float64 `json:"opacity"`
+	Scale   float64 `json:"scale"`
+	Enabled bool    `json:"enabled"`
+}
+
+func (o Overlay) Validate() error {
+	switch o.Kind {
+	case LogoOverlay:
+		if o.Image == "" {
+			return fmt.Errorf("logo overlay without image")
+		}
+		if o.Scale <= 0 || o.Scale > 1 {
+			return fmt.Errorf("logo scale must be between 0 and 1")
+		}
+	case TickerOverlay, ClockOverlay:
+		if o.Scale < 8 || o.Scale > 200 {
+			return fmt.Errorf("text size must be between 8 and 200")
+		}
+	default:
+		return fmt.Errorf("wrong overlay %q, must be logo, ticker or clock", o.Kind)
+	}
+	if o.X < 0 || o.X > 1 || o.Y < 0 || o.Y > 1 {
+		return fmt.Errorf("overlay position must be between 0 and 1")
+	}
+	if o.Opacity < 0 || o.Opacity > 1 {
+		return fmt.Errorf("overlay opacity must be between 0 and 1")
+	}
+	return nil
+}
+
+// NewOverlay returns an overlay of the kind with the default position, size
+// and opacity.
+func NewOverlay(kind string) Overlay {
+	o := Overlay{Id: uuid.New().String(), Kind: kind, Opacity: 1, Enabled: true}
+	switch kind {
+	case LogoOverlay:
+		o.X, o.Y, o.Scale = 0.84, 0.02, 0.15
+	case TickerOverlay:
+		o.X, o.Y, o.Scale = 0, 0.92, 32
+	case ClockOverlay:
+		o.X, o.Y, o.Scale = 0.02, 0.02, 32
+	}
+	return o
+}
+
+// The logos are composed on a layer of this size, ffmpeg scales it to the
+// size of the video.
+const (
+	layerWidth  = 1280
+	layerHeight = 720
+)
+
+var overlayFont string
+
+func init() {
+	if runtime.GOOS == "windows" {
+		overlayFont = "C:/Windows/Fonts/arial.ttf"
+	} else {
+		overlayFont = "/usr/share/fonts/truetype/dejavu/DejaVuSans.ttf"
+	}
+}
+
+// The encoder always has these tickers and clocks, a slot without a text
+// shows nothing until one is added.
+const (
+	tickerSlots = 2
+	clockSlots  = 2
+)
+
+// Overlays keeps the overlays of the channel and the files read by ffmpeg
+// while encoding. The logos are drawn on one image and the texts are written
+// to the files of their slots, ffmpeg reloads them on every frame so adding,
+// enabling or editing them is seen on air without restarting the encoder.
+// The position and size of the texts are read when the encoder starts, a
+// text added after that is shown where its kind is by default.
+type Overlays struct {
+	dir      string
+	overlays []*Overlay
+	lock     *sync.Mutex
+}
+
+func NewOverlays(dir string) *Overlays {
+	return &Overlays{dir: dir, overlays: []*Overlay{}, lock: &sync.Mutex{}}
+}
+
+func RestoreOverlays(dir string, overlays []Overlay) *Overlays {
+	o := NewOverlays(dir)
+	for i := range overlays {
+		ov := overlays[i]
+		o.overlays = append(o.overlays, &ov)
+	}
+	if err := o.render(); err != nil {
+		lerr.Printf("Overlays: unable to render: %v", err)
+	}
+	return o
+}
+
+func (o *Overlays) Snapshot() []Overlay {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	overlays := []Overlay{}
+	for _, ov := range o.overlays {
+		overlays = append(overlays, *ov)
+	}
+	return overlays
+}
+
+// Len returns the number of overlays configured, enabled or not.
+func (o *Overlays) Len() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.overlays)
+}
+
+// SaveImage stores an uploaded logo, it must be a PNG file.
+func (o *Overlays) SaveImage(r io.Reader) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+		return "", fmt.Errorf("the logo is not a png image: %v", err)
+	}
+	if err := os.MkdirAll(o.dir, 0755); err != nil {
+		return "", err
+	}
+	name := uuid.New().String() + ".png"
+	if err := replaceFile(filepath.Join(o.dir, name), data); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (o *Overlays) Add(ov Overlay) (*Overlay, error) {
+	if err := ov.Validate(); err != nil {
+		return nil, err
+	}
+	o.lock.Lock()
+	if slots := textSlots(ov.Kind); slots > 0 && len(o.ofKind(ov.Kind)) >= slots {
+		o.lock.Unlock()
+		return nil, fmt.Errorf("at most %d %s overlays", slots, ov.Kind)
+	}
+	o.overlays = append(o.overlays, &ov)
+	o.lock.Unlock()
+	return &ov, o.render()
+}
+
+// Update changes an overlay through fn, the change is discarded when the
+// result is not valid.
+func (o *Overlays) Update(id string, fn func(*Overlay)) (*Overlay, error) {
+	o.lock.Lock()
+	var found *Overlay
+	for _, ov := range o.overlays {
+		if ov.Id == id {
+			found = ov
+		}
+	}
+	if found == nil {
+		o.lock.Unlock()
+		return nil, fmt.Errorf("overlay %s not found", id)
+	}
+	updated := *found
+	fn(&updated)
+	updated.Id, updated.Kind = found.Id, found.Kind
+	if err := updated.Validate(); err != nil {
+		o.lock.Unlock()
+		return nil, err
+	}
+	*found = updated
+	o.lock.Unlock()
+	return &updated, o.render()
+}
+
+func (o *Overlays) Remove(id string) bool {
+	o.lock.Lock()
+	removed := false
+	for i, ov := range o.overlays {
+		if ov.Id == id {
+			o.overlays = append(o.overlays[:i], o.overlays[i+1:]...)
+			if ov.Image != "" {
+				os.Remove(filepath.Join(o.dir, ov.Image))
+			}
+			removed = true
+			break
+		}
+	}
+	o.lock.Unlock()
+	if removed {
+		if err := o.render(); err != nil {
+			lerr.Printf("Overlays: unable to render: %v", err)
+		}
+	}
+	return removed
+}
+
+func (o *Overlays) layerFile() string {
+	return filepath.Join(o.dir, "layer.png")
+}
+
+// textSlots returns how many overlays of a kind the encoder has, 0 for the
+// logos that are all drawn on the layer.
+func textSlots(kind string) int {
+	switch kind {
+	case TickerOverlay:
+		return tickerSlots
+	case ClockOverlay:
+		return clockSlots
+	}
+	return 0
+}
+
+// slotFile is the text of a slot of a kind.
+func (o *Overlays) slotFile(kind string, slot int) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%s-%d.txt", kind, slot))
+}
+
+// ofKind returns the overlays of a kind in the order of their slots, must be
+// called with the lock held.
+func (o *Overlays) ofKind(kind string) []*Overlay {
+	overlays := []*Overlay{}
+	for _, ov := range o.overlays {
+		if ov.Kind == kind {
+			overlays = append(overlays, ov)
+		}
+	}
+	return overlays
+}
+
+// render writes the files read by ffmpeg, the layer with the logos and the
+// text of every slot.
+func (o *Overlays) render() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if err := os.MkdirAll(o.dir, 0755); err != nil {
+		return err
+	}
+	layer := image.NewRGBA(image.Rect(0, 0, layerWidth, layerHeight))
+	for _, ov := range o.ofKind(LogoOverlay) {
+		if ov.Enabled {
+			if err := drawLogo(layer, filepath.Join(o.dir, ov.Image), ov); err != nil {
+				lerr.Printf("Overlays: unable to draw %s: %v", ov.Name, err)
+			}
+		}
+	}
+	for _, kind := range []string{TickerOverlay, ClockOverlay} {
+		overlays := o.ofKind(kind)
+		for slot := 0; slot < textSlots(kind); slot++ {
+			// A space keeps drawtext working while the slot shows nothing
+			text := " "
+			if slot < len(overlays) && overlays[slot].Enabled {
+				if ov := overlays[slot]; ov.Kind == ClockOverlay {
+					text = `%{localtime:%H\:%M\:%S}`
+				} else if ov.Text != "" {
+					text = escapeDrawtext(ov.Text)
+				}
+			}
+			if err := replaceFile(o.slotFile(kind, slot), []byte(text)); err != nil {
+				return err
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, layer); err != nil {
+		return err
+	}
+	return replaceFile(o.layerFile(), buf.Bytes())
+}
+
+// drawLogo scales the logo to its width in the layer and draws it with its
+// opacity.
+func drawLogo(layer *image.RGBA, path string, ov *Overlay) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	logo, err := png.Decode(f)
+	if err != nil {
+		return err
+	}
+	src := logo.Bounds()
+	if src.Dx() == 0 || src.Dy() == 0 {
+		return nil
+	}
+	w := int(ov.Scale * layerWidth)
+	h := w * src.Dy() / src.Dx()
+	if w == 0 || h == 0 {
+		return nil
+	}
+	// Nearest neighbour is enough for a logo bug
+	scaled := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			scaled.Set(x, y, logo.At(src.Min.X+x*src.Dx()/w, src.Min.Y+y*src.Dy()/h))
+		}
+	}
+	at := image.Pt(int(ov.X*layerWidth), int(ov.Y*layerHeight))
+	mask := image.NewUniform(color.Alpha{A: uint8(ov.Opacity * 255)})
+	draw.DrawMask(layer, scaled.Bounds().Add(at), scaled, image.Point{}, mask, image.Point{}, draw.Over)
+	return nil
+}
+
+// escapeDrawtext escapes the text expansion of drawtext.
+func escapeDrawtext(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, "%", `\%`)
+}
+
+// filterPath quotes a path to be used as an option of a filter.
+func filterPath(p string) string {
+	return "'" + filepath.ToSlash(p) + "'"
+}
+
+// burn returns a preset that re-encodes the video with the overlays on top,
+// vf and af are the filters applied to the video and audio before that.
+func (o *Overlays) burn(flags []string, vf string, af string, profile Profile) Preset {
+	if err := o.render(); err != nil {
+		lerr.Printf("Overlays: unable to render: %v", err)
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	base := "[0:v]null[base]"
+	if vf != "" {
+		base = "[0:v]" + vf + "[base]"
+	}
+	graph := base + ";[1:v][base]scale2ref[layer][main];[main][layer]overlay=shortest=1:format=auto"
+	for _, kind := range []string{TickerOverlay, ClockOverlay} {
+		overlays := o.ofKind(kind)
+		for slot := 0; slot < textSlots(kind); slot++ {
+			ov := NewOverlay(kind)
+			if slot < len(overlays) {
+				ov = *overlays[slot]
+			}
+			x := fmt.Sprintf("w*%.4f", ov.X)
+			if kind == TickerOverlay {
+				x = "'w-mod(t*120,w+tw)'"
+			}
+			graph += fmt.Sprintf(",drawtext=fontfile=%s:textfile=%s:reload=1:fontcolor=white@%.2f:fontsize=%d:borderw=2:bordercolor=black@%.2f:x=%s:y=h*%.4f",
+				filterPath(overlayFont), filterPath(o.slotFile(kind, slot)), ov.Opacity, int(ov.Scale), ov.Opacity, x, ov.Y)
+		}
+	}
+	graph += "[video]"
+
+	config := []string{
+		"-f", "image2", "-loop", "1", "-pattern_type", "none", "-framerate", "5", "-i", o.layerFile(),
+		"-filter_complex", graph,
+		"-map", "[video]",
+		"-map", "0:a?",
+	}
+	if af != "" {
+		config = append(config, "-af", af)
+	}
+	config = append(config, profile.config()...)
+	config = append(config, "-f", "mpegts")
+	return Preset{flags: flags, config: config}
+}
+
+// replaceFile writes a file atomically, ffmpeg never reads it half written.
+func replaceFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package saovivo
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestOverlaySlots(t *testing.T) {
+	o := NewOverlays(t.TempDir())
+	graph := func() string {
+		config := o.burn(nil, "", "", DefaultProfile).config
+		for i, c := range config {
+			if c == "-filter_complex" {
+				return config[i+1]
+			}
+		}
+		t.Fatal("no filter graph")
+		return ""
+	}
+	// The slots are in the graph before there is any text
+	if n := strings.Count(graph(), "drawtext="); n != tickerSlots+clockSlots {
+		t.Fatalf("%d drawtext filters, want %d", n, tickerSlots+clockSlots)
+	}
+	before := graph()
+
+	ticker := NewOverlay(TickerOverlay)
+	ticker.Text = "100%"
+	if _, err := o.Add(ticker); err != nil {
+		t.Fatal(err)
+	}
+	if text, _ := os.ReadFile(o.slotFile(TickerOverlay, 0)); string(text) != `100\%` {
+		t.Errorf("ticker slot with %q", text)
+	}
+	if text, _ := os.ReadFile(o.slotFile(TickerOverlay, 1)); string(text) != " " {
+		t.Errorf("empty ticker slot with %q", text)
+	}
+	if before != graph() {
+		t.Error("a ticker in its default position changed the graph")
+	}
+
+	ticker.Enabled = false
+	ticker.Id = "disabled"
+	o.Add(ticker)
+	if text, _ := os.ReadFile(o.slotFile(TickerOverlay, 1)); string(text) != " " {
+		t.Errorf("disabled ticker slot with %q", text)
+	}
+	if _, err := o.Add(NewOverlay(TickerOverlay)); err == nil {
+		t.Errorf("more tickers than slots added")
+	}
+	if _, err := o.Add(NewOverlay(ClockOverlay)); err != nil {
+		t.Errorf("clock not added: %v", err)
+	}
+}
@@ -2,6 +2,8 @@ package saovivo
 
 import (
 	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"strconv"
 
@@ -9,15 +11,34 @@ import (
 )
 
 type VideoFile struct {
-	Remote string
-	Local  string
+	Remote string `json:"remote"`
+	Local  string `json:"local"`
 }
 
 type Asset struct {
-	Id       string    `json:"id"`
-	Name     string    `json:"name"`
-	Duration string    `json:"duration"`
-	Video    VideoFile `json:"-"`
+	Id             string      `json:"id"`
+	Name           string      `json:"name"`
+	Duration       string      `json:"duration"`
+	Transition     *Transition `json:"transition,omitempty"`
+	Live           *LiveSource `json:"live,omitempty"`
+	Library        string      `json:"library,omitempty"`        // Item of the library played
+	AudioOnly      bool        `json:"audioOnly,omitempty"`      // Played over the slate
+	Segments       []Segment   `json:"segments,omitempty"`       // Played instead of the whole source, they make the duration
+	SourceDuration string      `json:"sourceDuration,omitempty"` // Of the whole source when it is trimmed
+	Video          VideoFile   `json:"-"`
+}
+
+// StoredAsset is the representation of an Asset saved in the state store, it
+// keeps the video paths hidden from the API.
+type StoredAsset struct {
+	Asset
+	Video VideoFile `json:"video"`
+}
+
+type PlaylistSnapshot struct {
+	Queue      []StoredAsset `json:"queue"`
+	Reproduced []StoredAsset `json:"reproduced"`
+	InPlay     *StoredAsset  `json:"inPlay,omitempty"`
 }
 
 type Playlist struct {
@@ -48,15 +69,66 @@ func NewPlaylist() *Playlist {
 	return &playlist
 }
 
+// RestorePlaylist rebuilds a playlist from a snapshot, the asset that was in
+// play when the snapshot was taken goes back to the front of the queue.
+func RestorePlaylist(s PlaylistSnapshot) *Playlist {
+	playlist := NewPlaylist()
+	if s.InPlay != nil {
+		playlist.videoQueue.PushBack(s.InPlay.restore())
+	}
+	for i := range s.Queue {
+		playlist.videoQueue.PushBack(s.Queue[i].restore())
+	}
+	for i := range s.Reproduced {
+		playlist.reproduced.PushBack(s.Reproduced[i].restore())
+	}
+	return playlist
+}
+
+func storeAsset(a *Asset) StoredAsset {
+	return StoredAsset{Asset: *a, Video: a.Video}
+}
+
+func (s *StoredAsset) restore() *Asset {
+	a := s.Asset
+	a.Video = s.Video
+	return &a
+}
+
+func (p *Playlist) Snapshot() PlaylistSnapshot {
+	s := PlaylistSnapshot{Queue: []StoredAsset{}, Reproduced: []StoredAsset{}}
+	if p.inPlay != nil {
+		a := storeAsset(p.inPlay)
+		s.InPlay = &a
+	}
+	for e := p.videoQueue.Front(); e != nil; e = e.Next() {
+		s.Queue = append(s.Queue, storeAsset(e.Value.(*Asset)))
+	}
+	for e := p.reproduced.Front(); e != nil; e = e.Next() {
+		s.Reproduced = append(s.Reproduced, storeAsset(e.Value.(*Asset)))
+	}
+	return s
+}
+
 func NewAsset(name string, assetpath string, duration string) *Asset {
 	var a Asset
 	a.Id = uuid.New().String()
 	a.Name = name
 	a.Duration = duration
-	a.Video = VideoFile{Remote: assetpath, Local: a.Id + ".ts"}
+	a.Video = VideoFile{Remote: assetpath, Local: cacheName(a.Id, assetpath)}
 	return &a
 }
 
+// cacheName returns the file where the transcode of a video is kept, the
+// remote videos are named after their url so the channels share them.
+func cacheName(id string, assetpath string) string {
+	if !isRemote(assetpath) {
+		return id + ".ts"
+	}
+	sum := sha1.Sum([]byte(assetpath))
+	return hex.EncodeToString(sum[:]) + ".ts"
+}
+
 func (p *Playlist) Append(asset *Asset) string {
 	p.videoQueue.PushBack(asset)
 	return asset.Id
@@ -74,6 +146,34 @@ func (p *Playlist) GetAssetNameById(id string) string {
 	return ""
 }
 
+func (p *Playlist) GetAssetById(id string) *Asset {
+	if p.inPlay != nil && p.inPlay.Id == id {
+		return p.inPlay
+	}
+	for _, l := range []*list.List{p.videoQueue, p.reproduced} {
+		for e := l.Front(); e != nil; e = e.Next() {
+			if e.Value.(*Asset).Id == id {
+				return e.Value.(*Asset)
+			}
+		}
+	}
+	return nil
+}
+
+// Assets returns every asset of the playlist, in play, queued or reproduced.
+func (p *Playlist) Assets() []*Asset {
+	assets := []*Asset{}
+	if p.inPlay != nil {
+		assets = append(assets, p.inPlay)
+	}
+	for _, l := range []*list.List{p.videoQueue, p.reproduced} {
+		for e := l.Front(); e != nil; e = e.Next() {
+			assets = append(assets, e.Value.(*Asset))
+		}
+	}
+	return assets
+}
+
 func (p *Playlist) getListElementByAssetIdInReproduced(id string) (*list.Element, int) {
 	i := 0
 	for e := p.videoQueue.Front(); e != nil; e = e.Next() {
@@ -192,6 +292,56 @@ func (p *Playlist) MoveByAssetIdToPositionGPT(id string, position int) bool {
 	return true
 }
 
+// Locate tells where an asset is: inPlay, queued with its position in the
+// queue, or reproduced. It returns an empty place when it is not found.
+func (p *Playlist) Locate(id string) (string, int) {
+	if p.inPlay != nil && p.inPlay.Id == id {
+		return "inPlay", -1
+	}
+	if _, i := p.getListElementByAssetId(id); i >= 0 {
+		return "queued", i
+	}
+	for e := p.reproduced.Front(); e != nil; e = e.Next() {
+		if e.Value.(*Asset).Id == id {
+			return "reproduced", -1
+		}
+	}
+	return "", -1
+}
+
+// Upcoming returns the next n assets of the queue.
+func (p *Playlist) Upcoming(n int) []*Asset {
+	assets := []*Asset{}
+	for e := p.videoQueue.Front(); e != nil && len(assets) < n; e = e.Next() {
+		assets = append(assets, e.Value.(*Asset))
+	}
+	return assets
+}
+
+// PromoteReady moves the first ready asset of the queue to the front when
+// the next one is not ready, the rest keep their order.
+func (p *Playlist) PromoteReady(ready func(*Asset) bool) {
+	front := p.videoQueue.Front()
+	if front == nil || ready(front.Value.(*Asset)) {
+		return
+	}
+	for e := front.Next(); e != nil; e = e.Next() {
+		if ready(e.Value.(*Asset)) {
+			p.videoQueue.MoveToFront(e)
+			return
+		}
+	}
+}
+
+// Release moves the asset in play to the reproduced list without taking the
+// next one, it makes room for a scheduled asset.
+func (p *Playlist) Release() {
+	if p.inPlay != nil {
+		p.reproduced.PushBack(p.inPlay)
+		p.inPlay = nil
+	}
+}
+
 func (p *Playlist) Shift(end bool) *Asset {
 	if p.inPlay != nil {
 		p.reproduced.PushBack(p.inPlay)
@@ -222,6 +372,10 @@ func (p *Playlist) Len() int {
 	return p.videoQueue.Len() + p.reproduced.Len() + i
 }
 
+func (p *Playlist) InPlay() *Asset {
+	return p.inPlay
+}
+
 func (p *Playlist) InQueue() int {
 	return p.videoQueue.Len()
 }
@@ -0,0 +1,360 @@
+package saovivo
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IngestState is how far the transcode of a video is.
+type IngestState struct {
+	State    string    `json:"state"`    // pending, uploading, downloading, transcoding, ready or failed
+	Progress float64   `json:"progress"` // 0 to 1 while downloading or transcoding
+	Error    string    `json:"error,omitempty"`
+	Ffmpeg   *Progress `json:"ffmpeg,omitempty"` // Last report of the transcode
+}
+
+// retryFailed is how long a failed video waits before being prefetched again
+var retryFailed = time.Minute
+
+type prefetchJob struct {
+	uri      string
+	dst      string
+	profile  Profile
+	duration float64 // Seconds, 0 when unknown
+	slate    string  // Shown under an audio, empty for a video
+}
+
+// Prefetcher transcodes the videos that are about to play to their files, so
+// they play from the disk instead of depending on the source while on air.
+type Prefetcher struct {
+	storage string
+	slate   string
+	jobs    chan prefetchJob
+	states  map[string]*IngestState // By file
+	failed  map[string]time.Time
+	hub     *ProgressHub
+	lock    *sync.Mutex
+}
+
+// NewPrefetcher starts the workers, they are shared by every channel. The
+// audios are shown over the slate and the changes of state are published to
+// hub.
+func NewPrefetcher(storage string, workers int, slate string, hub *ProgressHub) *Prefetcher {
+	p := &Prefetcher{
+		storage: storage,
+		slate:   slate,
+		jobs:    make(chan prefetchJob, 256),
+		states:  make(map[string]*IngestState),
+		failed:  make(map[string]time.Time),
+		hub:     hub,
+		lock:    &sync.Mutex{},
+	}
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+func (p *Prefetcher) worker() {
+	for job := range p.jobs {
+		lout.Printf("Prefetcher: ingest %s to %s", job.uri, job.dst)
+		err := ingestFile(job.uri, job.dst, job.profile, job.slate, job.duration, func(s IngestState) {
+			p.lock.Lock()
+			if _, ok := p.states[job.dst]; ok {
+				p.states[job.dst] = &s
+			}
+			p.lock.Unlock()
+			p.publish(job.dst, s)
+		})
+		state := IngestState{State: "ready", Progress: 1}
+		p.lock.Lock()
+		if err != nil {
+			lerr.Printf("Prefetcher: ingest %s with error: %v", job.uri, err)
+			state = IngestState{State: "failed", Error: err.Error()}
+			p.states[job.dst] = &state
+			p.failed[job.dst] = time.Now()
+		} else {
+			delete(p.states, job.dst)
+		}
+		p.lock.Unlock()
+		p.publish(job.dst, state)
+	}
+}
+
+// Key returns the name given to the transcode of an asset in the events.
+func (p *Prefetcher) Key(a *Asset, profile Profile) string {
+	return p.key(profile.localPath(p.storage, a.Video.Local))
+}
+
+func (p *Prefetcher) key(dst string) string {
+	if rel, err := filepath.Rel(p.storage, dst); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.Base(dst)
+}
+
+func (p *Prefetcher) publish(dst string, s IngestState) {
+	p.hub.publish(ProgressEvent{Kind: "ingest", Id: p.key(dst), IngestState: s})
+}
+
+// Follow reports the transcode of an asset done by the channel while it
+// plays, the progress ends when the ingest does. Nothing is reported when a
+// worker is already transcoding the asset.
+func (p *Prefetcher) Follow(a *Asset, profile Profile, progress <-chan Progress) {
+	dst := profile.localPath(p.storage, a.Video.Local)
+	duration, _ := strconv.ParseFloat(a.Duration, 64)
+	p.lock.Lock()
+	if s, ok := p.states[dst]; ok && s.State != "failed" {
+		p.lock.Unlock()
+		return
+	}
+	p.states[dst] = &IngestState{State: "transcoding"}
+	delete(p.failed, dst)
+	p.lock.Unlock()
+
+	go func() {
+		for pr := range progress {
+			pr := pr
+			s := IngestState{State: "transcoding", Progress: transcoded(pr, duration), Ffmpeg: &pr}
+			p.lock.Lock()
+			p.states[dst] = &s
+			p.lock.Unlock()
+			p.publish(dst, s)
+		}
+		p.lock.Lock()
+		delete(p.states, dst)
+		p.lock.Unlock()
+		p.publish(dst, p.State(a, profile))
+	}()
+}
+
+// transcoded returns the fraction of the video transcoded, 0 when the
+// duration is unknown.
+func transcoded(pr Progress, duration float64) float64 {
+	if duration <= 0 {
+		return 0
+	}
+	if pr.End || pr.OutTime >= duration {
+		return 1
+	}
+	return pr.OutTime / duration
+}
+
+// Prefetch queues the transcode of an asset, nothing is done when it is
+// ready, already queued or failed a moment ago.
+func (p *Prefetcher) Prefetch(a *Asset, profile Profile) {
+	if a.Live != nil {
+		return
+	}
+	dst := profile.localPath(p.storage, a.Video.Local)
+	if _, err := os.Stat(dst); err == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if s, ok := p.states[dst]; ok && (s.State != "failed" || time.Since(p.failed[dst]) < retryFailed) {
+		return
+	}
+	job := prefetchJob{uri: a.Video.Remote, dst: dst, profile: profile}
+	job.duration, _ = strconv.ParseFloat(a.Duration, 64)
+	if a.AudioOnly {
+		job.slate = p.slate
+	}
+	select {
+	case p.jobs <- job:
+		p.states[dst] = &IngestState{State: "pending"}
+		delete(p.failed, dst)
+	default:
+		// Queued again the next time
+	}
+}
+
+// State returns the ingest state of an asset, a live source is always ready.
+func (p *Prefetcher) State(a *Asset, profile Profile) IngestState {
+	if a.Live != nil {
+		return IngestState{State: "ready", Progress: 1}
+	}
+	dst := profile.localPath(p.storage, a.Video.Local)
+	if _, err := os.Stat(dst); err == nil {
+		return IngestState{State: "ready", Progress: 1}
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if s, ok := p.states[dst]; ok {
+		return *s
+	}
+	return IngestState{State: "pending"}
+}
+
+func (p *Prefetcher) Ready(a *Asset, profile Profile) bool {
+	return p.State(a, profile).State == "ready"
+}
+
+// Transcoding tells if a video is queued or being transcoded with a
+// profile.
+func (p *Prefetcher) Transcoding(profile Profile) bool {
+	dir := filepath.Join(p.storage, profile.Id)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for dst, s := range p.states {
+		if filepath.Dir(dst) == dir && (s.State == "pending" || s.State == "transcoding") {
+			return true
+		}
+	}
+	return false
+}
+
+// Busy tells if an asset was queued to be prefetched and it is still waiting
+// for its turn or being transcoded.
+func (p *Prefetcher) Busy(a *Asset, profile Profile) bool {
+	if a.Live != nil {
+		return false
+	}
+	dst := profile.localPath(p.storage, a.Video.Local)
+	if _, err := os.Stat(dst); err == nil {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s, ok := p.states[dst]
+	return ok && (s.State == "pending" || s.State == "transcoding")
+}
+
+// progressWriter reports the bytes written out of the total expected.
+type progressWriter struct {
+	w       io.Writer
+	written int64
+	total   int64
+	report  func(float64)
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	pw.written += int64(n)
+	if pw.total > 0 {
+		progress := float64(pw.written) / float64(pw.total)
+		if progress > 1 {
+			progress = 1
+		}
+		pw.report(progress)
+	}
+	return n, err
+}
+
+// sourceSize returns the bytes of a video, 0 when unknown.
+func sourceSize(uri string, localfile bool) int64 {
+	if localfile {
+		if info, err := os.Stat(uri); err == nil {
+			return info.Size()
+		}
+		return 0
+	}
+	rsp, err := remoteClient.Head(uri)
+	if err != nil {
+		return 0
+	}
+	rsp.Body.Close()
+	size, _ := strconv.ParseInt(rsp.Header.Get("Content-Length"), 10, 64)
+	return size
+}
+
+// ingestFile transcodes a video to dst without sending it to a channel, the
+// file appears once the transcode is complete. While the source is read the
+// progress is the bytes downloaded, then the time transcoded out of duration.
+func ingestFile(uri string, dst string, profile Profile, slate string, duration float64, report func(IngestState)) error {
+	var (
+		v     VideoIngest
+		state = IngestState{State: "downloading"}
+		lock  sync.Mutex
+	)
+	update := func(fn func(*IngestState)) {
+		lock.Lock()
+		fn(&state)
+		s := state
+		lock.Unlock()
+		report(s)
+	}
+
+	report(state)
+	if err := v.verifySource(uri); err != nil {
+		return err
+	}
+	srv, tcp, err := listenLocal()
+	if err != nil {
+		return err
+	}
+	part := dst + "." + uuid.New().String()[:8] + ".part"
+	ffmpeg := FFMPEGStream(tcp, part, storePreset(profile, slate))
+	progress := ffmpeg.Progress()
+	followed := make(chan bool)
+	go func() {
+		for pr := range progress {
+			pr := pr
+			update(func(s *IngestState) {
+				s.Ffmpeg = &pr
+				if s.State == "transcoding" {
+					s.Progress = transcoded(pr, duration)
+				}
+			})
+		}
+		close(followed)
+	}()
+	ffmpeg.Run()
+	conn, err := srv.Accept()
+	srv.Close()
+	if err != nil {
+		ffmpeg.StopAndWait()
+		<-followed
+		os.Remove(part)
+		return err
+	}
+
+	// Every segment of a playlist is a part of the progress, a single file
+	// the bytes read of its size
+	segments := len(v.uri) + len(v.audio)
+	started := 0
+	err = v.sendSource(conn, func(sg segment, w io.Writer) io.Writer {
+		if segments > 1 {
+			lock.Lock()
+			done := float64(started) / float64(segments)
+			started++
+			lock.Unlock()
+			update(func(s *IngestState) { s.Progress = done })
+			return w
+		}
+		total := sg.length
+		if total == 0 {
+			total = sourceSize(sg.uri, v.localfile)
+		}
+		return &progressWriter{w: w, total: total, report: func(progress float64) {
+			update(func(s *IngestState) { s.Progress = progress })
+		}}
+	})
+	if err != nil {
+		conn.Close()
+		ffmpeg.StopAndWait()
+		<-followed
+		os.Remove(part)
+		return err
+	}
+	conn.Close()
+	update(func(s *IngestState) {
+		s.State, s.Progress = "transcoding", 0
+		if s.Ffmpeg != nil {
+			s.Progress = transcoded(*s.Ffmpeg, duration)
+		}
+	})
+	err = ffmpeg.Wait()
+	<-followed
+	if err != nil {
+		os.Remove(part)
+		return err
+	}
+	return os.Rename(part, dst)
+}
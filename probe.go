@@ -0,0 +1,124 @@
+package saovivo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// MediaInfo is what ffprobe tells about a video.
+type MediaInfo struct {
+	Format   string       `json:"format"`
+	Duration float64      `json:"duration"`
+	Size     int64        `json:"size"`
+	Video    *VideoStream `json:"video,omitempty"`
+	Audio    *AudioStream `json:"audio,omitempty"`
+}
+
+type VideoStream struct {
+	Codec  string  `json:"codec"`
+	Width  int     `json:"width"`
+	Height int     `json:"height"`
+	Fps    float64 `json:"fps"`
+}
+
+type AudioStream struct {
+	Codec      string `json:"codec"`
+	SampleRate int    `json:"sampleRate"`
+	Channels   int    `json:"channels"`
+}
+
+var ffprobe_exec string
+
+func init() {
+	path, _ := os.Getwd()
+	if runtime.GOOS == "windows" {
+		ffprobe_exec = filepath.Join(path, "ffprobe.exe")
+	} else {
+		ffprobe_exec = filepath.Join(path, "ffprobe")
+	}
+}
+
+type probeOutput struct {
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		Size       string `json:"size"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType    string `json:"codec_type"`
+		CodecName    string `json:"codec_name"`
+		Width        int    `json:"width"`
+		Height       int    `json:"height"`
+		AvgFrameRate string `json:"avg_frame_rate"`
+		SampleRate   string `json:"sample_rate"`
+		Channels     int    `json:"channels"`
+		Disposition  struct {
+			AttachedPic int `json:"attached_pic"`
+		} `json:"disposition"`
+	} `json:"streams"`
+}
+
+// frameRate parses the rate given by ffprobe as a fraction.
+func frameRate(rate string) float64 {
+	num, den, found := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !found {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// Probe runs ffprobe on a local file or an url, only the first video and
+// audio streams are reported.
+func Probe(uri string) (*MediaInfo, error) {
+	var (
+		stdout bytes.Buffer
+		stderr bytes.Buffer
+		out    probeOutput
+	)
+	cmd := exec.Command(ffprobe_exec, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", uri)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s", msg)
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return nil, err
+	}
+
+	info := MediaInfo{Format: out.Format.FormatName}
+	info.Duration, _ = strconv.ParseFloat(out.Format.Duration, 64)
+	info.Size, _ = strconv.ParseInt(out.Format.Size, 10, 64)
+	for _, s := range out.Streams {
+		switch s.CodecType {
+		case "video":
+			// A cover image is not a video
+			if info.Video == nil && s.Disposition.AttachedPic == 0 {
+				info.Video = &VideoStream{Codec: s.CodecName, Width: s.Width, Height: s.Height, Fps: frameRate(s.AvgFrameRate)}
+			}
+		case "audio":
+			if info.Audio == nil {
+				rate, _ := strconv.Atoi(s.SampleRate)
+				info.Audio = &AudioStream{Codec: s.CodecName, SampleRate: rate, Channels: s.Channels}
+			}
+		}
+	}
+	return &info, nil
+}
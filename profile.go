@@ -0,0 +1,312 @@
+package saovivo
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Profile is a named encoding configuration, the channel transcodes its
+// videos with one of them and a destination can re-encode the stream of the
+// channel with another one.
+type Profile struct {
+	Id           string  `json:"id"`
+	Name         string  `json:"name"`
+	VideoCodec   string  `json:"videoCodec"` // libx264 or libx265
+	Speed        string  `json:"speed"`      // Preset of the encoder
+	Width        int     `json:"width"`      // 0 keeps the size of the source
+	Height       int     `json:"height"`
+	Fps          int     `json:"fps"`
+	VideoBitrate int     `json:"videoBitrate"` // kbps
+	Keyframe     float64 `json:"keyframe"`     // Seconds between keyframes
+	VideoProfile string  `json:"videoProfile,omitempty"`
+	Level        string  `json:"level,omitempty"`
+	AudioBitrate int     `json:"audioBitrate"` // kbps
+	SampleRate   int     `json:"sampleRate"`
+	Channels     int     `json:"channels"`
+	Builtin      bool    `json:"builtin"`
+}
+
+// DefaultProfile is the encoding used before the profiles existed.
+var DefaultProfile = Profile{
+	Id:           "default",
+	Name:         "Predeterminado",
+	VideoCodec:   "libx264",
+	Speed:        "fast",
+	Fps:          30,
+	VideoBitrate: 1500,
+	Keyframe:     2,
+	VideoProfile: "baseline",
+	Level:        "3.0",
+	AudioBitrate: 128,
+	SampleRate:   44100,
+	Channels:     2,
+	Builtin:      true,
+}
+
+var builtinProfiles = []Profile{
+	DefaultProfile,
+	{Id: "720p", Name: "720p", VideoCodec: "libx264", Speed: "fast", Width: 1280, Height: 720, Fps: 30, VideoBitrate: 3000, Keyframe: 2, VideoProfile: "main", Level: "3.1", AudioBitrate: 128, SampleRate: 48000, Channels: 2, Builtin: true},
+	{Id: "1080p", Name: "1080p", VideoCodec: "libx264", Speed: "fast", Width: 1920, Height: 1080, Fps: 30, VideoBitrate: 6000, Keyframe: 2, VideoProfile: "high", Level: "4.1", AudioBitrate: 160, SampleRate: 48000, Channels: 2, Builtin: true},
+	{Id: "1080p-hevc", Name: "1080p HEVC", VideoCodec: "libx265", Speed: "fast", Width: 1920, Height: 1080, Fps: 30, VideoBitrate: 4000, Keyframe: 2, AudioBitrate: 160, SampleRate: 48000, Channels: 2, Builtin: true},
+}
+
+var (
+	encoderSpeeds = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow"}
+	h264Profiles  = []string{"", "baseline", "main", "high"}
+	h264Level     = regexp.MustCompile(`^[1-6](\.[0-2])?$`)
+)
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Profile) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("profile without name")
+	}
+	switch p.VideoCodec {
+	case "libx264":
+		if !contains(h264Profiles, p.VideoProfile) {
+			return fmt.Errorf("wrong h264 profile %q, must be baseline, main or high", p.VideoProfile)
+		}
+		if p.Level != "" && !h264Level.MatchString(p.Level) {
+			return fmt.Errorf("wrong h264 level %q", p.Level)
+		}
+	case "libx265":
+		if p.VideoProfile != "" || p.Level != "" {
+			return fmt.Errorf("profile and level are only for libx264")
+		}
+	default:
+		return fmt.Errorf("wrong video codec %q, must be libx264 or libx265", p.VideoCodec)
+	}
+	if !contains(encoderSpeeds, p.Speed) {
+		return fmt.Errorf("wrong encoder speed %q", p.Speed)
+	}
+	if p.Width < 0 || p.Height < 0 || (p.Width == 0) != (p.Height == 0) || p.Width%2 != 0 || p.Height%2 != 0 {
+		return fmt.Errorf("width and height must be even, or both 0 to keep the size of the source")
+	}
+	if p.Width > 3840 || p.Height > 2160 {
+		return fmt.Errorf("the size can not be bigger than 3840x2160")
+	}
+	if p.Fps < 1 || p.Fps > 60 {
+		return fmt.Errorf("fps must be between 1 and 60")
+	}
+	if p.VideoBitrate < 100 || p.VideoBitrate > 50000 {
+		return fmt.Errorf("video bitrate must be between 100 and 50000 kbps")
+	}
+	if p.Keyframe < 0.5 || p.Keyframe > 10 {
+		return fmt.Errorf("keyframe interval must be between 0.5 and 10 seconds")
+	}
+	if p.AudioBitrate < 32 || p.AudioBitrate > 512 {
+		return fmt.Errorf("audio bitrate must be between 32 and 512 kbps")
+	}
+	if p.SampleRate != 44100 && p.SampleRate != 48000 {
+		return fmt.Errorf("sample rate must be 44100 or 48000")
+	}
+	if p.Channels != 1 && p.Channels != 2 {
+		return fmt.Errorf("audio channels must be 1 or 2")
+	}
+	return nil
+}
+
+// config returns the ffmpeg output options that encode with the profile.
+func (p Profile) config() []string {
+	gop := int(math.Round(float64(p.Fps) * p.Keyframe))
+	config := []string{
+		"-vcodec", p.VideoCodec,
+		"-preset", p.Speed,
+		"-r", strconv.Itoa(p.Fps),
+		"-bf", "0",
+		"-g", strconv.Itoa(gop),
+		"-vb", fmt.Sprintf("%dk", p.VideoBitrate),
+	}
+	if p.VideoProfile != "" {
+		config = append(config, "-vprofile", p.VideoProfile)
+	}
+	if p.Level != "" {
+		config = append(config, "-level", p.Level)
+	}
+	if p.Width > 0 {
+		config = append(config, "-s", fmt.Sprintf("%dx%d", p.Width, p.Height))
+	}
+	return append(config,
+		"-pix_fmt", "yuv420p",
+		"-acodec", "aac",
+		"-ab", fmt.Sprintf("%dk", p.AudioBitrate),
+		"-ar", strconv.Itoa(p.SampleRate),
+		"-ac", strconv.Itoa(p.Channels),
+	)
+}
+
+// hevc tells if the profile can not be sent in flv, it needs an mpegts output.
+func (p Profile) hevc() bool {
+	return p.VideoCodec == "libx265"
+}
+
+// localPath returns where a video transcoded with the profile is kept, the
+// videos of the default profile stay in the storage as before.
+func (p Profile) localPath(storage string, name string) string {
+	if p.Id == DefaultProfile.Id || p.Id == "" {
+		return filepath.Join(storage, name)
+	}
+	dir := filepath.Join(storage, p.Id)
+	os.MkdirAll(dir, 0755)
+	return filepath.Join(dir, name)
+}
+
+// Profiles keeps the builtin profiles and the ones created through the API.
+// The videos transcoded with a profile are kept under storage.
+type Profiles struct {
+	profiles []*Profile
+	storage  string
+	lock     *sync.Mutex
+}
+
+func NewProfiles(storage string) *Profiles {
+	ps := &Profiles{profiles: []*Profile{}, storage: storage, lock: &sync.Mutex{}}
+	for i := range builtinProfiles {
+		p := builtinProfiles[i]
+		ps.profiles = append(ps.profiles, &p)
+	}
+	return ps
+}
+
+// RestoreProfiles adds the stored profiles to the builtin ones, a stored
+// profile that is no longer valid is dropped.
+func RestoreProfiles(storage string, profiles []Profile) *Profiles {
+	ps := NewProfiles(storage)
+	for i := range profiles {
+		p := profiles[i]
+		if p.Builtin || p.Validate() != nil {
+			lerr.Printf("Profiles: dropping profile %s", p.Id)
+			continue
+		}
+		ps.profiles = append(ps.profiles, &p)
+	}
+	return ps
+}
+
+// Snapshot returns the profiles created through the API.
+func (ps *Profiles) Snapshot() []Profile {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	profiles := []Profile{}
+	for _, p := range ps.profiles {
+		if !p.Builtin {
+			profiles = append(profiles, *p)
+		}
+	}
+	return profiles
+}
+
+func (ps *Profiles) List() []Profile {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	profiles := []Profile{}
+	for _, p := range ps.profiles {
+		profiles = append(profiles, *p)
+	}
+	sort.SliceStable(profiles, func(i, j int) bool {
+		return profiles[i].Builtin && !profiles[j].Builtin
+	})
+	return profiles
+}
+
+func (ps *Profiles) get(id string) *Profile {
+	for _, p := range ps.profiles {
+		if p.Id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func (ps *Profiles) Get(id string) (Profile, error) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if p := ps.get(id); p != nil {
+		return *p, nil
+	}
+	return Profile{}, fmt.Errorf("profile %s not found", id)
+}
+
+func (ps *Profiles) Add(p Profile) (Profile, error) {
+	p.Id = uuid.New().String()
+	p.Builtin = false
+	if err := p.Validate(); err != nil {
+		return p, err
+	}
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	ps.profiles = append(ps.profiles, &p)
+	return p, nil
+}
+
+// Update replaces a profile created through the API, the builtin profiles
+// can not be changed.
+func (ps *Profiles) Update(p Profile) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	old := ps.get(p.Id)
+	if old == nil {
+		return fmt.Errorf("profile %s not found", p.Id)
+	}
+	if old.Builtin {
+		return fmt.Errorf("profile %s can not be changed", p.Id)
+	}
+	p.Builtin = false
+	// The videos transcoded before are not played with another encoding
+	if encoding(*old) != encoding(p) {
+		ps.purge(p.Id)
+	}
+	*old = p
+	return nil
+}
+
+func (ps *Profiles) Remove(id string) error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	for i, p := range ps.profiles {
+		if p.Id == id {
+			if p.Builtin {
+				return fmt.Errorf("profile %s can not be removed", id)
+			}
+			ps.profiles = append(ps.profiles[:i], ps.profiles[i+1:]...)
+			ps.purge(id)
+			return nil
+		}
+	}
+	return fmt.Errorf("profile %s not found", id)
+}
+
+// encoding returns the profile without what does not change its videos.
+func encoding(p Profile) Profile {
+	p.Name, p.Builtin = "", false
+	return p
+}
+
+// purge removes the videos transcoded with a profile.
+func (ps *Profiles) purge(id string) {
+	if id == DefaultProfile.Id || id == "" {
+		return
+	}
+	if err := os.RemoveAll(filepath.Join(ps.storage, id)); err != nil {
+		lerr.Printf("Profiles: unable to remove the videos of %s: %v", id, err)
+	}
+}
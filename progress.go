@@ -0,0 +1,112 @@
+package saovivo
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Progress is a report of ffmpeg given through -progress.
+type Progress struct {
+	Frame   int64   `json:"frame"`
+	Fps     float64 `json:"fps"`
+	Bitrate string  `json:"bitrate"`
+	OutTime float64 `json:"outTime"` // Seconds transcoded
+	Speed   float64 `json:"speed"`   // Times the real time
+	End     bool    `json:"end"`
+}
+
+// progressParser reads the key=value lines written by ffmpeg, a report ends
+// with the progress key.
+type progressParser struct {
+	pending []byte
+	current Progress
+	report  func(Progress)
+}
+
+func (p *progressParser) Write(b []byte) (int, error) {
+	p.pending = append(p.pending, b...)
+	for {
+		i := bytes.IndexByte(p.pending, '\n')
+		if i < 0 {
+			break
+		}
+		p.line(strings.TrimSpace(string(p.pending[:i])))
+		p.pending = p.pending[i+1:]
+	}
+	return len(b), nil
+}
+
+func (p *progressParser) line(line string) {
+	key, value, found := strings.Cut(line, "=")
+	if !found {
+		return
+	}
+	switch key {
+	case "frame":
+		p.current.Frame, _ = strconv.ParseInt(value, 10, 64)
+	case "fps":
+		p.current.Fps, _ = strconv.ParseFloat(value, 64)
+	case "bitrate":
+		p.current.Bitrate = value
+	case "out_time_us":
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil {
+			p.current.OutTime = float64(us) / 1000000
+		}
+	case "speed":
+		p.current.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+	case "progress":
+		p.current.End = value == "end"
+		p.report(p.current)
+	}
+}
+
+// ProgressEvent is sent to the subscribers of a ProgressHub.
+type ProgressEvent struct {
+	Kind  string `json:"kind"`            // ingest or upload
+	Id    string `json:"id"`              // File of the transcode or name of the upload
+	Asset string `json:"asset,omitempty"` // Set by who knows the asset of the file
+	IngestState
+}
+
+// ProgressHub pushes the progress of the transcodes to its subscribers, a
+// subscriber that does not keep up loses events.
+type ProgressHub struct {
+	subscribers map[chan ProgressEvent]bool
+	lock        *sync.Mutex
+}
+
+func NewProgressHub() *ProgressHub {
+	return &ProgressHub{subscribers: make(map[chan ProgressEvent]bool), lock: &sync.Mutex{}}
+}
+
+// Subscribe returns the events and the function to stop receiving them.
+func (h *ProgressHub) Subscribe() (<-chan ProgressEvent, func()) {
+	ch := make(chan ProgressEvent, 64)
+	h.lock.Lock()
+	h.subscribers[ch] = true
+	h.lock.Unlock()
+	return ch, func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		if h.subscribers[ch] {
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (h *ProgressHub) publish(e ProgressEvent) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package saovivo
+
+import (
+	"fmt"
+	"time"
+)
+
+type ReconnectPolicy struct {
+	MaxAttempts int     `json:"maxAttempts"` // 0 never reconnects
+	Backoff     float64 `json:"backoff"`     // Seconds before the first attempt, doubled on every attempt
+	MaxBackoff  float64 `json:"maxBackoff"`  // Seconds
+	Resume      bool    `json:"resume"`      // Resume the asset in play where it was, instead of starting it again
+}
+
+var DefaultReconnectPolicy = ReconnectPolicy{MaxAttempts: 5, Backoff: 2, MaxBackoff: 60, Resume: true}
+
+func (p ReconnectPolicy) Validate() error {
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("maxAttempts can not be negative")
+	}
+	if p.Backoff < 0 || p.MaxBackoff < p.Backoff {
+		return fmt.Errorf("backoff must be positive and not greater than maxBackoff")
+	}
+	return nil
+}
+
+// delay returns the time to wait before an attempt, starting at 1.
+func (p ReconnectPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return time.Duration(d * float64(time.Second))
+}
@@ -0,0 +1,105 @@
+package saovivo
+
+import (
+	"fmt"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// The kinds of remote source the ingest reads.
+const (
+	sourceFile = "file" // A media file read as it is
+	sourceHls  = "hls"  // A playlist of segments
+	sourceDash = "dash" // A manifest of segments
+)
+
+// remoteKind tells what a remote url is from the content type it is served
+// with, or from its extension when the server does not tell, as it happens
+// with the objects of S3.
+func remoteKind(uri string) (string, string) {
+	contentType, err := getContentType(uri)
+	if err == nil {
+		media, _, _ := mime.ParseMediaType(contentType)
+		switch strings.ToLower(media) {
+		case "application/vnd.apple.mpegurl", "application/x-mpegurl", "audio/mpegurl", "audio/x-mpegurl":
+			return sourceHls, contentType
+		case "application/dash+xml":
+			return sourceDash, contentType
+		}
+	}
+	if u, err := url.Parse(uri); err == nil {
+		switch strings.ToLower(path.Ext(u.Path)) {
+		case ".m3u8", ".m3u":
+			return sourceHls, contentType
+		case ".mpd":
+			return sourceDash, contentType
+		}
+	}
+	return sourceFile, contentType
+}
+
+// remoteName returns a name for the asset of an url, the file without its
+// extension or the directory of a playlist with a generic name.
+func remoteName(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	dir, file := path.Split(strings.TrimSuffix(u.Path, "/"))
+	name := strings.TrimSuffix(file, path.Ext(file))
+	switch strings.ToLower(name) {
+	case "", "index", "master", "playlist", "manifest", "stream", "main":
+		if parent := path.Base(strings.TrimSuffix(dir, "/")); parent != "." && parent != "/" && parent != "" {
+			name = parent
+		} else if name == "" {
+			name = u.Host
+		}
+	}
+	if unescaped, err := url.PathUnescape(name); err == nil {
+		name = unescaped
+	}
+	return name
+}
+
+// probeRemote returns the asset of a media file, an HLS playlist or a DASH
+// manifest over http(s) or in S3, ffprobe reads it over the network to know
+// its duration and streams.
+func probeRemote(uri string) (*Asset, error) {
+	// ffmpeg reads many other protocols, file:// among them
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "s3":
+	default:
+		return nil, fmt.Errorf("unsupported url %s, only http, https and s3 are accepted", uri)
+	}
+	resolved, err := resolveRemote(uri)
+	if err != nil {
+		return nil, err
+	}
+	kind, _ := remoteKind(resolved)
+	probed, err := presignS3(resolved, s3Presign)
+	if err != nil {
+		return nil, err
+	}
+	info, err := Probe(probed)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %v", uri, err)
+	}
+	if info.Video == nil && info.Audio == nil {
+		return nil, fmt.Errorf("no audio or video stream in %s", uri)
+	}
+	if info.Duration < 1 {
+		if kind != sourceFile {
+			return nil, fmt.Errorf("%s has no end, add it as a live source", uri)
+		}
+		return nil, fmt.Errorf("unable to know the duration of %s", uri)
+	}
+	a := NewAsset(remoteName(uri), uri, fmt.Sprintf("%.2f", info.Duration))
+	a.AudioOnly = info.Video == nil
+	return a, nil
+}
@@ -0,0 +1,292 @@
+package saovivo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// uploadExpire is how long an unfinished upload is kept without receiving
+// data
+var uploadExpire = 24 * time.Hour
+
+var (
+	ErrUploadNotFound = errors.New("upload not found")
+	ErrUploadOffset   = errors.New("the offset does not match the received part")
+	ErrUploadChecksum = errors.New("the checksum does not match")
+	ErrUploadBusy     = errors.New("the upload is receiving another chunk")
+	ErrUploadSize     = errors.New("the chunk goes beyond the size of the upload")
+)
+
+// Upload is a file sent in chunks, an interrupted upload is resumed from the
+// offset received. The received part and its state are kept on disk, so it
+// survives a restart of the server.
+type Upload struct {
+	Id       string    `json:"id"`
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Offset   int64     `json:"offset"`
+	Checksum string    `json:"checksum,omitempty"` // sha256 of the whole file in hex
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+// Expires returns when the upload is dropped if it receives nothing more.
+func (u Upload) Expires() time.Time {
+	return u.Updated.Add(uploadExpire)
+}
+
+func (u Upload) state() IngestState {
+	s := IngestState{State: "uploading"}
+	if u.Size > 0 {
+		s.Progress = float64(u.Offset) / float64(u.Size)
+	}
+	return s
+}
+
+func (f *FileReceiver) partPath(id string) string {
+	return filepath.Join(f.partial, id+".part")
+}
+
+func (f *FileReceiver) uploadStore(id string) *Store {
+	return NewStore(filepath.Join(f.partial, id+".json"))
+}
+
+// restoreUploads loads the uploads that were not finished before a restart,
+// the received part is trusted over the stored offset.
+func (f *FileReceiver) restoreUploads() {
+	if f.partial == "" {
+		return
+	}
+	if err := os.MkdirAll(f.partial, os.ModePerm); err != nil {
+		lerr.Printf("FileReceiver: %v", err)
+		return
+	}
+	paths, _ := filepath.Glob(filepath.Join(f.partial, "*.json"))
+	for _, path := range paths {
+		id := strings.TrimSuffix(filepath.Base(path), ".json")
+		var u Upload
+		if err := f.uploadStore(id).Load(&u); err != nil {
+			lerr.Printf("FileReceiver: unable to restore upload %s: %v", id, err)
+			continue
+		}
+		info, err := os.Stat(f.partPath(id))
+		if err != nil {
+			f.dropUpload(id)
+			continue
+		}
+		u.Offset = info.Size()
+		f.resumable[id] = &u
+		f.uploads[u.Name] = &IngestState{State: "uploading", Progress: u.state().Progress}
+	}
+	f.expireUploads()
+}
+
+// dropUpload removes the files of an upload.
+func (f *FileReceiver) dropUpload(id string) {
+	os.Remove(f.partPath(id))
+	os.Remove(f.uploadStore(id).Path())
+}
+
+// expireUploads drops the uploads that stopped receiving data, must be called
+// with the lock held.
+func (f *FileReceiver) expireUploads() {
+	for id, u := range f.resumable {
+		if time.Now().After(u.Expires()) && !f.busy[id] {
+			lout.Printf("FileReceiver: upload of %s expired at %d of %d bytes", u.Name, u.Offset, u.Size)
+			delete(f.resumable, id)
+			delete(f.uploads, u.Name)
+			f.dropUpload(id)
+		}
+	}
+}
+
+// CreateUpload starts an upload of size bytes, checksum is the sha256 of the
+// whole file in hex and is verified when the last chunk arrives.
+func (f *FileReceiver) CreateUpload(name string, size int64, checksum string) (Upload, error) {
+	name = filepath.Base(name)
+	if name == "." || name == string(filepath.Separator) {
+		return Upload{}, fmt.Errorf("upload without file name")
+	}
+	if size <= 0 {
+		return Upload{}, fmt.Errorf("wrong upload size %d", size)
+	}
+	if checksum != "" {
+		if b, err := hex.DecodeString(checksum); err != nil || len(b) != sha256.Size {
+			return Upload{}, fmt.Errorf("the checksum must be a sha256 in hex")
+		}
+	}
+	u := Upload{Id: uuid.New().String(), Name: name, Size: size, Checksum: strings.ToLower(checksum), Created: time.Now(), Updated: time.Now()}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.expireUploads()
+	if err := os.MkdirAll(f.partial, os.ModePerm); err != nil {
+		return Upload{}, err
+	}
+	part, err := os.Create(f.partPath(u.Id))
+	if err != nil {
+		return Upload{}, err
+	}
+	part.Close()
+	if err := f.uploadStore(u.Id).Save(&u); err != nil {
+		f.dropUpload(u.Id)
+		return Upload{}, err
+	}
+	f.resumable[u.Id] = &u
+	f.uploads[name] = &IngestState{State: "uploading"}
+	lout.Printf("FileReceiver: upload of %s (%d bytes) created", name, size)
+	return u, nil
+}
+
+// Upload returns the state of an unfinished upload.
+func (f *FileReceiver) Upload(id string) (Upload, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	u, ok := f.resumable[id]
+	if !ok {
+		return Upload{}, ErrUploadNotFound
+	}
+	return *u, nil
+}
+
+// Uploads returns the unfinished uploads, the oldest first.
+func (f *FileReceiver) Uploads() []Upload {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	uploads := []Upload{}
+	for _, u := range f.resumable {
+		uploads = append(uploads, *u)
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].Created.Before(uploads[j].Created)
+	})
+	return uploads
+}
+
+// CancelUpload drops an unfinished upload with its received part.
+func (f *FileReceiver) CancelUpload(id string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	u, ok := f.resumable[id]
+	if !ok {
+		return ErrUploadNotFound
+	}
+	if f.busy[id] {
+		return ErrUploadBusy
+	}
+	delete(f.resumable, id)
+	delete(f.uploads, u.Name)
+	f.dropUpload(id)
+	lout.Printf("FileReceiver: upload of %s cancelled", u.Name)
+	return nil
+}
+
+// WriteChunk appends the chunk read from r at offset, which must be where
+// the received part ends. checksum is the sha256 of the chunk, a chunk that
+// does not match it is discarded. When the last chunk arrives the file is
+// handed to the job returned, which verifies it and keeps it as an uploaded
+// file.
+func (f *FileReceiver) WriteChunk(id string, offset int64, r io.Reader, checksum []byte) (Upload, *Job, error) {
+	f.lock.Lock()
+	u, ok := f.resumable[id]
+	if !ok {
+		f.lock.Unlock()
+		return Upload{}, nil, ErrUploadNotFound
+	}
+	if f.busy[id] {
+		f.lock.Unlock()
+		return *u, nil, ErrUploadBusy
+	}
+	if offset != u.Offset {
+		f.lock.Unlock()
+		return *u, nil, ErrUploadOffset
+	}
+	f.busy[id] = true
+	upload := *u
+	f.lock.Unlock()
+	defer func() {
+		f.lock.Lock()
+		delete(f.busy, id)
+		f.lock.Unlock()
+	}()
+
+	written, err := f.appendChunk(&upload, r, checksum)
+	f.lock.Lock()
+	upload.Offset += written
+	if written > 0 {
+		upload.Updated = time.Now()
+	}
+	*u = upload
+	f.lock.Unlock()
+	if written > 0 {
+		if e := f.uploadStore(id).Save(&upload); e != nil {
+			lerr.Printf("FileReceiver: unable to save upload %s: %v", id, e)
+		}
+		f.report(upload.Name, upload.state())
+	}
+	if err != nil || upload.Offset < upload.Size {
+		return upload, nil, err
+	}
+
+	job, err := f.finishUpload(upload)
+	if err != nil {
+		return upload, nil, err
+	}
+	return upload, &job, nil
+}
+
+// appendChunk writes the chunk at the end of the received part and returns
+// how much of it is kept, nothing when its checksum does not match. A chunk
+// cut by the connection is kept up to where it was cut.
+func (f *FileReceiver) appendChunk(u *Upload, r io.Reader, checksum []byte) (int64, error) {
+	part, err := os.OpenFile(f.partPath(u.Id), os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer part.Close()
+	if _, err := part.Seek(u.Offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	sum := sha256.New()
+	// One byte more to know if the chunk is too big
+	written, err := io.Copy(io.MultiWriter(part, sum), io.LimitReader(r, u.Size-u.Offset+1))
+	if err == nil && u.Offset+written > u.Size {
+		err = ErrUploadSize
+	}
+	if err == nil && checksum != nil && !bytes.Equal(sum.Sum(nil), checksum) {
+		err = ErrUploadChecksum
+	}
+	if err == ErrUploadSize || err == ErrUploadChecksum || (err != nil && checksum != nil) {
+		// A chunk with a checksum is kept whole or not at all
+		written = 0
+	}
+	if e := part.Truncate(u.Offset + written); e != nil && err == nil {
+		err = e
+	}
+	return written, err
+}
+
+// finishUpload hands the received file to a job, which verifies the
+// checksum of the whole file.
+func (f *FileReceiver) finishUpload(u Upload) (Job, error) {
+	// Next to the uploaded files, so it is moved instead of copied
+	path := filepath.Join(f.localpath, u.Id+".upload"+filepath.Ext(u.Name))
+	if err := os.Rename(f.partPath(u.Id), path); err != nil {
+		return Job{}, err
+	}
+	f.lock.Lock()
+	delete(f.resumable, u.Id)
+	f.lock.Unlock()
+	f.dropUpload(u.Id)
+	return f.submit(u.Name, path, u.Checksum), nil
+}
@@ -0,0 +1,524 @@
+package saovivo
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"sync"
+)
+
+// The messages of RTMP used by the server.
+const (
+	rtmpSetChunkSize     = 1
+	rtmpAbort            = 2
+	rtmpAck              = 3
+	rtmpUserControl      = 4
+	rtmpWindowAckSize    = 5
+	rtmpSetPeerBandwidth = 6
+	rtmpAudio            = 8
+	rtmpVideo            = 9
+	rtmpDataAMF3         = 15
+	rtmpCommandAMF3      = 17
+	rtmpDataAMF0         = 18
+	rtmpCommandAMF0      = 20
+)
+
+// The chunk streams the server writes on.
+const (
+	rtmpControlChunks = 2
+	rtmpCommandChunks = 3
+	rtmpAudioChunks   = 4
+	rtmpDataChunks    = 5
+	rtmpVideoChunks   = 6
+)
+
+const (
+	rtmpHandshakeSize = 1536
+	rtmpMaxMessage    = 16 << 20 // Larger messages close the connection
+	rtmpChunkSize     = 4096     // Of the chunks written by the server
+	rtmpWindow        = 2500000
+	rtmpChunkStreams  = 64       // Most chunk streams a peer can open
+	rtmpReadStep      = 64 << 10 // The buffer of a message grows by this
+	amfMaxDepth       = 32       // Of the objects and arrays nested
+)
+
+type rtmpMessage struct {
+	typ       byte
+	timestamp uint32
+	stream    uint32
+	data      []byte
+}
+
+// rtmpChunkStream is the state of a chunk stream read, the headers of the
+// chunks only carry what changes from the previous one.
+type rtmpChunkStream struct {
+	timestamp uint32
+	field     uint32 // Timestamp or delta of the last header
+	length    uint32
+	typ       byte
+	stream    uint32
+	extended  bool
+	buf       []byte
+}
+
+// rtmpConn reads and writes the chunks of an RTMP connection.
+type rtmpConn struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	w        *bufio.Writer
+	wlock    *sync.Mutex
+	inChunk  uint32
+	chunks   map[uint32]*rtmpChunkStream
+	read     uint32 // Bytes read since the last acknowledgement
+	window   uint32 // Of the acknowledgements asked by the peer
+	received uint32 // Bytes read
+}
+
+func newRtmpConn(conn net.Conn) *rtmpConn {
+	return &rtmpConn{
+		conn:    conn,
+		r:       bufio.NewReaderSize(conn, 64*1024),
+		w:       bufio.NewWriterSize(conn, 64*1024),
+		wlock:   &sync.Mutex{},
+		inChunk: 128,
+		chunks:  make(map[uint32]*rtmpChunkStream),
+	}
+}
+
+// handshake answers to the handshake of a client, the simple one without
+// digests that ffmpeg and the players accept.
+func (c *rtmpConn) handshake() error {
+	c0c1 := make([]byte, 1+rtmpHandshakeSize)
+	if _, err := io.ReadFull(c.r, c0c1); err != nil {
+		return err
+	}
+	if c0c1[0] != 3 {
+		return fmt.Errorf("unsupported rtmp version %d", c0c1[0])
+	}
+	s := make([]byte, 1+2*rtmpHandshakeSize)
+	s[0] = 3
+	// S1 is the time and zeros, then random bytes
+	rand.Read(s[9 : 1+rtmpHandshakeSize])
+	// S2 echoes C1
+	copy(s[1+rtmpHandshakeSize:], c0c1[1:])
+	if _, err := c.w.Write(s); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(c.r, make([]byte, rtmpHandshakeSize))
+	return err
+}
+
+func (c *rtmpConn) readFull(b []byte) error {
+	n, err := io.ReadFull(c.r, b)
+	c.read += uint32(n)
+	c.received += uint32(n)
+	return err
+}
+
+func readUint24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v>>16), byte(v>>8), byte(v)
+}
+
+// readMessage reads chunks until a message is complete, the control
+// messages of the protocol are handled here.
+func (c *rtmpConn) readMessage() (*rtmpMessage, error) {
+	for {
+		m, err := c.readChunk()
+		if err != nil {
+			return nil, err
+		}
+		if c.window > 0 && c.read >= c.window {
+			c.read = 0
+			ack := make([]byte, 4)
+			binary.BigEndian.PutUint32(ack, c.received)
+			if err := c.writeMessage(rtmpControlChunks, &rtmpMessage{typ: rtmpAck, data: ack}); err != nil {
+				return nil, err
+			}
+		}
+		if m == nil {
+			continue
+		}
+		switch m.typ {
+		case rtmpSetChunkSize:
+			if len(m.data) < 4 {
+				return nil, fmt.Errorf("wrong chunk size message")
+			}
+			size := binary.BigEndian.Uint32(m.data) & 0x7fffffff
+			if size < 1 || size > rtmpMaxMessage {
+				return nil, fmt.Errorf("wrong chunk size %d", size)
+			}
+			c.inChunk = size
+		case rtmpAbort:
+			if len(m.data) >= 4 {
+				if st, ok := c.chunks[binary.BigEndian.Uint32(m.data)]; ok {
+					st.buf = nil
+				}
+			}
+		case rtmpWindowAckSize:
+			if len(m.data) >= 4 {
+				c.window = binary.BigEndian.Uint32(m.data)
+			}
+		case rtmpAck, rtmpSetPeerBandwidth:
+		default:
+			return m, nil
+		}
+	}
+}
+
+// readChunk reads a chunk, it returns the message it completes or nil.
+func (c *rtmpConn) readChunk() (*rtmpMessage, error) {
+	var b [11]byte
+	if err := c.readFull(b[:1]); err != nil {
+		return nil, err
+	}
+	format := b[0] >> 6
+	id := uint32(b[0] & 0x3f)
+	switch id {
+	case 0:
+		if err := c.readFull(b[:1]); err != nil {
+			return nil, err
+		}
+		id = 64 + uint32(b[0])
+	case 1:
+		if err := c.readFull(b[:2]); err != nil {
+			return nil, err
+		}
+		id = 64 + uint32(b[0]) + uint32(b[1])*256
+	}
+	st, ok := c.chunks[id]
+	if !ok {
+		if format != 0 {
+			return nil, fmt.Errorf("chunk stream %d starts without a full header", id)
+		}
+		if len(c.chunks) >= rtmpChunkStreams {
+			return nil, fmt.Errorf("too many chunk streams")
+		}
+		st = &rtmpChunkStream{}
+		c.chunks[id] = st
+	}
+
+	sizes := [4]int{11, 7, 3, 0}
+	if err := c.readFull(b[:sizes[format]]); err != nil {
+		return nil, err
+	}
+	if format < 3 {
+		st.field = readUint24(b[:3])
+		st.extended = st.field == 0xffffff
+	}
+	if format < 2 {
+		st.length = readUint24(b[3:6])
+		st.typ = b[6]
+		if st.length > rtmpMaxMessage {
+			return nil, fmt.Errorf("message of %d bytes too large", st.length)
+		}
+	}
+	if format == 0 {
+		st.stream = binary.LittleEndian.Uint32(b[7:11])
+	}
+	if st.extended {
+		// Also repeated in the chunks that continue a message
+		if err := c.readFull(b[:4]); err != nil {
+			return nil, err
+		}
+		if format < 3 {
+			st.field = binary.BigEndian.Uint32(b[:4])
+		}
+	}
+	if len(st.buf) == 0 {
+		if format == 0 {
+			st.timestamp = st.field
+		} else {
+			st.timestamp += st.field
+		}
+	}
+
+	// The buffer grows as the data arrives, not as the length announced
+	n := st.length - uint32(len(st.buf))
+	if n > c.inChunk {
+		n = c.inChunk
+	}
+	for n > 0 {
+		step := n
+		if step > rtmpReadStep {
+			step = rtmpReadStep
+		}
+		start := len(st.buf)
+		st.buf = append(st.buf, make([]byte, step)...)
+		if err := c.readFull(st.buf[start:]); err != nil {
+			return nil, err
+		}
+		n -= step
+	}
+	if uint32(len(st.buf)) < st.length {
+		return nil, nil
+	}
+	m := &rtmpMessage{typ: st.typ, timestamp: st.timestamp, stream: st.stream, data: st.buf}
+	st.buf = nil
+	return m, nil
+}
+
+// writeMessage writes a message with a full header, in chunks of
+// rtmpChunkSize once it is announced.
+func (c *rtmpConn) writeMessage(id uint32, m *rtmpMessage) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	var h [16]byte
+	h[0] = byte(id)
+	extended := m.timestamp >= 0xffffff
+	if extended {
+		putUint24(h[1:4], 0xffffff)
+	} else {
+		putUint24(h[1:4], m.timestamp)
+	}
+	putUint24(h[4:7], uint32(len(m.data)))
+	h[7] = m.typ
+	binary.LittleEndian.PutUint32(h[8:12], m.stream)
+	n := 12
+	if extended {
+		binary.BigEndian.PutUint32(h[12:16], m.timestamp)
+		n = 16
+	}
+	if _, err := c.w.Write(h[:n]); err != nil {
+		return err
+	}
+	data := m.data
+	for {
+		size := len(data)
+		if size > rtmpChunkSize {
+			size = rtmpChunkSize
+		}
+		if _, err := c.w.Write(data[:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+		if len(data) == 0 {
+			break
+		}
+		h[0] = 0xc0 | byte(id)
+		c.w.WriteByte(h[0])
+		if extended {
+			c.w.Write(h[12:16])
+		}
+	}
+	return c.w.Flush()
+}
+
+func (c *rtmpConn) writeControl(typ byte, values ...uint32) error {
+	data := make([]byte, 0, 4*len(values))
+	for _, v := range values {
+		data = binary.BigEndian.AppendUint32(data, v)
+	}
+	if typ == rtmpSetPeerBandwidth {
+		// The limit type, dynamic
+		data = append(data, 2)
+	}
+	return c.writeMessage(rtmpControlChunks, &rtmpMessage{typ: typ, data: data})
+}
+
+func (c *rtmpConn) writeCommand(stream uint32, values ...interface{}) error {
+	return c.writeMessage(rtmpCommandChunks, &rtmpMessage{typ: rtmpCommandAMF0, stream: stream, data: amfEncode(values...)})
+}
+
+// amfObject is an AMF0 object that keeps the order of its properties when
+// it is written.
+type amfObject []amfProperty
+
+type amfProperty struct {
+	key   string
+	value interface{}
+}
+
+// The AMF0 markers
+const (
+	amfNumber      = 0
+	amfBoolean     = 1
+	amfString      = 2
+	amfObjectStart = 3
+	amfNull        = 5
+	amfUndefined   = 6
+	amfECMAArray   = 8
+	amfObjectEnd   = 9
+	amfStrictArray = 10
+	amfDate        = 11
+	amfLongString  = 12
+)
+
+func amfAppendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// amfEncode writes numbers, booleans, strings, objects and nulls.
+func amfEncode(values ...interface{}) []byte {
+	b := []byte{}
+	for _, v := range values {
+		b = amfAppend(b, v)
+	}
+	return b
+}
+
+func amfAppend(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case float64:
+		b = append(b, amfNumber)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(v))
+	case int:
+		return amfAppend(b, float64(v))
+	case uint32:
+		return amfAppend(b, float64(v))
+	case bool:
+		if v {
+			return append(b, amfBoolean, 1)
+		}
+		return append(b, amfBoolean, 0)
+	case string:
+		if len(v) > 0xffff {
+			b = append(b, amfLongString)
+			b = binary.BigEndian.AppendUint32(b, uint32(len(v)))
+			return append(b, v...)
+		}
+		return amfAppendString(append(b, amfString), v)
+	case amfObject:
+		b = append(b, amfObjectStart)
+		for _, p := range v {
+			b = amfAppendString(b, p.key)
+			b = amfAppend(b, p.value)
+		}
+		return append(b, 0, 0, amfObjectEnd)
+	case map[string]interface{}:
+		keys := []string{}
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		object := amfObject{}
+		for _, k := range keys {
+			object = append(object, amfProperty{k, v[k]})
+		}
+		return amfAppend(b, object)
+	default:
+		return append(b, amfNull)
+	}
+}
+
+// amfDecode reads the values of a command, the objects and the arrays are
+// maps and the values it does not know end the reading.
+func amfDecode(b []byte) ([]interface{}, error) {
+	values := []interface{}{}
+	for len(b) > 0 {
+		v, n, err := amfRead(b, 0)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+		b = b[n:]
+	}
+	return values, nil
+}
+
+func amfReadString(b []byte) (string, int, error) {
+	if len(b) < 2 {
+		return "", 0, io.ErrUnexpectedEOF
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", 0, io.ErrUnexpectedEOF
+	}
+	return string(b[2 : 2+n]), 2 + n, nil
+}
+
+func amfRead(b []byte, depth int) (interface{}, int, error) {
+	if len(b) == 0 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if depth > amfMaxDepth {
+		return nil, 0, fmt.Errorf("amf values nested too deep")
+	}
+	switch b[0] {
+	case amfNumber:
+		if len(b) < 9 {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b[1:9])), 9, nil
+	case amfBoolean:
+		if len(b) < 2 {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		return b[1] != 0, 2, nil
+	case amfString:
+		s, n, err := amfReadString(b[1:])
+		return s, 1 + n, err
+	case amfLongString:
+		if len(b) < 5 {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		n := int(binary.BigEndian.Uint32(b[1:5]))
+		if n < 0 || len(b) < 5+n {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		return string(b[5 : 5+n]), 5 + n, nil
+	case amfNull, amfUndefined:
+		return nil, 1, nil
+	case amfDate:
+		if len(b) < 11 {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b[1:9])), 11, nil
+	case amfObjectStart, amfECMAArray:
+		pos := 1
+		if b[0] == amfECMAArray {
+			// The count is only a hint
+			pos += 4
+		}
+		object := make(map[string]interface{})
+		for {
+			if len(b) < pos+3 {
+				return nil, 0, io.ErrUnexpectedEOF
+			}
+			if b[pos] == 0 && b[pos+1] == 0 && b[pos+2] == amfObjectEnd {
+				return object, pos + 3, nil
+			}
+			key, n, err := amfReadString(b[pos:])
+			if err != nil {
+				return nil, 0, err
+			}
+			pos += n
+			v, n, err := amfRead(b[pos:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			pos += n
+			object[key] = v
+		}
+	case amfStrictArray:
+		if len(b) < 5 {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		count := int(binary.BigEndian.Uint32(b[1:5]))
+		pos := 5
+		array := []interface{}{}
+		for i := 0; i < count; i++ {
+			v, n, err := amfRead(b[pos:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			pos += n
+			array = append(array, v)
+		}
+		return array, pos, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported amf0 marker %d", b[0])
+	}
+}
@@ -0,0 +1,414 @@
+package saovivo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rtmpChunk returns a chunk with a basic header of one byte.
+func rtmpChunk(format byte, id byte, header []byte, data []byte) []byte {
+	b := append([]byte{format<<6 | id}, header...)
+	return append(b, data...)
+}
+
+func rtmpHeader0(timestamp uint32, length uint32, typ byte, stream uint32) []byte {
+	h := make([]byte, 11)
+	putUint24(h[0:3], timestamp)
+	putUint24(h[3:6], length)
+	h[6] = typ
+	binary.LittleEndian.PutUint32(h[7:11], stream)
+	return h
+}
+
+func rtmpHeader1(delta uint32, length uint32, typ byte) []byte {
+	h := make([]byte, 7)
+	putUint24(h[0:3], delta)
+	putUint24(h[3:6], length)
+	h[6] = typ
+	return h
+}
+
+func rtmpHeader2(delta uint32) []byte {
+	h := make([]byte, 3)
+	putUint24(h, delta)
+	return h
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// readerConn reads the chunks of data, it can not write.
+func readerConn(data []byte) *rtmpConn {
+	c := newRtmpConn(nil)
+	c.r = bufio.NewReader(bytes.NewReader(data))
+	return c
+}
+
+// readMessages reads messages until an error, io.EOF at the end of data.
+func readMessages(c *rtmpConn) ([]*rtmpMessage, error) {
+	messages := []*rtmpMessage{}
+	for {
+		m, err := c.readMessage()
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, m)
+	}
+}
+
+func TestRtmpReadChunks(t *testing.T) {
+	long := bytes.Repeat([]byte{'x'}, 200)
+	chunkSize := make([]byte, 4)
+	binary.BigEndian.PutUint32(chunkSize, 200)
+	tooLarge := make([]byte, 4)
+	binary.BigEndian.PutUint32(tooLarge, rtmpMaxMessage+1)
+	tests := []struct {
+		name string
+		data []byte
+		want []rtmpMessage
+		err  string
+	}{
+		{
+			name: "format 0",
+			data: rtmpChunk(0, 3, rtmpHeader0(100, 3, rtmpCommandAMF0, 1), []byte("abc")),
+			want: []rtmpMessage{{typ: rtmpCommandAMF0, timestamp: 100, stream: 1, data: []byte("abc")}},
+		},
+		{
+			name: "format 1 keeps the stream",
+			data: join(
+				rtmpChunk(0, 3, rtmpHeader0(100, 3, rtmpCommandAMF0, 1), []byte("abc")),
+				rtmpChunk(1, 3, rtmpHeader1(10, 2, rtmpVideo), []byte("de")),
+			),
+			want: []rtmpMessage{
+				{typ: rtmpCommandAMF0, timestamp: 100, stream: 1, data: []byte("abc")},
+				{typ: rtmpVideo, timestamp: 110, stream: 1, data: []byte("de")},
+			},
+		},
+		{
+			name: "format 2 keeps the length and the type",
+			data: join(
+				rtmpChunk(0, 3, rtmpHeader0(100, 3, rtmpAudio, 1), []byte("abc")),
+				rtmpChunk(2, 3, rtmpHeader2(5), []byte("def")),
+			),
+			want: []rtmpMessage{
+				{typ: rtmpAudio, timestamp: 100, stream: 1, data: []byte("abc")},
+				{typ: rtmpAudio, timestamp: 105, stream: 1, data: []byte("def")},
+			},
+		},
+		{
+			name: "format 3 repeats the delta",
+			data: join(
+				rtmpChunk(0, 3, rtmpHeader0(100, 3, rtmpAudio, 1), []byte("abc")),
+				rtmpChunk(2, 3, rtmpHeader2(5), []byte("def")),
+				rtmpChunk(3, 3, nil, []byte("ghi")),
+			),
+			want: []rtmpMessage{
+				{typ: rtmpAudio, timestamp: 100, stream: 1, data: []byte("abc")},
+				{typ: rtmpAudio, timestamp: 105, stream: 1, data: []byte("def")},
+				{typ: rtmpAudio, timestamp: 110, stream: 1, data: []byte("ghi")},
+			},
+		},
+		{
+			name: "format 3 continues a message",
+			data: join(
+				rtmpChunk(0, 3, rtmpHeader0(100, 200, rtmpVideo, 1), long[:128]),
+				rtmpChunk(3, 3, nil, long[128:]),
+			),
+			want: []rtmpMessage{{typ: rtmpVideo, timestamp: 100, stream: 1, data: long}},
+		},
+		{
+			name: "extended timestamp",
+			data: rtmpChunk(0, 3, join(rtmpHeader0(0xffffff, 1, rtmpVideo, 1), []byte{1, 0, 0, 0}), []byte("a")),
+			want: []rtmpMessage{{typ: rtmpVideo, timestamp: 1 << 24, stream: 1, data: []byte("a")}},
+		},
+		{
+			name: "chunk stream id of two bytes",
+			data: join([]byte{0, 10}, rtmpHeader0(7, 1, rtmpVideo, 1), []byte("a")),
+			want: []rtmpMessage{{typ: rtmpVideo, timestamp: 7, stream: 1, data: []byte("a")}},
+		},
+		{
+			name: "set chunk size",
+			data: join(
+				rtmpChunk(0, 2, rtmpHeader0(0, 4, rtmpSetChunkSize, 0), chunkSize),
+				rtmpChunk(0, 3, rtmpHeader0(0, 200, rtmpVideo, 1), long),
+			),
+			want: []rtmpMessage{{typ: rtmpVideo, timestamp: 0, stream: 1, data: long}},
+		},
+		{
+			name: "format 3 at the start of a stream",
+			data: rtmpChunk(3, 4, nil, []byte("a")),
+			err:  "starts without a full header",
+		},
+		{
+			name: "format 1 at the start of a stream",
+			data: rtmpChunk(1, 4, rtmpHeader1(0, 1, rtmpVideo), []byte("a")),
+			err:  "starts without a full header",
+		},
+		{
+			name: "chunk size past the largest message",
+			data: rtmpChunk(0, 2, rtmpHeader0(0, 4, rtmpSetChunkSize, 0), tooLarge),
+			err:  "wrong chunk size",
+		},
+		{
+			name: "chunk size of 0",
+			data: rtmpChunk(0, 2, rtmpHeader0(0, 4, rtmpSetChunkSize, 0), []byte{0, 0, 0, 0}),
+			err:  "wrong chunk size",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages, err := readMessages(readerConn(tt.data))
+			if tt.err == "" && err != io.EOF {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+			if len(messages) != len(tt.want) {
+				t.Fatalf("%d messages, want %d", len(messages), len(tt.want))
+			}
+			for i, m := range messages {
+				w := tt.want[i]
+				if m.typ != w.typ || m.timestamp != w.timestamp || m.stream != w.stream || !bytes.Equal(m.data, w.data) {
+					t.Errorf("message %d is %d %d %d %q, want %d %d %d %q", i, m.typ, m.timestamp, m.stream, m.data, w.typ, w.timestamp, w.stream, w.data)
+				}
+			}
+		})
+	}
+}
+
+func TestRtmpChunkStreamsLimit(t *testing.T) {
+	data := []byte{}
+	for i := 0; i <= rtmpChunkStreams; i++ {
+		data = append(data, 0, byte(i))
+		data = append(data, rtmpHeader0(0, 0, rtmpVideo, 1)...)
+	}
+	messages, err := readMessages(readerConn(data))
+	if err == nil || !strings.Contains(err.Error(), "too many chunk streams") {
+		t.Fatalf("error %v, want too many chunk streams", err)
+	}
+	if len(messages) != rtmpChunkStreams {
+		t.Fatalf("%d messages, want %d", len(messages), rtmpChunkStreams)
+	}
+}
+
+func TestRtmpMessageGrowsWithChunks(t *testing.T) {
+	// The largest length of a header
+	data := rtmpChunk(0, 3, rtmpHeader0(0, 0xffffff, rtmpVideo, 1), make([]byte, 128))
+	c := readerConn(data)
+	m, err := c.readChunk()
+	if m != nil || err != nil {
+		t.Fatalf("got %v %v, want an incomplete message", m, err)
+	}
+	if buf := c.chunks[3].buf; len(buf) != 128 || cap(buf) > rtmpReadStep {
+		t.Fatalf("buffer of %d bytes and capacity %d after a chunk of 128", len(buf), cap(buf))
+	}
+	if _, err := c.readChunk(); err != io.EOF {
+		t.Fatalf("error %v at the end of the data, want EOF", err)
+	}
+}
+
+// amfNested returns depth objects one inside the other.
+func amfNested(depth int) interface{} {
+	var v interface{} = 1
+	for i := 0; i < depth; i++ {
+		v = amfObject{{"a", v}}
+	}
+	return v
+}
+
+func TestAmfDecode(t *testing.T) {
+	strictArrays := []byte{}
+	for i := 0; i <= amfMaxDepth; i++ {
+		strictArrays = append(strictArrays, amfStrictArray, 0, 0, 0, 1)
+	}
+	strictArrays = append(strictArrays, amfNull)
+	tests := []struct {
+		name   string
+		data   []byte
+		values int
+		err    string
+	}{
+		{name: "command", data: amfEncode("connect", 1, amfObject{{"app", "live"}}), values: 3},
+		{name: "objects at the depth limit", data: amfEncode(amfNested(amfMaxDepth)), values: 1},
+		{name: "objects past the depth limit", data: amfEncode(amfNested(amfMaxDepth + 1)), err: "too deep"},
+		{name: "arrays past the depth limit", data: strictArrays, err: "too deep"},
+		{name: "truncated string", data: []byte{amfString, 0, 5, 'a'}, err: io.ErrUnexpectedEOF.Error()},
+		{name: "unknown marker", data: []byte{0x7f}, err: "unsupported amf0 marker"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := amfDecode(tt.data)
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+			if tt.err == "" && len(values) != tt.values {
+				t.Fatalf("%d values, want %d", len(values), tt.values)
+			}
+		})
+	}
+	values, _ := amfDecode(amfEncode("connect", 1, amfObject{{"app", "live"}}))
+	if o, _ := values[2].(map[string]interface{}); values[0] != "connect" || values[1] != 1.0 || o["app"] != "live" {
+		t.Errorf("decoded %v", values)
+	}
+}
+
+func testRtmpServer() *RtmpServer {
+	return &RtmpServer{
+		key:       "secret",
+		authorize: func(token string) bool { return token == "good" },
+		streams:   make(map[string]*rtmpStream),
+		conns:     make(map[net.Conn]bool),
+		lock:      &sync.Mutex{},
+	}
+}
+
+// rtmpDial connects a client to the server over a pipe, the error the
+// server ends with is sent to the channel.
+func rtmpDial(t *testing.T, s *RtmpServer) (*rtmpConn, <-chan error) {
+	client, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.serve(newRtmpConn(server))
+		server.Close()
+	}()
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	c := newRtmpConn(client)
+	c0c1 := make([]byte, 1+rtmpHandshakeSize)
+	c0c1[0] = 3
+	if _, err := c.w.Write(c0c1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	s0s1s2 := make([]byte, 1+2*rtmpHandshakeSize)
+	if _, err := io.ReadFull(c.r, s0s1s2); err != nil {
+		t.Fatal(err)
+	}
+	if s0s1s2[0] != 3 || !bytes.Equal(s0s1s2[1+rtmpHandshakeSize:], c0c1[1:]) {
+		t.Fatal("wrong handshake of the server")
+	}
+	c.w.Write(s0s1s2[1 : 1+rtmpHandshakeSize])
+	if err := c.w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.writeControl(rtmpSetChunkSize, rtmpChunkSize); err != nil {
+		t.Fatal(err)
+	}
+	c.writeCommand(0, "connect", 1, amfObject{{"app", RtmpApp}})
+	rtmpExpect(t, c, "_result")
+	c.writeCommand(0, "createStream", 2, nil)
+	rtmpExpect(t, c, "_result")
+	return c, done
+}
+
+// rtmpExpect reads until a command and returns its values.
+func rtmpExpect(t *testing.T, c *rtmpConn, command string) []interface{} {
+	t.Helper()
+	for {
+		m, err := c.readMessage()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", command, err)
+		}
+		if m.typ != rtmpCommandAMF0 {
+			continue
+		}
+		values, _ := amfDecode(m.data)
+		if len(values) > 0 && values[0] == command {
+			return values
+		}
+	}
+}
+
+// rtmpStatusCode reads until an onStatus and returns its code.
+func rtmpStatusCode(t *testing.T, c *rtmpConn) string {
+	t.Helper()
+	values := rtmpExpect(t, c, "onStatus")
+	if len(values) < 4 {
+		t.Fatalf("onStatus without status: %v", values)
+	}
+	info, _ := values[3].(map[string]interface{})
+	code, _ := info["code"].(string)
+	return code
+}
+
+func TestRtmpPublishPlay(t *testing.T) {
+	s := testRtmpServer()
+	publisher, _ := rtmpDial(t, s)
+	publisher.writeCommand(1, "publish", 3, nil, "ch?key=secret", "live")
+	if code := rtmpStatusCode(t, publisher); code != "NetStream.Publish.Start" {
+		t.Fatalf("publish answered %s", code)
+	}
+	if !s.Published("ch") {
+		t.Fatal("ch not published")
+	}
+
+	player, _ := rtmpDial(t, s)
+	player.writeCommand(1, "play", 3, nil, "ch?token=good")
+	for _, want := range []string{"NetStream.Play.Reset", "NetStream.Play.Start"} {
+		if code := rtmpStatusCode(t, player); code != want {
+			t.Fatalf("play answered %s, want %s", code, want)
+		}
+	}
+
+	keyframe := []byte{0x17, 1, 0, 0, 0, 0xaa, 0xbb}
+	publisher.writeMessage(rtmpVideoChunks, &rtmpMessage{typ: rtmpVideo, timestamp: 40, stream: 1, data: keyframe})
+	for {
+		m, err := player.readMessage()
+		if err != nil {
+			t.Fatalf("waiting for the video: %v", err)
+		}
+		if m.typ == rtmpVideo {
+			if m.timestamp != 40 || !bytes.Equal(m.data, keyframe) {
+				t.Fatalf("played %d %x, want 40 %x", m.timestamp, m.data, keyframe)
+			}
+			break
+		}
+	}
+	if players := s.Players()["ch"]; players != 1 {
+		t.Fatalf("%d players, want 1", players)
+	}
+}
+
+func TestRtmpRefused(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		stream  string
+		code    string
+	}{
+		{name: "publish without the key", command: "publish", stream: "ch", code: "NetStream.Publish.BadName"},
+		{name: "publish with a wrong key", command: "publish", stream: "ch?key=wrong", code: "NetStream.Publish.BadName"},
+		{name: "play without a token", command: "play", stream: "ch", code: "NetStream.Play.Failed"},
+		{name: "play with a wrong token", command: "play", stream: "ch?token=bad", code: "NetStream.Play.Failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testRtmpServer()
+			c, done := rtmpDial(t, s)
+			c.writeCommand(1, tt.command, 3, nil, tt.stream)
+			if code := rtmpStatusCode(t, c); code != tt.code {
+				t.Fatalf("answered %s, want %s", code, tt.code)
+			}
+			if err := <-done; err == nil || !strings.Contains(err.Error(), "not allowed") {
+				t.Fatalf("server ended with %v", err)
+			}
+			if s.Published("ch") || s.Players()["ch"] != 0 {
+				t.Fatal("refused client was accepted")
+			}
+		})
+	}
+}
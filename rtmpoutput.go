@@ -1,76 +1,93 @@
 package saovivo
 
 import (
-	"io"
+	"fmt"
 	"net"
 	"time"
 )
 
+// RtmpOutput sends the mpegts stream produced by the Broadcast to a single
+// destination, every destination has its own ffmpeg so the failure of one of
+// them does not affect the others.
 type RtmpOutput struct {
-	Input  chan io.ReadCloser
+	Input  chan []byte
 	Output chan error
 	ffmpeg *FFMPEG
 }
 
-func NewRtmpOutput(rtmp string) (*RtmpOutput, error) {
-	var (
-		src RtmpOutput
-		srv *net.TCPListener
-		dst io.WriteCloser
-		err error
-	)
+func listenLocal() (*net.TCPListener, string, error) {
 	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
-	srv, err = net.ListenTCP("tcp4", addr)
+	srv, err := net.ListenTCP("tcp4", addr)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-
 	srv.SetDeadline(time.Now().Add(10 * time.Second))
-	tcp := "tcp://" + srv.Addr().String()
+	return srv, "tcp://" + srv.Addr().String(), nil
+}
+
+// NewRtmpOutput connects a destination, the stream is re-encoded with the
+// profile when it is not nil.
+func NewRtmpOutput(rtmp string, profile *Profile) (*RtmpOutput, error) {
+	return newOutput(rtmp, outputPreset(rtmp, profile))
+}
+
+// newOutput starts the ffmpeg that writes the stream to output with the
+// preset.
+func newOutput(rtmp string, preset Preset) (*RtmpOutput, error) {
+	var src RtmpOutput
+
+	srv, tcp, err := listenLocal()
+	if err != nil {
+		return nil, err
+	}
+	defer srv.Close()
 
-	ffmpeg := FFMPEGStream(tcp, rtmp, CopyPreset)
+	ffmpeg := FFMPEGStream(tcp, rtmp, preset)
 	src.ffmpeg = ffmpeg
 	ffmpeg.Run()
 
-	dst, err = srv.Accept()
+	dst, err := srv.Accept()
 	if err != nil {
+		ffmpeg.StopAndWait()
 		return nil, err
 	}
 
-	src.Input = make(chan io.ReadCloser)
-	src.Output = make(chan error)
+	src.Input = make(chan []byte, 256)
+	src.Output = make(chan error, 1)
 
 	go func() {
 		lout.Printf("RtmpOutput: Start, listen on: %s, sending to: %s", tcp, rtmp)
+		done := make(chan error, 1)
+		go func() {
+			done <- ffmpeg.Wait()
+		}()
 		for {
-			in := <-src.Input
-			if in == nil {
-				lout.Println("RtmpOutput: nothing to do, stoping")
-				ffmpeg.Stop()
-				e := <-ffmpeg.err
-				src.Output <- e
-				goto end_loop
-			}
-			for {
-				n, err := io.Copy(dst, in)
-				in.Close()
-				if err != nil && n != 0 {
-					//	select {
-					//	case e := <-ffmpeg.err:
-					//		src.Output <- e
-					//		goto end_loop
-					//	default:
-					//		src.Output <- nil
-					//		break
+			select {
+			case buf, ok := <-src.Input:
+				if !ok {
+					lout.Println("RtmpOutput: nothing to do, stoping")
+					dst.Close()
+					src.Output <- <-done
+					goto end_loop
+				}
+				if _, err := dst.Write(buf); err != nil {
 					lerr.Printf("RtmpOutput: send with error: %v", err)
-					e := <-ffmpeg.err
-					src.Output <- e
+					dst.Close()
+					ffmpeg.Stop()
+					if e := <-done; e != nil {
+						err = e
+					}
+					src.Output <- err
 					goto end_loop
-					//}
-				} else {
-					src.Output <- nil
-					break
 				}
+			case err := <-done:
+				dst.Close()
+				if err == nil {
+					err = fmt.Errorf("output finished unexpectedly")
+				}
+				lerr.Printf("RtmpOutput: ffmpeg ends with error: %v", err)
+				src.Output <- err
+				goto end_loop
 			}
 		}
 	end_loop:
@@ -0,0 +1,511 @@
+package saovivo
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RtmpDestination is the id of the output that publishes the channel to the
+// RtmpServer, it is reported with the rest of the destinations.
+const RtmpDestination = "rtmp"
+
+// RtmpApp is the application of the streams of the server,
+// rtmp://host/live/<channel>.
+const RtmpApp = "live"
+
+// rtmpQueue is how many messages a player can fall behind before it is
+// disconnected
+const rtmpQueue = 1024
+
+// rtmpGop is the most messages kept since the last keyframe for the players
+// that join
+const rtmpGop = 4096
+
+// RtmpServer lets the players pull the channels as RTMP or HTTP-FLV, every
+// channel publishes its stream to it as one more destination. Only who knows
+// the key of the server can publish, and only who has a token accepted by
+// authorize can play, with ?token= after the stream.
+type RtmpServer struct {
+	listener  net.Listener
+	key       string
+	authorize func(token string) bool // Every player plays when nil
+	streams   map[string]*rtmpStream
+	conns     map[net.Conn]bool
+	lock      *sync.Mutex
+}
+
+// rtmpStream is a stream published, what a player needs to start is kept
+// for the ones that join later.
+type rtmpStream struct {
+	publisher *rtmpConn
+	metadata  *rtmpMessage
+	video     *rtmpMessage // Sequence header of the codec
+	audio     *rtmpMessage
+	gop       []*rtmpMessage
+	players   map[*rtmpPlayer]bool
+}
+
+// rtmpPlayer receives the messages of a stream on its own goroutine, a
+// slow player does not delay the rest of them.
+type rtmpPlayer struct {
+	queue chan *rtmpMessage
+	once  *sync.Once
+	close func()
+}
+
+// stop ends the queue of the player, must be called with the lock of the
+// server held so nothing is sent to it after.
+func (p *rtmpPlayer) stop() {
+	p.once.Do(func() {
+		close(p.queue)
+		p.close()
+	})
+}
+
+// NewRtmpServer listens on addr, host:port, authorize tells if a token lets
+// play the streams.
+func NewRtmpServer(addr string, authorize func(token string) bool) (*RtmpServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 16)
+	rand.Read(key)
+	s := &RtmpServer{
+		listener:  listener,
+		key:       hex.EncodeToString(key),
+		authorize: authorize,
+		streams:   make(map[string]*rtmpStream),
+		conns:     make(map[net.Conn]bool),
+		lock:      &sync.Mutex{},
+	}
+	lout.Printf("RtmpServer: listen on %s", listener.Addr())
+	go s.accept()
+	return s, nil
+}
+
+// Port returns the port the server listens on.
+func (s *RtmpServer) Port() int {
+	if addr, ok := s.listener.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// PublishURL returns where a channel publishes its stream, with the key of
+// the server. The loopback is used when the server listens on every
+// interface.
+func (s *RtmpServer) PublishURL(stream string) string {
+	host := "127.0.0.1"
+	if addr, ok := s.listener.Addr().(*net.TCPAddr); ok && !addr.IP.IsUnspecified() {
+		host = addr.IP.String()
+	}
+	return fmt.Sprintf("rtmp://%s/%s/%s?key=%s", net.JoinHostPort(host, fmt.Sprint(s.Port())), RtmpApp, stream, s.key)
+}
+
+// Close stops listening and disconnects every publisher and player.
+func (s *RtmpServer) Close() error {
+	err := s.listener.Close()
+	s.lock.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	return err
+}
+
+func (s *RtmpServer) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			lout.Printf("RtmpServer: End %v", err)
+			return
+		}
+		s.lock.Lock()
+		s.conns[conn] = true
+		s.lock.Unlock()
+		go func() {
+			if err := s.serve(newRtmpConn(conn)); err != nil && err != io.EOF {
+				lerr.Printf("RtmpServer: %s: %v", conn.RemoteAddr(), err)
+			}
+			conn.Close()
+			s.lock.Lock()
+			delete(s.conns, conn)
+			s.lock.Unlock()
+		}()
+	}
+}
+
+// streamName returns the stream of a publish or play command and the
+// parameters after it, the key or the token.
+func streamName(name string) (string, url.Values) {
+	name, query, _ := strings.Cut(name, "?")
+	values, _ := url.ParseQuery(query)
+	return name, values
+}
+
+func rtmpStatus(level string, code string, description string) amfObject {
+	return amfObject{{"level", level}, {"code", code}, {"description", description}}
+}
+
+// serve answers to the commands of a client, a publisher sends its stream
+// and a player receives it.
+func (s *RtmpServer) serve(c *rtmpConn) error {
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := c.handshake(); err != nil {
+		return err
+	}
+	var (
+		app       string
+		published string
+	)
+	defer func() {
+		if published != "" {
+			s.unpublish(published, c)
+		}
+	}()
+	for {
+		c.conn.SetDeadline(time.Now().Add(30 * time.Second))
+		m, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+		switch m.typ {
+		case rtmpAudio, rtmpVideo, rtmpDataAMF0:
+			if published != "" {
+				s.send(published, m)
+			}
+			continue
+		case rtmpCommandAMF3:
+			if len(m.data) > 0 {
+				m.data = m.data[1:]
+			}
+		case rtmpCommandAMF0:
+		default:
+			continue
+		}
+
+		values, err := amfDecode(m.data)
+		if len(values) < 2 {
+			return fmt.Errorf("wrong command: %v", err)
+		}
+		command, _ := values[0].(string)
+		tx, _ := values[1].(float64)
+		switch command {
+		case "connect":
+			if len(values) > 2 {
+				if o, ok := values[2].(map[string]interface{}); ok {
+					app, _ = o["app"].(string)
+				}
+			}
+			app = strings.Trim(app, "/")
+			if i := strings.Index(app, "?"); i >= 0 {
+				app = app[:i]
+			}
+			if app != RtmpApp {
+				c.writeCommand(0, "_error", tx, nil, rtmpStatus("error", "NetConnection.Connect.Rejected", "unknown application "+app))
+				return fmt.Errorf("unknown application %q", app)
+			}
+			c.writeControl(rtmpWindowAckSize, rtmpWindow)
+			c.writeControl(rtmpSetPeerBandwidth, rtmpWindow)
+			c.writeControl(rtmpSetChunkSize, rtmpChunkSize)
+			result := rtmpStatus("status", "NetConnection.Connect.Success", "Connection succeeded.")
+			result = append(result, amfProperty{"objectEncoding", 0})
+			if err := c.writeCommand(0, "_result", tx, amfObject{{"fmsVer", "FMS/3,0,1,123"}, {"capabilities", 31}}, result); err != nil {
+				return err
+			}
+		case "createStream":
+			if err := c.writeCommand(0, "_result", tx, nil, 1); err != nil {
+				return err
+			}
+		case "publish":
+			name := ""
+			if len(values) > 3 {
+				name, _ = values[3].(string)
+			}
+			stream, query := streamName(name)
+			if query.Get("key") != s.key || stream == "" || published != "" {
+				c.writeCommand(m.stream, "onStatus", 0, nil, rtmpStatus("error", "NetStream.Publish.BadName", "not allowed to publish "+stream))
+				return fmt.Errorf("not allowed to publish %q", stream)
+			}
+			s.publish(stream, c)
+			published = stream
+			lout.Printf("RtmpServer: publish %s from %s", stream, c.conn.RemoteAddr())
+			if err := c.writeCommand(m.stream, "onStatus", 0, nil, rtmpStatus("status", "NetStream.Publish.Start", stream+" is now published.")); err != nil {
+				return err
+			}
+		case "play":
+			name := ""
+			if len(values) > 3 {
+				name, _ = values[3].(string)
+			}
+			stream, query := streamName(name)
+			if s.authorize != nil && !s.authorize(query.Get("token")) {
+				c.writeCommand(m.stream, "onStatus", 0, nil, rtmpStatus("error", "NetStream.Play.Failed", "not allowed to play "+stream))
+				return fmt.Errorf("not allowed to play %q", stream)
+			}
+			return s.play(c, m.stream, stream)
+		case "deleteStream", "closeStream", "FCUnpublish":
+			if published != "" {
+				s.unpublish(published, c)
+				published = ""
+			}
+		}
+	}
+}
+
+func (s *RtmpServer) stream(name string) *rtmpStream {
+	st, ok := s.streams[name]
+	if !ok {
+		st = &rtmpStream{players: make(map[*rtmpPlayer]bool)}
+		s.streams[name] = st
+	}
+	return st
+}
+
+// publish takes a stream for a publisher, a new publisher of the same stream
+// replaces the one that did not leave yet.
+func (s *RtmpServer) publish(name string, c *rtmpConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	st := s.stream(name)
+	if st.publisher != nil && st.publisher != c {
+		st.publisher.conn.Close()
+	}
+	st.publisher = c
+	st.metadata, st.video, st.audio, st.gop = nil, nil, nil, nil
+}
+
+func (s *RtmpServer) unpublish(name string, c *rtmpConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	st, ok := s.streams[name]
+	if !ok || st.publisher != c {
+		return
+	}
+	lout.Printf("RtmpServer: unpublish %s", name)
+	st.publisher = nil
+	st.gop = nil
+	if len(st.players) == 0 {
+		delete(s.streams, name)
+	}
+}
+
+// isKeyframe tells if a video message starts a group of pictures.
+func isKeyframe(m *rtmpMessage) bool {
+	return m.typ == rtmpVideo && len(m.data) > 0 && m.data[0]>>4 == 1
+}
+
+// isSequenceHeader tells if a message has the configuration of the codec
+// that the decoder needs before the frames.
+func isSequenceHeader(m *rtmpMessage) bool {
+	if len(m.data) < 2 {
+		return false
+	}
+	switch m.typ {
+	case rtmpVideo:
+		// AVC and HEVC
+		codec := m.data[0] & 0x0f
+		return (codec == 7 || codec == 12) && m.data[1] == 0
+	case rtmpAudio:
+		// AAC
+		return m.data[0]>>4 == 10 && m.data[1] == 0
+	}
+	return false
+}
+
+// metadata removes the @setDataFrame of the publisher, the players receive
+// the onMetaData alone.
+func metadata(m *rtmpMessage) *rtmpMessage {
+	if len(m.data) < 3 || m.data[0] != amfString {
+		return m
+	}
+	n := int(binary.BigEndian.Uint16(m.data[1:3]))
+	if len(m.data) < 3+n || string(m.data[3:3+n]) != "@setDataFrame" {
+		return m
+	}
+	return &rtmpMessage{typ: m.typ, timestamp: m.timestamp, stream: m.stream, data: m.data[3+n:]}
+}
+
+// send delivers a message of the publisher to the players and keeps what the
+// players that join need.
+func (s *RtmpServer) send(name string, m *rtmpMessage) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	st, ok := s.streams[name]
+	if !ok {
+		return
+	}
+	switch {
+	case m.typ == rtmpDataAMF0:
+		m = metadata(m)
+		st.metadata = m
+	case isSequenceHeader(m):
+		if m.typ == rtmpVideo {
+			st.video = m
+		} else {
+			st.audio = m
+		}
+	case isKeyframe(m):
+		st.gop = []*rtmpMessage{m}
+	case st.gop != nil:
+		if len(st.gop) < rtmpGop {
+			st.gop = append(st.gop, m)
+		} else {
+			// Too long, the players that join wait for the next keyframe
+			st.gop = nil
+		}
+	}
+	for p := range st.players {
+		select {
+		case p.queue <- m:
+		default:
+			lerr.Printf("RtmpServer: player of %s stalled", name)
+			delete(st.players, p)
+			p.stop()
+		}
+	}
+}
+
+// join adds a player to a stream, it receives first what it needs to start
+// decoding.
+func (s *RtmpServer) join(name string, close func()) *rtmpPlayer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	st := s.stream(name)
+	p := &rtmpPlayer{queue: make(chan *rtmpMessage, rtmpQueue+rtmpGop+3), once: &sync.Once{}, close: close}
+	for _, m := range []*rtmpMessage{st.metadata, st.video, st.audio} {
+		if m != nil {
+			p.queue <- m
+		}
+	}
+	for _, m := range st.gop {
+		p.queue <- m
+	}
+	st.players[p] = true
+	return p
+}
+
+// leave removes a player from a stream and stops it.
+func (s *RtmpServer) leave(name string, p *rtmpPlayer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	p.stop()
+	st, ok := s.streams[name]
+	if !ok {
+		return
+	}
+	delete(st.players, p)
+	if len(st.players) == 0 && st.publisher == nil {
+		delete(s.streams, name)
+	}
+}
+
+// play sends a stream to an RTMP player until it disconnects.
+func (s *RtmpServer) play(c *rtmpConn, stream uint32, name string) error {
+	if name == "" {
+		c.writeCommand(stream, "onStatus", 0, nil, rtmpStatus("error", "NetStream.Play.StreamNotFound", "no stream"))
+		return fmt.Errorf("play without stream")
+	}
+	lout.Printf("RtmpServer: play %s to %s", name, c.conn.RemoteAddr())
+	// StreamBegin
+	begin := []byte{0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(begin[2:], stream)
+	c.writeMessage(rtmpControlChunks, &rtmpMessage{typ: rtmpUserControl, data: begin})
+	c.writeCommand(stream, "onStatus", 0, nil, rtmpStatus("status", "NetStream.Play.Reset", "Playing and resetting "+name+"."))
+	if err := c.writeCommand(stream, "onStatus", 0, nil, rtmpStatus("status", "NetStream.Play.Start", "Started playing "+name+".")); err != nil {
+		return err
+	}
+	c.writeMessage(rtmpDataChunks, &rtmpMessage{typ: rtmpDataAMF0, stream: stream, data: amfEncode("|RtmpSampleAccess", true, true)})
+
+	p := s.join(name, func() { c.conn.Close() })
+	defer s.leave(name, p)
+	// The commands of the player are read and ignored until it leaves
+	c.conn.SetDeadline(time.Time{})
+	go func() {
+		for {
+			if _, err := c.readMessage(); err != nil {
+				s.leave(name, p)
+				return
+			}
+		}
+	}()
+	for m := range p.queue {
+		id := uint32(rtmpVideoChunks)
+		switch m.typ {
+		case rtmpAudio:
+			id = rtmpAudioChunks
+		case rtmpDataAMF0:
+			id = rtmpDataChunks
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+		if err := c.writeMessage(id, &rtmpMessage{typ: m.typ, timestamp: m.timestamp, stream: stream, data: m.data}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteFLV sends a stream as HTTP-FLV until done is closed or w fails.
+func (s *RtmpServer) WriteFLV(w io.Writer, name string, done <-chan struct{}) error {
+	stopped := make(chan struct{})
+	p := s.join(name, func() { close(stopped) })
+	defer s.leave(name, p)
+	go func() {
+		select {
+		case <-done:
+			s.leave(name, p)
+		case <-stopped:
+		}
+	}()
+
+	// Header with audio and video, and the size of no previous tag
+	if _, err := w.Write([]byte{'F', 'L', 'V', 1, 5, 0, 0, 0, 9, 0, 0, 0, 0}); err != nil {
+		return err
+	}
+	tag := make([]byte, 11)
+	size := make([]byte, 4)
+	for m := range p.queue {
+		tag[0] = m.typ
+		putUint24(tag[1:4], uint32(len(m.data)))
+		putUint24(tag[4:7], m.timestamp&0xffffff)
+		tag[7] = byte(m.timestamp >> 24)
+		binary.BigEndian.PutUint32(size, uint32(11+len(m.data)))
+		for _, b := range [][]byte{tag, m.data, size} {
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Players returns how many players receive each stream.
+func (s *RtmpServer) Players() map[string]int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	players := make(map[string]int)
+	for name, st := range s.streams {
+		players[name] = len(st.players)
+	}
+	return players
+}
+
+// Published tells if a channel is publishing its stream.
+func (s *RtmpServer) Published(name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	st, ok := s.streams[name]
+	return ok && st.publisher != nil
+}
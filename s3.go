@@ -0,0 +1,217 @@
+package saovivo
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config is where the s3:// urls are read from, without keys the objects
+// must be public.
+type S3Config struct {
+	Endpoint     string // Of an S3 compatible server, empty for AWS
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// S3 is used by every s3:// source, it is set once at start.
+var S3 = S3Config{Region: "us-east-1"}
+
+// s3Presign is how long the url given to ffprobe is valid
+const s3Presign = time.Hour
+
+func isS3(uri string) bool {
+	return strings.HasPrefix(uri, "s3://")
+}
+
+// isRemote tells if a source is read over the network.
+func isRemote(uri string) bool {
+	return strings.HasPrefix(uri, "http") || isS3(uri)
+}
+
+// host returns the host of the server of the objects, empty when it is not
+// known.
+func (c S3Config) host() string {
+	if c.Endpoint != "" {
+		if u, err := url.Parse(c.Endpoint); err == nil && u.Host != "" {
+			return u.Host
+		}
+		return ""
+	}
+	return "s3." + c.Region + ".amazonaws.com"
+}
+
+// resolveS3 returns the https url of an s3://bucket/key object, a custom
+// endpoint is addressed with the bucket in the path.
+func resolveS3(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return "", fmt.Errorf("the s3 url must be s3://bucket/key")
+	}
+	if S3.Endpoint != "" {
+		endpoint, err := url.Parse(S3.Endpoint)
+		if err != nil {
+			return "", fmt.Errorf("wrong s3 endpoint: %v", err)
+		}
+		endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + u.Host + u.Path
+		endpoint.RawPath = s3Escape(endpoint.Path, true)
+		return endpoint.String(), nil
+	}
+	return (&url.URL{Scheme: "https", Host: u.Host + "." + S3.host(), Path: u.Path, RawPath: s3Escape(u.Path, true)}).String(), nil
+}
+
+// resolveRemote returns the url a remote source is read from.
+func resolveRemote(uri string) (string, error) {
+	if isS3(uri) {
+		return resolveS3(uri)
+	}
+	return uri, nil
+}
+
+// isS3Host tells if the requests to host are signed with the keys.
+func isS3Host(host string) bool {
+	if S3.AccessKey == "" {
+		return false
+	}
+	s3 := S3.host()
+	return s3 != "" && (host == s3 || strings.HasSuffix(host, "."+s3))
+}
+
+// s3Escape encodes as AWS Signature Version 4 expects, every byte but the
+// unreserved characters.
+func s3Escape(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3Query(query url.Values) string {
+	keys := []string{}
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Signature signs a request with AWS Signature Version 4, headers are the
+// signed ones with lowercase names.
+func s3Signature(method string, u *url.URL, query url.Values, headers map[string]string, payload string, now time.Time) (string, string) {
+	names := []string{}
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders += k + ":" + strings.TrimSpace(headers[k]) + "\n"
+	}
+	signed := strings.Join(names, ";")
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{method, s3Escape(path, true), s3Query(query), canonicalHeaders, signed, payload}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+
+	date := now.Format("20060102")
+	scope := date + "/" + S3.Region + "/s3/aws4_request"
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", now.Format("20060102T150405Z"), scope, hex.EncodeToString(sum[:])}, "\n")
+	key := hmacSHA256([]byte("AWS4"+S3.SecretKey), date)
+	key = hmacSHA256(key, S3.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign)), signed
+}
+
+// presignS3 returns a url that lets a GET read the object for expires, for
+// ffprobe and ffmpeg which can not sign their requests.
+func presignS3(uri string, expires time.Duration) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if !isS3Host(u.Host) {
+		return uri, nil
+	}
+	now := time.Now().UTC()
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", S3.AccessKey+"/"+now.Format("20060102")+"/"+S3.Region+"/s3/aws4_request")
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if S3.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", S3.SessionToken)
+	}
+	signature, _ := s3Signature("GET", u, query, map[string]string{"host": u.Host}, "UNSIGNED-PAYLOAD", now)
+	query.Set("X-Amz-Signature", signature)
+	u.RawQuery = s3Query(query)
+	return u.String(), nil
+}
+
+// s3Transport signs the requests to the server of the objects, the rest are
+// sent as they are.
+type s3Transport struct {
+	base http.RoundTripper
+}
+
+func (t *s3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isS3Host(req.URL.Host) || req.URL.Query().Get("X-Amz-Signature") != "" {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	now := time.Now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": "UNSIGNED-PAYLOAD",
+		"x-amz-date":           req.Header.Get("X-Amz-Date"),
+	}
+	if S3.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", S3.SessionToken)
+		headers["x-amz-security-token"] = S3.SessionToken
+	}
+	signature, signed := s3Signature(req.Method, req.URL, req.URL.Query(), headers, "UNSIGNED-PAYLOAD", now)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s/%s/s3/aws4_request, SignedHeaders=%s, Signature=%s",
+		S3.AccessKey, now.Format("20060102"), S3.Region, signed, signature))
+	return t.base.RoundTrip(req)
+}
+
+// remoteClient reads the remote sources, the objects of S3 with the keys
+// configured.
+var remoteClient = &http.Client{Transport: &s3Transport{base: http.DefaultTransport}}
@@ -0,0 +1,175 @@
+package saovivo
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	HardCut = "hard" // Interrupts the asset in play at the start time
+	SoftCut = "soft" // Waits for the asset in play to finish
+)
+
+type ScheduleEntry struct {
+	Id    string    `json:"id"`
+	Start time.Time `json:"start"`
+	Cut   string    `json:"cut"`
+	State string    `json:"state"` // pending, playing, done, missed or failed
+	Asset *Asset    `json:"asset"`
+}
+
+type StoredScheduleEntry struct {
+	ScheduleEntry
+	Asset StoredAsset `json:"asset"`
+}
+
+// Schedule keeps the assets pinned to a wall-clock start time, the playlist
+// fills the gaps between them.
+type Schedule struct {
+	entries []*ScheduleEntry
+}
+
+// keepFinished is how long the finished entries are kept in the schedule
+var keepFinished = 24 * time.Hour
+
+func NewSchedule() *Schedule {
+	return &Schedule{entries: []*ScheduleEntry{}}
+}
+
+func RestoreSchedule(entries []StoredScheduleEntry) *Schedule {
+	s := NewSchedule()
+	for i := range entries {
+		e := entries[i].ScheduleEntry
+		e.Asset = entries[i].Asset.restore()
+		if e.State == "playing" {
+			e.State = "pending"
+		}
+		s.entries = append(s.entries, &e)
+	}
+	s.sort()
+	return s
+}
+
+func (s *Schedule) Snapshot() []StoredScheduleEntry {
+	entries := []StoredScheduleEntry{}
+	for _, e := range s.entries {
+		entries = append(entries, StoredScheduleEntry{ScheduleEntry: *e, Asset: storeAsset(e.Asset)})
+	}
+	return entries
+}
+
+func validCut(cut string) bool {
+	return cut == HardCut || cut == SoftCut
+}
+
+func (s *Schedule) sort() {
+	sort.SliceStable(s.entries, func(i, j int) bool {
+		return s.entries[i].Start.Before(s.entries[j].Start)
+	})
+}
+
+func (s *Schedule) Add(start time.Time, asset *Asset, cut string) (*ScheduleEntry, error) {
+	if !validCut(cut) {
+		return nil, fmt.Errorf("wrong cut %q, must be hard or soft", cut)
+	}
+	e := &ScheduleEntry{Id: uuid.New().String(), Start: start, Cut: cut, State: "pending", Asset: asset}
+	s.entries = append(s.entries, e)
+	s.sort()
+	return e, nil
+}
+
+func (s *Schedule) Get(id string) *ScheduleEntry {
+	for _, e := range s.entries {
+		if e.Id == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// Update changes the start time or the cut of an entry, a finished entry is
+// scheduled again when it gets a new start time.
+func (s *Schedule) Update(id string, start *time.Time, cut *string) error {
+	e := s.Get(id)
+	if e == nil {
+		return fmt.Errorf("schedule entry %s not found", id)
+	}
+	if e.State == "playing" {
+		return fmt.Errorf("schedule entry %s is playing", id)
+	}
+	if cut != nil {
+		if !validCut(*cut) {
+			return fmt.Errorf("wrong cut %q, must be hard or soft", *cut)
+		}
+		e.Cut = *cut
+	}
+	if start != nil {
+		e.Start = *start
+		e.State = "pending"
+		s.sort()
+	}
+	return nil
+}
+
+func (s *Schedule) Remove(id string) bool {
+	for i, e := range s.entries {
+		if e.Id == id {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schedule) List() []*ScheduleEntry {
+	return append([]*ScheduleEntry{}, s.entries...)
+}
+
+func (e *ScheduleEntry) end() time.Time {
+	d, err := strconv.ParseFloat(e.Asset.Duration, 64)
+	if err != nil {
+		return e.Start
+	}
+	return e.Start.Add(time.Duration(d * float64(time.Second)))
+}
+
+// Due returns the first pending entry whose start time has arrived, the
+// entries that should have ended by now are marked as missed. Finished
+// entries older than a day are dropped.
+func (s *Schedule) Due(now time.Time) *ScheduleEntry {
+	entries := s.entries[:0]
+	for _, e := range s.entries {
+		if e.State != "pending" && e.State != "playing" && now.Sub(e.end()) > keepFinished {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	s.entries = entries
+
+	for _, e := range s.entries {
+		if e.State != "pending" || e.Start.After(now) {
+			continue
+		}
+		if e.end().After(e.Start) && now.After(e.end()) {
+			e.State = "missed"
+			continue
+		}
+		return e
+	}
+	return nil
+}
+
+// Next returns the first pending entry starting after now, when hard is true
+// only the entries that interrupt the asset in play are considered.
+func (s *Schedule) Next(now time.Time, hard bool) *ScheduleEntry {
+	for _, e := range s.entries {
+		if e.State == "pending" && e.Start.After(now) && (!hard || e.Cut == HardCut) {
+			return e
+		}
+	}
+	return nil
+}
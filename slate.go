@@ -0,0 +1,50 @@
+package saovivo
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"strconv"
+)
+
+// SaveSlate stores the image shown under the assets that only have audio, a
+// PNG or JPEG image is kept as PNG.
+func SaveSlate(path string, r io.Reader) error {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return fmt.Errorf("the slate is not a png or jpeg image: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	return replaceFile(path, buf.Bytes())
+}
+
+// slateInput returns the input of the slate, a black frame of the size of
+// the profile when there is no image.
+func slateInput(p Profile, slate string) []string {
+	fps := strconv.Itoa(p.Fps)
+	if _, err := os.Stat(slate); err == nil {
+		return []string{"-loop", "1", "-framerate", fps, "-i", slate}
+	}
+	size := "1280x720"
+	if p.Width > 0 {
+		size = fmt.Sprintf("%dx%d", p.Width, p.Height)
+	}
+	return []string{"-f", "lavfi", "-i", "color=c=black:s=" + size + ":r=" + fps}
+}
+
+// sourceOptions returns the extra inputs and the maps of a transcode. slate
+// is empty for a video, an audio is shown over it and ends with the audio.
+func sourceOptions(p Profile, slate string) ([]string, []string) {
+	if slate == "" {
+		return []string{}, []string{"-map", "0:v", "-map", "0:a?"}
+	}
+	maps := []string{"-map", "1:v", "-map", "0:a", "-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2", "-shortest"}
+	return slateInput(p, slate), maps
+}
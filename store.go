@@ -0,0 +1,63 @@
+package saovivo
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type Store struct {
+	path string
+	lock *sync.Mutex
+}
+
+func NewStore(path string) *Store {
+	return &Store{path: path, lock: &sync.Mutex{}}
+}
+
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Save writes v as json, the file is replaced atomically so a crash in the
+// middle of a write never leaves a truncated state behind.
+func (s *Store) Save(v any) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Load reads the stored json into v, when nothing was saved yet it returns an
+// error that satisfies os.IsNotExist.
+func (s *Store) Load(v any) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,70 @@
+package saovivo
+
+import (
+	"fmt"
+)
+
+const (
+	CutTransition   = "cut"   // The next video starts right away
+	BlackTransition = "black" // Black screen and silence before the video
+	FadeTransition  = "fade"  // The video fades in from black and fades out to black
+)
+
+// Transition is applied in continuous playout before and around an asset.
+type Transition struct {
+	Kind     string  `json:"kind"`
+	Duration float64 `json:"duration"` // Seconds
+}
+
+func (t Transition) Validate() error {
+	switch t.Kind {
+	case "", CutTransition:
+		return nil
+	case BlackTransition, FadeTransition:
+		if t.Duration <= 0 || t.Duration > 10 {
+			return fmt.Errorf("transition duration must be between 0 and 10 seconds")
+		}
+		return nil
+	}
+	return fmt.Errorf("wrong transition %q, must be cut, black or fade", t.Kind)
+}
+
+var blackInput = "anullsrc=r=44100:cl=stereo"
+
+// blackPreset generates seconds of black screen and silence, of the size and
+// frame rate of the profile.
+func blackPreset(seconds float64, profile Profile) Preset {
+	flags := append([]string{"-re"}, slateInput(profile, "")...)
+	flags = append(flags, "-f", "lavfi")
+	config := []string{"-t", fmt.Sprintf("%.3f", seconds)}
+	config = append(config, profile.config()...)
+	config = append(config, "-f", "mpegts")
+	return Preset{flags: flags, config: config}
+}
+
+// transitionFilters returns the video and audio filters of a fade, empty for
+// the rest of the transitions.
+func transitionFilters(t Transition, duration float64) (string, string) {
+	if t.Kind != FadeTransition || t.Duration <= 0 {
+		return "", ""
+	}
+	video := fmt.Sprintf("fade=t=in:st=0:d=%.3f", t.Duration)
+	audio := fmt.Sprintf("afade=t=in:st=0:d=%.3f", t.Duration)
+	if duration > 2*t.Duration {
+		video += fmt.Sprintf(",fade=t=out:st=%.3f:d=%.3f", duration-t.Duration, t.Duration)
+		audio += fmt.Sprintf(",afade=t=out:st=%.3f:d=%.3f", duration-t.Duration, t.Duration)
+	}
+	return video, audio
+}
+
+// transitionPreset paces a video, re-encoding it when it has to fade.
+func transitionPreset(t Transition, duration float64, profile Profile) Preset {
+	video, audio := transitionFilters(t, duration)
+	if video == "" {
+		return PacePreset
+	}
+	config := []string{"-vf", video, "-af", audio}
+	config = append(config, profile.config()...)
+	config = append(config, "-f", "mpegts")
+	return Preset{flags: []string{"-re"}, config: config}
+}
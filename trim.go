@@ -0,0 +1,384 @@
+package saovivo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxSegments is the most segments an asset can be trimmed to
+const maxSegments = 50
+
+// tsTimestampMask keeps the 33 bits of the mpegts timestamps
+const tsTimestampMask = 1<<33 - 1
+
+// Timecode is a position in seconds, it is read from a number or from a
+// string as [hh:]mm:ss[.fff].
+type Timecode float64
+
+func (t *Timecode) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) != nil {
+		var f float64
+		if err := json.Unmarshal(data, &f); err != nil {
+			return fmt.Errorf("wrong timecode %s", data)
+		}
+		*t = Timecode(f)
+		return nil
+	}
+	f, err := parseTimecode(s)
+	if err != nil {
+		return err
+	}
+	*t = Timecode(f)
+	return nil
+}
+
+// parseTimecode returns the seconds of [hh:]mm:ss[.fff], or of a number of
+// seconds.
+func parseTimecode(s string) (float64, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("wrong timecode %q", s)
+	}
+	seconds := 0.0
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil || v < 0 || (i > 0 && v >= 60) {
+			return 0, fmt.Errorf("wrong timecode %q", s)
+		}
+		if i < len(parts)-1 && v != float64(int(v)) {
+			return 0, fmt.Errorf("wrong timecode %q", s)
+		}
+		seconds = seconds*60 + v
+	}
+	return seconds, nil
+}
+
+// Segment is a part of the source of an asset, from In to Out seconds of the
+// source. An Out of 0 plays to the end.
+type Segment struct {
+	In  Timecode `json:"in"`
+	Out Timecode `json:"out,omitempty"`
+}
+
+// validSegments checks that the segments are in order, do not overlap and
+// start inside the source, duration is 0 when it is unknown.
+func validSegments(segments []Segment, duration float64) error {
+	if len(segments) > maxSegments {
+		return fmt.Errorf("at most %d segments", maxSegments)
+	}
+	end := Timecode(0)
+	for i, s := range segments {
+		switch {
+		case s.In < 0 || s.Out < 0:
+			return fmt.Errorf("segment %d: negative timecode", i+1)
+		case s.In < end:
+			return fmt.Errorf("segment %d: starts before the end of the previous one", i+1)
+		case s.Out == 0 && i < len(segments)-1:
+			return fmt.Errorf("segment %d: only the last segment can play to the end", i+1)
+		case s.Out != 0 && s.Out <= s.In:
+			return fmt.Errorf("segment %d: ends before it starts", i+1)
+		case duration > 0 && float64(s.In) >= duration:
+			return fmt.Errorf("segment %d: starts after the end of the video", i+1)
+		case duration > 0 && float64(s.Out) > duration:
+			return fmt.Errorf("segment %d: ends after the end of the video", i+1)
+		}
+		end = s.Out
+	}
+	return nil
+}
+
+// segmentsDuration returns the seconds the segments play, false when the
+// last one plays to the end of a source of unknown duration.
+func segmentsDuration(segments []Segment, duration float64) (float64, bool) {
+	total := 0.0
+	for _, s := range segments {
+		out := float64(s.Out)
+		if out == 0 {
+			if duration <= 0 {
+				return 0, false
+			}
+			out = duration
+		}
+		total += out - float64(s.In)
+	}
+	return total, true
+}
+
+// trimAfter returns what is left of the segments after playing elapsed
+// seconds of them.
+func trimAfter(segments []Segment, elapsed float64) []Segment {
+	left := []Segment{}
+	for _, s := range segments {
+		if elapsed > 0 {
+			if s.Out != 0 && float64(s.Out-s.In) <= elapsed {
+				elapsed -= float64(s.Out - s.In)
+				continue
+			}
+			s.In += Timecode(elapsed)
+			elapsed = 0
+		}
+		left = append(left, s)
+	}
+	return left
+}
+
+// Trim plays only the segments of the source of the asset, with none it is
+// played whole again. The duration of the asset becomes the one of the
+// segments.
+func (a *Asset) Trim(segments []Segment) error {
+	if a.Live != nil {
+		return fmt.Errorf("a live source can not be trimmed")
+	}
+	source := a.Duration
+	if len(a.Segments) > 0 {
+		source = a.SourceDuration
+	}
+	duration, _ := strconv.ParseFloat(source, 64)
+	if err := validSegments(segments, duration); err != nil {
+		return err
+	}
+	if len(segments) == 0 {
+		a.Segments, a.SourceDuration, a.Duration = nil, "", source
+		return nil
+	}
+	a.Segments, a.SourceDuration, a.Duration = segments, source, ""
+	if d, ok := segmentsDuration(segments, duration); ok {
+		a.Duration = fmt.Sprintf("%.2f", d)
+	}
+	return nil
+}
+
+// readTimestamp decodes the 33 bits of a PTS or DTS of a PES header.
+func readTimestamp(b []byte) int64 {
+	return int64(b[0]&0x0e)<<29 | int64(b[1])<<22 | int64(b[2]&0xfe)<<14 | int64(b[3])<<7 | int64(b[4])>>1
+}
+
+// putTimestamp encodes a PTS or DTS keeping the prefix of the first byte.
+func putTimestamp(b []byte, ts int64) {
+	ts &= tsTimestampMask
+	b[0] = b[0]&0xf0 | byte(ts>>29)&0x0e | 1
+	b[1] = byte(ts >> 22)
+	b[2] = byte(ts>>14)&0xfe | 1
+	b[3] = byte(ts >> 7)
+	b[4] = byte(ts<<1) | 1
+}
+
+// trimReader passes only the segments of an mpegts stream, the timestamps
+// are shifted so every segment follows the previous one without a gap. A
+// segment starts at the first keyframe from its in point and ends at the
+// first frame from its out point.
+type trimReader struct {
+	src      io.ReadCloser
+	segments []Segment
+	drain    bool // Keep reading the source when closed before its end
+	once     *sync.Once
+	packet   []byte
+	pending  []byte
+	keep     map[uint16]bool // Of the PES in course of every stream
+	cc       map[uint16]byte // Continuity counters of the packets passed
+	video    bool            // There is a video stream, it decides the cuts
+	base     int64           // First timestamp of the source, -1 until seen
+	inside   bool
+	start    int64 // Of the segment in course, in ticks since the base
+	shift    int64 // Subtracted from the timestamps of the segment
+	played   int64 // Ticks of the segments ended
+	ended    bool  // After the last segment
+	eof      bool  // The source was read to the end
+}
+
+// newTrimReader plays the segments of src, drain keeps reading what is left
+// of src when it is closed so its writer is not stopped.
+func newTrimReader(src io.ReadCloser, segments []Segment, drain bool) *trimReader {
+	return &trimReader{
+		src:      src,
+		segments: segments,
+		drain:    drain,
+		once:     &sync.Once{},
+		packet:   make([]byte, tsPacketSize),
+		keep:     make(map[uint16]bool),
+		cc:       make(map[uint16]byte),
+		base:     -1,
+		ended:    len(segments) == 0,
+	}
+}
+
+func (r *trimReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.ended {
+			return 0, io.EOF
+		}
+		if _, err := io.ReadFull(r.src, r.packet); err != nil {
+			r.eof = true
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		if r.packet[0] != 0x47 {
+			return 0, fmt.Errorf("lost the sync of the mpegts stream")
+		}
+		if r.filter(r.packet) {
+			r.pending = r.packet
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// filter tells if a packet is passed, its timestamps and continuity counter
+// are rewritten then.
+func (r *trimReader) filter(p []byte) bool {
+	pid := uint16(p[1]&0x1f)<<8 | uint16(p[2])
+	afc := (p[3] >> 4) & 0x03
+	if afc&0x02 != 0 && int(p[4])+1 > tsPacketSize-4 {
+		return false
+	}
+	keep, pes := r.keep[pid]
+	if payload := pesStart(p); payload != nil {
+		pes = true
+		keep = r.decide(p, payload)
+		r.keep[pid] = keep
+		if keep {
+			r.shiftPES(payload)
+		}
+	}
+	if pes && !keep {
+		return false
+	}
+	r.shiftPCR(p)
+	if afc&0x01 != 0 {
+		p[3] = p[3]&0xf0 | r.cc[pid]
+		r.cc[pid] = (r.cc[pid] + 1) & 0x0f
+	}
+	return true
+}
+
+// pesStart returns the payload of a packet that starts a PES, nil for the
+// rest of the packets.
+func pesStart(p []byte) []byte {
+	afc := (p[3] >> 4) & 0x03
+	if p[1]&0x40 == 0 || afc&0x01 == 0 {
+		return nil
+	}
+	payload := p[4:]
+	if afc&0x02 != 0 {
+		if int(p[4])+1 > len(payload) {
+			return nil
+		}
+		payload = payload[int(p[4])+1:]
+	}
+	if len(payload) < 9 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+		return nil
+	}
+	return payload
+}
+
+// pesTimestamp returns the DTS of a PES header, or its PTS when it has no
+// DTS, false when it has none.
+func pesTimestamp(payload []byte) (int64, bool) {
+	if payload[7]&0x80 == 0 || len(payload) < 14 {
+		return 0, false
+	}
+	if payload[7]&0xc0 == 0xc0 && len(payload) >= 19 {
+		return readTimestamp(payload[14:19]), true
+	}
+	return readTimestamp(payload[9:14]), true
+}
+
+// randomAccess tells if the adaptation field of a packet marks a frame that
+// can be decoded alone.
+func randomAccess(p []byte) bool {
+	return p[3]&0x20 != 0 && p[4] > 0 && p[5]&0x40 != 0
+}
+
+// decide tells if a PES is passed, the video frames, or the audio ones when
+// there is no video, start and end the segments.
+func (r *trimReader) decide(p []byte, payload []byte) bool {
+	ts, ok := pesTimestamp(payload)
+	if !ok {
+		return r.inside
+	}
+	if r.base < 0 {
+		r.base = ts
+	}
+	t := (ts - r.base) & tsTimestampMask
+	video := payload[3]&0xf0 == 0xe0
+	r.video = r.video || video
+	if r.video && !video {
+		out := r.segments[0].Out
+		return r.inside && t >= r.start && (out == 0 || t < ticks(out))
+	}
+	if r.inside && r.segments[0].Out != 0 && t >= ticks(r.segments[0].Out) {
+		r.played += t - r.start
+		r.inside = false
+		r.segments = r.segments[1:]
+		if len(r.segments) == 0 {
+			r.ended = true
+			return false
+		}
+	}
+	// A random access point, every audio frame is one
+	key := !video || randomAccess(p)
+	if !r.inside && key && t >= ticks(r.segments[0].In) {
+		r.inside = true
+		r.start = t
+		r.shift = t - r.played
+	}
+	return r.inside
+}
+
+// ticks returns a timecode in the 90kHz clock of the mpegts timestamps.
+func ticks(t Timecode) int64 {
+	return int64(float64(t) * 90000)
+}
+
+// shiftPES moves the PTS and the DTS of a PES header to the segment.
+func (r *trimReader) shiftPES(payload []byte) {
+	flags := payload[7] & 0xc0
+	if flags&0x80 != 0 && len(payload) >= 14 {
+		putTimestamp(payload[9:14], readTimestamp(payload[9:14])-r.shift)
+	}
+	if flags == 0xc0 && len(payload) >= 19 {
+		putTimestamp(payload[14:19], readTimestamp(payload[14:19])-r.shift)
+	}
+}
+
+// shiftPCR moves the clock reference of an adaptation field to the segment.
+func (r *trimReader) shiftPCR(p []byte) {
+	if (p[3]>>4)&0x02 == 0 || p[4] < 7 || p[5]&0x10 == 0 {
+		return
+	}
+	pcr := int64(p[6])<<25 | int64(p[7])<<17 | int64(p[8])<<9 | int64(p[9])<<1 | int64(p[10])>>7
+	pcr = (pcr - r.shift) & tsTimestampMask
+	p[6] = byte(pcr >> 25)
+	p[7] = byte(pcr >> 17)
+	p[8] = byte(pcr >> 9)
+	p[9] = byte(pcr >> 1)
+	p[10] = byte(pcr<<7) | p[10]&0x7f
+}
+
+// stopped tells if the segments ended before the source.
+func (r *trimReader) stopped() bool {
+	return r.ended && !r.eof
+}
+
+func (r *trimReader) Close() error {
+	var err error
+	r.once.Do(func() {
+		if r.drain && r.stopped() {
+			go func() {
+				io.Copy(io.Discard, r.src)
+				r.src.Close()
+			}()
+			return
+		}
+		err = r.src.Close()
+	})
+	return err
+}
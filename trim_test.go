@@ -0,0 +1,305 @@
+package saovivo
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestTimestampRoundTrip(t *testing.T) {
+	for _, ts := range []int64{0, 1, 90000, 1 << 32, tsTimestampMask} {
+		for _, prefix := range []byte{0x20, 0x30, 0x10} {
+			b := []byte{prefix, 0, 0, 0, 0}
+			putTimestamp(b, ts)
+			if got := readTimestamp(b); got != ts {
+				t.Errorf("timestamp %d read as %d", ts, got)
+			}
+			if b[0]&0xf0 != prefix || b[0]&1 != 1 || b[2]&1 != 1 || b[4]&1 != 1 {
+				t.Errorf("timestamp %d with prefix %x lost its prefix or markers: %x", ts, prefix, b)
+			}
+		}
+	}
+	// Past the 33 bits it wraps
+	b := []byte{0x20, 0, 0, 0, 0}
+	putTimestamp(b, -90000)
+	if got := readTimestamp(b); got != tsTimestampMask+1-90000 {
+		t.Errorf("negative timestamp read as %d", got)
+	}
+}
+
+// The test streams start at these timestamps, the DTS of every video frame
+// is 3000 ticks before its PTS.
+const (
+	testBase     = 900000
+	testReorder  = 3000
+	testVideoPid = 0x100
+	testAudioPid = 0x101
+)
+
+// tsPacket returns a packet of pid with payload, the adaptation field
+// carries the random access flag, the pcr when it is not negative and the
+// stuffing.
+func tsPacket(pid uint16, start bool, key bool, pcr int64, payload []byte) []byte {
+	p := make([]byte, tsPacketSize)
+	p[0] = 0x47
+	p[1] = byte(pid>>8) & 0x1f
+	if start {
+		p[1] |= 0x40
+	}
+	p[2] = byte(pid)
+	if len(payload) == tsPacketSize-4 {
+		p[3] = 0x10
+		copy(p[4:], payload)
+		return p
+	}
+	p[3] = 0x30
+	p[4] = byte(tsPacketSize - 4 - 1 - len(payload))
+	for i := 5; i < tsPacketSize-len(payload); i++ {
+		p[i] = 0xff
+	}
+	p[5] = 0
+	if key {
+		p[5] |= 0x40
+	}
+	if pcr >= 0 {
+		p[5] |= 0x10
+		p[6], p[7], p[8], p[9] = byte(pcr>>25), byte(pcr>>17), byte(pcr>>9), byte(pcr>>1)
+		p[10] = byte(pcr<<7) | 0x7e
+		p[11] = 0
+	}
+	copy(p[tsPacketSize-len(payload):], payload)
+	return p
+}
+
+// pesHeader returns the header of a PES with a PTS, and a DTS when it is
+// not negative.
+func pesHeader(stream byte, pts int64, dts int64) []byte {
+	if dts < 0 {
+		h := []byte{0, 0, 1, stream, 0, 0, 0x80, 0x80, 5, 0x20, 0, 0, 0, 0}
+		putTimestamp(h[9:14], pts)
+		return h
+	}
+	h := []byte{0, 0, 1, stream, 0, 0, 0x80, 0xc0, 10, 0x30, 0, 0, 0, 0, 0x10, 0, 0, 0, 0}
+	putTimestamp(h[9:14], pts)
+	putTimestamp(h[14:19], dts)
+	return h
+}
+
+// testStream returns frames every half second for seconds, a video frame
+// is two packets and the keyframes are at every second. Without video the
+// frames are audio of one packet.
+func testStream(seconds float64, video bool) []byte {
+	stream := []byte{}
+	for t := 0.0; t < seconds; t += 0.5 {
+		ts := testBase + int64(t*90000)
+		if !video {
+			stream = append(stream, tsPacket(testAudioPid, true, false, -1, pesHeader(0xc0, ts, -1))...)
+			continue
+		}
+		key := t == float64(int(t))
+		stream = append(stream, tsPacket(testVideoPid, true, key, ts, pesHeader(0xe0, ts+testReorder, ts))...)
+		stream = append(stream, tsPacket(testVideoPid, false, false, -1, bytes.Repeat([]byte{0xab}, tsPacketSize-4))...)
+	}
+	return stream
+}
+
+// tsFrame is what is read back of a packet of the trimmed stream.
+type tsFrame struct {
+	pid   uint16
+	start bool
+	pts   int64
+	dts   int64
+	pcr   int64
+	cc    byte
+}
+
+func readFrames(t *testing.T, stream []byte) []tsFrame {
+	frames := []tsFrame{}
+	for len(stream) > 0 {
+		if len(stream) < tsPacketSize || stream[0] != 0x47 {
+			t.Fatalf("%d bytes out of sync", len(stream))
+		}
+		p := stream[:tsPacketSize]
+		stream = stream[tsPacketSize:]
+		f := tsFrame{pid: uint16(p[1]&0x1f)<<8 | uint16(p[2]), start: p[1]&0x40 != 0, pts: -1, dts: -1, pcr: -1, cc: p[3] & 0x0f}
+		payload := p[4:]
+		if p[3]&0x20 != 0 {
+			if p[4] >= 7 && p[5]&0x10 != 0 {
+				f.pcr = int64(p[6])<<25 | int64(p[7])<<17 | int64(p[8])<<9 | int64(p[9])<<1 | int64(p[10])>>7
+			}
+			payload = payload[1+int(p[4]):]
+		}
+		if f.start {
+			f.pts = readTimestamp(payload[9:14])
+			if payload[7]&0xc0 == 0xc0 {
+				f.dts = readTimestamp(payload[14:19])
+			}
+		}
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+func TestTrimReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		video    bool
+		segments []Segment
+		want     []float64 // Seconds of the PTS of the frames passed
+		stopped  bool
+	}{
+		{
+			name:     "segment edges between keyframes",
+			video:    true,
+			segments: []Segment{{In: 1.2, Out: 2.7}},
+			want:     []float64{0, 0.5},
+			stopped:  true,
+		},
+		{
+			name:     "segment on keyframes",
+			video:    true,
+			segments: []Segment{{In: 1, Out: 2}},
+			want:     []float64{0, 0.5},
+			stopped:  true,
+		},
+		{
+			name:     "segments follow each other",
+			video:    true,
+			segments: []Segment{{In: 0, Out: 1}, {In: 2, Out: 3}, {In: 4, Out: 4.5}},
+			want:     []float64{0, 0.5, 1, 1.5, 2},
+			stopped:  true,
+		},
+		{
+			name:     "last segment to the end",
+			video:    true,
+			segments: []Segment{{In: 0, Out: 1}, {In: 4}},
+			want:     []float64{0, 0.5, 1, 1.5},
+		},
+		{
+			name:     "audio only",
+			segments: []Segment{{In: 0.7, Out: 1.6}, {In: 3, Out: 3.5}},
+			want:     []float64{0, 0.5, 1},
+			stopped:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTrimReader(io.NopCloser(bytes.NewReader(testStream(5, tt.video))), tt.segments, false)
+			out, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.stopped() != tt.stopped {
+				t.Errorf("stopped %v, want %v", r.stopped(), tt.stopped)
+			}
+			got := []float64{}
+			for i, f := range readFrames(t, out) {
+				if f.cc != byte(i)&0x0f {
+					t.Errorf("packet %d with continuity counter %d", i, f.cc)
+				}
+				if !tt.video {
+					got = append(got, float64(f.pts-testBase)/90000)
+					continue
+				}
+				// Only whole frames are passed
+				if f.start != (i%2 == 0) {
+					t.Fatalf("packet %d starts a frame: %v", i, f.start)
+				}
+				if f.start {
+					got = append(got, float64(f.pts-testBase-testReorder)/90000)
+					if f.dts != f.pts-testReorder || f.pcr != f.dts {
+						t.Errorf("frame %d with pts %d, dts %d and pcr %d", i/2, f.pts, f.dts, f.pcr)
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("frames at %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrimReaderWithoutSegments(t *testing.T) {
+	r := newTrimReader(io.NopCloser(bytes.NewReader(testStream(2, true))), nil, false)
+	out, err := io.ReadAll(r)
+	if err != nil || len(out) != 0 {
+		t.Fatalf("read %d bytes and %v, want nothing", len(out), err)
+	}
+}
+
+func TestShiftPCR(t *testing.T) {
+	for _, tt := range []struct {
+		pcr, shift, want int64
+	}{
+		{pcr: 900000, shift: 90000, want: 810000},
+		{pcr: 900000, shift: 0, want: 900000},
+		{pcr: 90000, shift: 180000, want: tsTimestampMask + 1 - 90000},
+	} {
+		p := tsPacket(testVideoPid, false, false, tt.pcr, nil)
+		p[10] |= 0x01 // Extension bit kept
+		r := &trimReader{shift: tt.shift}
+		r.shiftPCR(p)
+		f := readFrames(t, p)[0]
+		if f.pcr != tt.want || p[10]&0x7f != 0x7f {
+			t.Errorf("pcr %d shifted %d is %d, want %d", tt.pcr, tt.shift, f.pcr, tt.want)
+		}
+	}
+}
+
+func TestTrimAfter(t *testing.T) {
+	segments := []Segment{{In: 10, Out: 20}, {In: 30, Out: 40}}
+	tests := []struct {
+		name     string
+		segments []Segment
+		elapsed  float64
+		want     []Segment
+	}{
+		{name: "nothing played", segments: segments, elapsed: 0, want: segments},
+		{name: "inside the first segment", segments: segments, elapsed: 4, want: []Segment{{In: 14, Out: 20}, {In: 30, Out: 40}}},
+		{name: "at the end of the first segment", segments: segments, elapsed: 10, want: []Segment{{In: 30, Out: 40}}},
+		{name: "inside the second segment", segments: segments, elapsed: 12.5, want: []Segment{{In: 32.5, Out: 40}}},
+		{name: "past every segment", segments: segments, elapsed: 25, want: []Segment{}},
+		{name: "segment to the end", segments: []Segment{{In: 10}}, elapsed: 100, want: []Segment{{In: 110}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := trimAfter(tt.segments, tt.elapsed); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTimecode(t *testing.T) {
+	tests := []struct {
+		timecode string
+		want     float64
+		err      bool
+	}{
+		{timecode: "01:02:03.500", want: 3723.5},
+		{timecode: "00:00:00.001", want: 0.001},
+		{timecode: "02:30", want: 150},
+		{timecode: "45", want: 45},
+		{timecode: "7.25", want: 7.25},
+		{timecode: " 10 ", want: 10},
+		{timecode: "", err: true},
+		{timecode: "abc", err: true},
+		{timecode: "-1", err: true},
+		{timecode: "01:60", err: true},
+		{timecode: "00:01:60", err: true},
+		{timecode: "1.5:00", err: true},
+		{timecode: "01:02:03:04", err: true},
+		{timecode: "01::03", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTimecode(tt.timecode)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: error %v", tt.timecode, err)
+			continue
+		}
+		if !tt.err && got != tt.want {
+			t.Errorf("%q is %v, want %v", tt.timecode, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package saovivo
+
+// tsClock follows the presentation timestamps of an mpegts stream to know how
+// many seconds of stream went through it.
+type tsClock struct {
+	first   int64
+	last    int64
+	seen    bool
+	pending []byte
+}
+
+const tsPacketSize = 188
+
+func (c *tsClock) Write(p []byte) (int, error) {
+	data := append(c.pending, p...)
+	for len(data) >= tsPacketSize {
+		if data[0] != 0x47 {
+			// Lost the sync byte, look for the next packet
+			data = data[1:]
+			continue
+		}
+		c.packet(data[:tsPacketSize])
+		data = data[tsPacketSize:]
+	}
+	c.pending = append(c.pending[:0], data...)
+	return len(p), nil
+}
+
+func (c *tsClock) packet(p []byte) {
+	if p[1]&0x40 == 0 { // Not the start of a PES
+		return
+	}
+	afc := (p[3] >> 4) & 0x03
+	if afc&0x01 == 0 { // Without payload
+		return
+	}
+	payload := p[4:]
+	if afc&0x02 != 0 {
+		if int(p[4])+1 >= len(payload) {
+			return
+		}
+		payload = payload[int(p[4])+1:]
+	}
+	if len(payload) < 14 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+		return
+	}
+	// Only audio and video streams
+	if payload[3] < 0xc0 || payload[3] > 0xef {
+		return
+	}
+	if payload[7]&0x80 == 0 {
+		return
+	}
+	pts := readTimestamp(payload[9:14])
+	if !c.seen || pts < c.first {
+		c.first = pts
+	}
+	if !c.seen || pts > c.last {
+		c.last = pts
+	}
+	c.seen = true
+}
+
+// Duration returns the seconds between the first and the last timestamp.
+func (c *tsClock) Duration() float64 {
+	if !c.seen {
+		return 0
+	}
+	return float64(c.last-c.first) / 90000
+}
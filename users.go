@@ -0,0 +1,383 @@
+package saovivo
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The roles are ordered, each one can do what the previous ones do.
+const (
+	RoleViewer   = "viewer"   // Sees the channels
+	RoleOperator = "operator" // Manages the playlists, the schedule and the graphics
+	RoleAdmin    = "admin"    // Manages the destinations, channels, profiles and users
+)
+
+var roleLevels = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// RoleAllows tells if role can do what needs the role required.
+func RoleAllows(role string, required string) bool {
+	return roleLevels[role] > 0 && roleLevels[role] >= roleLevels[required]
+}
+
+// sessionTime is how long a login lasts without using it
+var sessionTime = 12 * time.Hour
+
+const passwordIterations = 100000
+
+type User struct {
+	Name    string    `json:"name"`
+	Role    string    `json:"role"`
+	Salt    string    `json:"salt,omitempty"`
+	Hash    string    `json:"hash,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Token is a key given to a script to use the API as a user, only its hash
+// is kept.
+type Token struct {
+	Id      string    `json:"id"`
+	Name    string    `json:"name"`
+	User    string    `json:"user"`
+	Hash    string    `json:"hash,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+type usersState struct {
+	Users  []User  `json:"users"`
+	Tokens []Token `json:"tokens"`
+}
+
+type session struct {
+	user    string
+	expires time.Time
+}
+
+// Users keeps the accounts and the API tokens, the logins are kept in memory
+// and are lost on restart.
+type Users struct {
+	store    *Store
+	users    []*User
+	tokens   []*Token
+	sessions map[string]*session // By hash of the session key
+	lock     *sync.Mutex
+}
+
+func NewUsers(store *Store) *Users {
+	var state usersState
+	u := &Users{store: store, users: []*User{}, tokens: []*Token{}, sessions: make(map[string]*session), lock: &sync.Mutex{}}
+	if err := store.Load(&state); err != nil && !os.IsNotExist(err) {
+		lerr.Printf("Users: unable to restore: %v", err)
+	}
+	for i := range state.Users {
+		u.users = append(u.users, &state.Users[i])
+	}
+	for i := range state.Tokens {
+		u.tokens = append(u.tokens, &state.Tokens[i])
+	}
+	return u
+}
+
+// save must be called with the lock held.
+func (u *Users) save() error {
+	state := usersState{Users: []User{}, Tokens: []Token{}}
+	for _, user := range u.users {
+		state.Users = append(state.Users, *user)
+	}
+	for _, t := range u.tokens {
+		state.Tokens = append(state.Tokens, *t)
+	}
+	return u.store.Save(&state)
+}
+
+// pbkdf2 derives a key from a password with HMAC-SHA256 (RFC 8018).
+func pbkdf2(password []byte, salt []byte, iterations int, length int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := []byte{}
+	for block := uint32(1); len(key) < length; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:length]
+}
+
+func randomKey(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// NewPassword returns a random password for a user created by the server.
+func NewPassword() string {
+	return randomKey(9)
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (user *User) setPassword(password string) error {
+	if len(password) < 8 {
+		return fmt.Errorf("the password must have at least 8 characters")
+	}
+	user.Salt = randomKey(16)
+	user.Hash = hex.EncodeToString(pbkdf2([]byte(password), []byte(user.Salt), passwordIterations, 32))
+	return nil
+}
+
+func (user *User) checkPassword(password string) bool {
+	hash := hex.EncodeToString(pbkdf2([]byte(password), []byte(user.Salt), passwordIterations, 32))
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(user.Hash)) == 1
+}
+
+// public returns the user without its password.
+func (user User) public() User {
+	user.Salt, user.Hash = "", ""
+	return user
+}
+
+func (u *Users) get(name string) *User {
+	for _, user := range u.users {
+		if user.Name == name {
+			return user
+		}
+	}
+	return nil
+}
+
+func (u *Users) Len() int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return len(u.users)
+}
+
+func (u *Users) List() []User {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	users := []User{}
+	for _, user := range u.users {
+		users = append(users, user.public())
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+	return users
+}
+
+func (u *Users) Add(name string, password string, role string) (User, error) {
+	if name == "" {
+		return User{}, fmt.Errorf("user without name")
+	}
+	if roleLevels[role] == 0 {
+		return User{}, fmt.Errorf("wrong role %q, must be viewer, operator or admin", role)
+	}
+	user := &User{Name: name, Role: role, Created: time.Now()}
+	if err := user.setPassword(password); err != nil {
+		return User{}, err
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.get(name) != nil {
+		return User{}, fmt.Errorf("user %s already exists", name)
+	}
+	u.users = append(u.users, user)
+	return user.public(), u.save()
+}
+
+// admins returns how many admins there are, must be called with the lock
+// held.
+func (u *Users) admins() int {
+	n := 0
+	for _, user := range u.users {
+		if user.Role == RoleAdmin {
+			n++
+		}
+	}
+	return n
+}
+
+// Update changes the role or the password of a user, empty leaves it as it
+// is. The last admin can not lose its role.
+func (u *Users) Update(name string, password string, role string) (User, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	user := u.get(name)
+	if user == nil {
+		return User{}, fmt.Errorf("user %s not found", name)
+	}
+	updated := *user
+	if role != "" {
+		if roleLevels[role] == 0 {
+			return User{}, fmt.Errorf("wrong role %q, must be viewer, operator or admin", role)
+		}
+		if user.Role == RoleAdmin && role != RoleAdmin && u.admins() == 1 {
+			return User{}, fmt.Errorf("the last admin can not lose its role")
+		}
+		updated.Role = role
+	}
+	if password != "" {
+		if err := updated.setPassword(password); err != nil {
+			return User{}, err
+		}
+		u.endSessions(name)
+	}
+	*user = updated
+	return user.public(), u.save()
+}
+
+// Remove drops a user with its tokens and logins, the last admin can not be
+// removed.
+func (u *Users) Remove(name string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for i, user := range u.users {
+		if user.Name != name {
+			continue
+		}
+		if user.Role == RoleAdmin && u.admins() == 1 {
+			return fmt.Errorf("the last admin can not be removed")
+		}
+		u.users = append(u.users[:i], u.users[i+1:]...)
+		tokens := []*Token{}
+		for _, t := range u.tokens {
+			if t.User != name {
+				tokens = append(tokens, t)
+			}
+		}
+		u.tokens = tokens
+		u.endSessions(name)
+		return u.save()
+	}
+	return fmt.Errorf("user %s not found", name)
+}
+
+// endSessions must be called with the lock held.
+func (u *Users) endSessions(name string) {
+	for key, s := range u.sessions {
+		if s.user == name {
+			delete(u.sessions, key)
+		}
+	}
+}
+
+// Login checks the password and returns the key of a new session.
+func (u *Users) Login(name string, password string) (string, User, error) {
+	u.lock.Lock()
+	user := u.get(name)
+	u.lock.Unlock()
+	if user == nil || !user.checkPassword(password) {
+		return "", User{}, fmt.Errorf("wrong user or password")
+	}
+	key := randomKey(32)
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for k, s := range u.sessions {
+		if time.Now().After(s.expires) {
+			delete(u.sessions, k)
+		}
+	}
+	u.sessions[hashKey(key)] = &session{user: name, expires: time.Now().Add(sessionTime)}
+	return key, user.public(), nil
+}
+
+func (u *Users) Logout(key string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	delete(u.sessions, hashKey(key))
+}
+
+// Resolve returns the user of a session key or an API token, the session is
+// extended on every use.
+func (u *Users) Resolve(key string) (User, bool) {
+	if key == "" {
+		return User{}, false
+	}
+	hash := hashKey(key)
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if s, ok := u.sessions[hash]; ok {
+		if time.Now().After(s.expires) {
+			delete(u.sessions, hash)
+		} else if user := u.get(s.user); user != nil {
+			s.expires = time.Now().Add(sessionTime)
+			return user.public(), true
+		}
+	}
+	for _, t := range u.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+			if user := u.get(t.User); user != nil {
+				return user.public(), true
+			}
+		}
+	}
+	return User{}, false
+}
+
+// Tokens returns the tokens of a user, every token when user is empty.
+func (u *Users) Tokens(user string) []Token {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	tokens := []Token{}
+	for _, t := range u.tokens {
+		if user == "" || t.User == user {
+			c := *t
+			c.Hash = ""
+			tokens = append(tokens, c)
+		}
+	}
+	return tokens
+}
+
+// AddToken creates an API token for a user, the key is returned only here.
+func (u *Users) AddToken(user string, name string) (Token, string, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.get(user) == nil {
+		return Token{}, "", fmt.Errorf("user %s not found", user)
+	}
+	key := "sv_" + randomKey(24)
+	t := &Token{Id: uuid.New().String(), Name: name, User: user, Hash: hashKey(key), Created: time.Now()}
+	u.tokens = append(u.tokens, t)
+	c := *t
+	c.Hash = ""
+	return c, key, u.save()
+}
+
+// RemoveToken drops a token, owner limits it to the tokens of that user when
+// it is not empty.
+func (u *Users) RemoveToken(id string, owner string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for i, t := range u.tokens {
+		if t.Id == id && (owner == "" || t.User == owner) {
+			u.tokens = append(u.tokens[:i], u.tokens[i+1:]...)
+			return u.save()
+		}
+	}
+	return fmt.Errorf("token %s not found", id)
+}
@@ -1,15 +1,34 @@
 package saovivo
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
-	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type VideoChannel struct {
-	Input  chan<- *VideoFile
+	Input  chan<- *Asset
 	Output <-chan error
 	Abort  chan<- bool
+
+	skip      chan bool
+	options   ChannelOptions
+	lock      *sync.Mutex
+	broadcast *Broadcast
+	attempts  int
+}
+
+// Skip ends the video in play, the channel keeps sending to the destinations
+// and waits for the next video.
+func (v *VideoChannel) Skip() {
+	select {
+	case v.skip <- true:
+	default:
+	}
 }
 
 func (v *VideoChannel) Stop() {
@@ -18,50 +37,206 @@ func (v *VideoChannel) Stop() {
 	lout.Println("Stoped video channel")
 }
 
-func NewVideoChannel(rtmpOutput string, storage string) (*VideoChannel, error) {
-	channel := make(chan *VideoFile)
+func (v *VideoChannel) getBroadcast() *Broadcast {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.broadcast
+}
+
+func (v *VideoChannel) AddDestination(d Destination) error {
+	return v.getBroadcast().Add(d)
+}
+
+func (v *VideoChannel) RemoveDestination(id string) {
+	v.getBroadcast().Remove(id)
+}
+
+func (v *VideoChannel) Destinations() []DestinationStatus {
+	return v.getBroadcast().Status()
+}
+
+// Attempts returns the number of the attempt to restart the output in
+// course, 0 when the output is working.
+func (v *VideoChannel) Attempts() int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.attempts
+}
+
+// restart creates a new output after a failure following the reconnect
+// policy, it returns nil when the channel has to end.
+func (v *VideoChannel) restart(cause error, abort <-chan bool) *Broadcast {
+	policy := v.options.Reconnect
+	destinations := v.getBroadcast().configured()
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		v.lock.Lock()
+		v.attempts = attempt
+		v.lock.Unlock()
+		// A stop already requested is not made to wait for the notification
+		select {
+		case <-abort:
+			return nil
+		default:
+		}
+		if v.options.NotifyReconnect != nil {
+			v.options.NotifyReconnect(attempt, cause)
+		}
+		select {
+		case <-time.After(policy.delay(attempt)):
+		case <-abort:
+			return nil
+		}
+		rtmp, err := NewBroadcast(destinations, v.options)
+		if err == nil {
+			v.lock.Lock()
+			v.broadcast = rtmp
+			v.attempts = 0
+			v.lock.Unlock()
+			lout.Printf("VideoChannel: output restarted on attempt %d", attempt)
+			return rtmp
+		}
+		lerr.Printf("VideoChannel: restart attempt %d: %v", attempt, err)
+		cause = err
+	}
+	v.lock.Lock()
+	v.attempts = 0
+	v.lock.Unlock()
+	return nil
+}
+
+// resumeOffset returns the byte where a local file has to be resumed after
+// playing it for elapsed seconds, the first keyframe from there by the
+// timestamps of the file. It is 0 when there is none.
+func resumeOffset(f io.Reader, elapsed float64) int64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	r := bufio.NewReaderSize(f, 1<<20)
+	p := make([]byte, tsPacketSize)
+	base := int64(-1)
+	video := false
+	for offset := int64(0); ; offset += tsPacketSize {
+		if _, err := io.ReadFull(r, p); err != nil || p[0] != 0x47 {
+			return 0
+		}
+		payload := pesStart(p)
+		if payload == nil {
+			continue
+		}
+		ts, ok := pesTimestamp(payload)
+		if !ok {
+			continue
+		}
+		if base < 0 {
+			base = ts
+		}
+		// The video decides, every audio frame is a keyframe
+		isVideo := payload[3]&0xf0 == 0xe0
+		video = video || isVideo
+		if video && !isVideo || isVideo && !randomAccess(p) {
+			continue
+		}
+		if (ts-base)&tsTimestampMask >= ticks(Timecode(elapsed)) {
+			return offset
+		}
+	}
+}
+
+// ingestJob is the transcode of a remote video or a live source running while
+// it is sent to the destinations.
+type ingestJob interface {
+	Stop()
+	Wait() error
+}
+
+// NewVideoChannel starts a channel sending to every enabled destination.
+func NewVideoChannel(destinations []Destination, storage string, options ChannelOptions) (*VideoChannel, error) {
+	channel := make(chan *Asset)
 	abort := make(chan bool)
 	output := make(chan error)
+	skip := make(chan bool, 1)
 
-	rtmp, err := NewRtmpOutput(rtmpOutput)
+	rtmp, err := NewBroadcast(destinations, options)
 	if err != nil {
 		return nil, err
 	}
+	v := &VideoChannel{Input: channel, Output: output, Abort: abort, skip: skip, options: options, lock: &sync.Mutex{}, broadcast: rtmp}
 
 	go func() {
 		lout.Println("VideoChannel: Start")
 		for {
 			lout.Println("VideoChannel: loop")
 			var (
+				asset     *Asset
 				video     *VideoFile
-				ingest    *VideoIngest
+				ingest    ingestJob
+				liveEnd   <-chan time.Time
 				end       bool
 				ingestRun bool
+				source    io.ReadCloser
+				started   time.Time
+				elapsed   float64 // Seconds played before a restart of the output
+				lead      float64 // Seconds of black before the video
+				duration  float64
 			)
 			ingestRun = false
 			select {
-			case video = <-channel:
+			case asset = <-channel:
 			case end = <-abort:
 			}
-			lout.Println("VideoChannel: video", video, end)
-			if video == nil || end {
+			lout.Println("VideoChannel: video", asset, end)
+			if asset == nil || end {
 				rtmp.Input <- nil // Signal to end
 				<-rtmp.Output     // Wait end
 				output <- nil     // Own signal to say goodbye
 				goto end_loop
 			}
 
-			videoLocal := filepath.Join(storage, video.Local)
-			if _, err := os.Stat(videoLocal); err != nil {
+			// A skip requested after the previous video ended
+			select {
+			case <-skip:
+			default:
+			}
+
+			if d, err := strconv.ParseFloat(asset.Duration, 64); err == nil {
+				duration = d
+			}
+			// A reconnect does not extend a live source
+			if asset.Live != nil && asset.Live.Duration > 0 {
+				liveEnd = time.After(time.Duration(asset.Live.Duration * float64(time.Second)))
+			}
+		play:
+			ingestRun = false
+			video = &asset.Video
+			videoLocal := options.profile().localPath(storage, video.Local)
+			if asset.Live != nil {
+				lout.Printf("VideoChannel: live source %s: %s", asset.Live.Kind, asset.Live.Url)
+				live, err := NewLiveIngest(*asset.Live, options.profile())
+				if err != nil {
+					lerr.Printf("VideoChannel: impossible to create a live ingest: %v", err)
+					output <- fmt.Errorf("Ingest")
+					continue
+				}
+				ingest, ingestRun, source = live, true, live.File
+			} else if _, err := os.Stat(videoLocal); err != nil {
 				lout.Println("VideoChannel: local files does not exist, creating new ingest job")
-				ingest, err = NewVideoIngest(video.Remote, videoLocal)
+				slate := ""
+				if asset.AudioOnly {
+					slate = options.Slate
+				}
+				vi, err := NewVideoIngest(video.Remote, videoLocal, options.profile(), slate)
 				if err != nil {
 					lerr.Printf("VideoChannel: impossible to create a new ingest job: %v", err)
 					output <- fmt.Errorf("Ingest")
 					continue
 				}
-				ingestRun = true
-				rtmp.Input <- ingest.File
+				if options.Prefetcher != nil {
+					options.Prefetcher.Follow(asset, options.profile(), vi.Progress())
+				}
+				ingest, ingestRun, source = vi, true, vi.File
+				if len(asset.Segments) > 0 {
+					source = newTrimReader(vi.File, asset.Segments, true)
+				}
 			} else {
 				lout.Printf("VideoChannel: processing local file: %s", videoLocal)
 				rc, err := os.Open(videoLocal)
@@ -70,16 +245,49 @@ func NewVideoChannel(rtmpOutput string, storage string) (*VideoChannel, error) {
 					output <- fmt.Errorf("Ingest")
 					continue
 				}
-				rtmp.Input <- rc
+				source = rc
+				if len(asset.Segments) > 0 {
+					segments := asset.Segments
+					if options.Reconnect.Resume && elapsed > 0 {
+						lout.Printf("VideoChannel: resume trimmed local file at %.2f seconds", elapsed)
+						segments = trimAfter(segments, elapsed)
+					}
+					source = newTrimReader(rc, segments, false)
+				} else if options.Reconnect.Resume && elapsed > 0 {
+					offset := resumeOffset(rc, elapsed)
+					lout.Printf("VideoChannel: resume local file at %.2f seconds, byte %d", elapsed, offset)
+					rc.Seek(offset, io.SeekStart)
+				}
 			}
+			if ingestRun {
+				// A remote video starts again from the beginning
+				elapsed = 0
+			}
+			item := &PlayoutItem{Video: source, Duration: duration}
+			lead = 0
+			if asset.Transition != nil && elapsed == 0 {
+				item.Transition = *asset.Transition
+				if options.Continuous && item.Transition.Kind == BlackTransition {
+					lead = item.Transition.Duration
+				}
+			}
+			started = time.Now()
+			rtmp.Input <- item
 			select {
+			case <-skip:
+				lout.Printf("VideoChannel: skip video.")
+			case <-liveEnd:
+				lout.Printf("VideoChannel: live source duration reached.")
 			case <-abort:
 				lout.Printf("VideoChannel: abort operation.")
 				rtmp.Stop()
 				<-rtmp.Output
 				if ingestRun {
+					if asset.Live != nil {
+						ingest.Stop()
+					}
 					lout.Printf("VideoChannel: waiting ingest Job.")
-					<-ingest.Output
+					ingest.Wait()
 					lout.Printf("VideoChannel: end ingest Job.")
 				}
 				output <- fmt.Errorf("Abort")
@@ -88,11 +296,27 @@ func NewVideoChannel(rtmpOutput string, storage string) (*VideoChannel, error) {
 				lout.Printf("VideoChannel: rtmp return %v", re)
 				if re != nil {
 					lerr.Printf("VideoChannel: rtmp output with errors: %v", re)
-					output <- fmt.Errorf("Abort")
-					goto end_loop
+					if ingestRun {
+						ingest.Stop()
+						ingest.Wait()
+					}
+					// The black of the transition is not part of the video
+					if played := time.Since(started).Seconds() - lead; played > 0 {
+						elapsed += played
+					}
+					if rtmp = v.restart(re, abort); rtmp == nil {
+						output <- fmt.Errorf("Abort")
+						goto end_loop
+					}
+					goto play
 				}
-				if ingestRun {
-					e := <-ingest.Output
+				if trim, ok := source.(*trimReader); ok && ingestRun && trim.stopped() {
+					// The rest of the source goes on to the cache while the
+					// next video plays
+					go ingest.Wait()
+					output <- re
+				} else if ingestRun {
+					e := ingest.Wait()
 					if e != nil {
 						output <- fmt.Errorf("Ingest")
 					} else {
@@ -101,10 +325,30 @@ func NewVideoChannel(rtmpOutput string, storage string) (*VideoChannel, error) {
 				} else {
 					output <- re
 				}
+				continue
+			}
+
+			// Skipped or the live source is over
+			if ingestRun {
+				ingest.Stop()
+			} else {
+				source.Close()
+			}
+			if re := <-rtmp.Output; re != nil {
+				if ingestRun {
+					ingest.Wait()
+				}
+				lerr.Printf("VideoChannel: rtmp output with errors: %v", re)
+				output <- fmt.Errorf("Abort")
+				goto end_loop
+			}
+			if ingestRun {
+				ingest.Wait()
 			}
+			output <- nil
 		}
 	end_loop:
 		lout.Println("VideoChannel: End")
 	}()
-	return &VideoChannel{channel, output, abort}, nil
+	return v, nil
 }
@@ -0,0 +1,31 @@
+package saovivo
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestResumeOffset(t *testing.T) {
+	// Keyframes every second, a video frame is two packets
+	video := testStream(5, true)
+	audio := testStream(5, false)
+	tests := []struct {
+		name    string
+		stream  []byte
+		elapsed float64
+		want    int64
+	}{
+		{name: "not played", stream: video, elapsed: 0, want: 0},
+		{name: "on a keyframe", stream: video, elapsed: 2, want: 8 * tsPacketSize},
+		{name: "between keyframes", stream: video, elapsed: 2.2, want: 12 * tsPacketSize},
+		{name: "past the last keyframe", stream: video, elapsed: 4.6, want: 0},
+		{name: "audio", stream: audio, elapsed: 1.2, want: 3 * tsPacketSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resumeOffset(bytes.NewReader(tt.stream), tt.elapsed); got != tt.want {
+				t.Errorf("offset %d, want %d", got, tt.want)
+			}
+		})
+	}
+}